@@ -0,0 +1,208 @@
+package porter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+The header the trusted proxies report the address of the client in.
+*/
+type ForwardingHeader uint8
+
+const (
+	/*
+		X-Forwarded-For: client, proxy1, proxy2
+	*/
+	XForwardedFor ForwardingHeader = iota
+	/*
+		Forwarded: for=client, for=proxy1 (RFC 7239)
+	*/
+	ForwardedHeader
+	/*
+		X-Real-IP: client, set by a single proxy
+	*/
+	XRealIP
+)
+
+func (h ForwardingHeader) String() string {
+	switch h {
+	case XForwardedFor:
+		return "X-Forwarded-For"
+	case ForwardedHeader:
+		return "Forwarded"
+	case XRealIP:
+		return "X-Real-IP"
+	}
+	return "unknown"
+}
+
+/*
+Resolves the address of the client of an HTTP request behind reverse proxies and load balancers.
+
+Only the configured forwarding header is read, the one the proxies set.
+Other forwarding headers are ignored: a proxy passes them through from the client unchanged,
+so falling back to them would let the client choose its address.
+The header is accepted only from trusted proxies. Its hops are walked from the nearest one
+while they are trusted proxies, so a client cannot spoof its address by sending the header itself.
+A hop that is not an IP address ("unknown" or an obfuscated identifier) stops the walk at the proxy reporting it.
+*/
+type RemoteAddressResolver struct {
+	header  ForwardingHeader
+	trusted []*net.IPNet
+}
+
+/*
+Creates the resolver reading the header of the proxies trusted by their addresses or CIDR blocks ("10.0.0.0/8").
+Returns the InvalidAddress error if a proxy is neither of them.
+Without trusted proxies the address of the connection is used.
+*/
+func NewRemoteAddressResolver(header ForwardingHeader, trustedProxies ...string) (*RemoteAddressResolver, error) {
+	resolver := &RemoteAddressResolver{header: header}
+	for _, proxy := range trustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+/*
+Parses the CIDR block or the single address as a network.
+*/
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.New(InvalidAddress)
+		}
+		return network, nil
+	}
+	ip := parseIP(value)
+	if ip == nil {
+		return nil, errors.New(InvalidAddress)
+	}
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+/*
+Returns the normalized address of the client of the request. See: NormalizeAddress
+*/
+func (r *RemoteAddressResolver) Resolve(request *http.Request) string {
+	return r.ResolveAddress(request.RemoteAddr, request.Header)
+}
+
+/*
+Returns the normalized address of the client by the address of the connection and the request headers.
+*/
+func (r *RemoteAddressResolver) ResolveAddress(remoteAddress string, header http.Header) string {
+	peer := NormalizeAddress(remoteAddress)
+	if !r.isTrusted(peer) {
+		return peer
+	}
+	hops := forwardedHops(header, r.header)
+	if len(hops) == 0 {
+		return peer
+	}
+	resolved := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := NormalizeAddress(hops[i])
+		if parseIP(hop) == nil {
+			break
+		}
+		resolved = hop
+		if !r.isTrusted(hop) {
+			break
+		}
+	}
+	return resolved
+}
+
+func (r *RemoteAddressResolver) isTrusted(address string) bool {
+	if r == nil {
+		return false
+	}
+	ip := parseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the client addresses of the forwarding header, the farthest hop first.
+*/
+func forwardedHops(header http.Header, forwarding ForwardingHeader) []string {
+	hops := []string{}
+	switch forwarding {
+	case ForwardedHeader:
+		for _, value := range header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					split := strings.IndexByte(pair, '=')
+					if split > 0 && strings.EqualFold(strings.TrimSpace(pair[:split]), "for") {
+						hops = append(hops, strings.Trim(strings.TrimSpace(pair[split+1:]), `"`))
+					}
+				}
+			}
+		}
+	case XForwardedFor:
+		for _, value := range header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	case XRealIP:
+		if value := strings.TrimSpace(header.Get("X-Real-IP")); value != "" {
+			hops = append(hops, value)
+		}
+	}
+	return hops
+}
+
+/*
+Returns the IP address without the port, IPv4-mapped IPv6 addresses as IPv4 and IPv6 addresses in the canonical form.
+Other values are returned as is.
+*/
+func NormalizeAddress(address string) string {
+	host := address
+	if split, _, err := net.SplitHostPort(address); err == nil {
+		host = split
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := parseIP(host); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+/*
+Parses the IP address, IPv4 addresses are returned in the 4 byte form.
+*/
+func parseIP(value string) net.IP {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+/*
+Returns TRUE if the addresses are equal after normalization.
+*/
+func sameAddress(a string, b string) bool {
+	return a == b || NormalizeAddress(a) == NormalizeAddress(b)
+}
@@ -0,0 +1,151 @@
+package porter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	addresses := map[string]string{
+		"10.0.0.1":                "10.0.0.1",
+		"10.0.0.1:4000":           "10.0.0.1",
+		"::ffff:10.0.0.1":         "10.0.0.1",
+		"[::ffff:10.0.0.1]:4000":  "10.0.0.1",
+		"[2001:DB8:0::1]:4000":    "2001:db8::1",
+		"[2001:db8::1]":           "2001:db8::1",
+		"remote1":                 "remote1",
+		"unknown":                 "unknown",
+		"":                        "",
+		"2001:0db8:0000::0000:01": "2001:db8::1",
+	}
+	for address, expected := range addresses {
+		if normalized := NormalizeAddress(address); normalized != expected {
+			t.Errorf("%s is normalized as %s, expected %s", address, normalized, expected)
+		}
+	}
+}
+
+func TestRemoteAddressResolver(t *testing.T) {
+	if _, err := NewRemoteAddressResolver(XForwardedFor, "10.0.0.0/33"); err == nil || err.Error() != InvalidAddress {
+		t.Error("Invalid CIDR is accepted")
+	}
+	if _, err := NewRemoteAddressResolver(XForwardedFor, "proxy"); err == nil || err.Error() != InvalidAddress {
+		t.Error("Invalid address is accepted")
+	}
+	resolvers := map[ForwardingHeader]*RemoteAddressResolver{}
+	for _, header := range []ForwardingHeader{XForwardedFor, ForwardedHeader, XRealIP} {
+		resolver, err := NewRemoteAddressResolver(header, "10.0.0.0/8", "2001:db8::1")
+		check(err, t)
+		resolvers[header] = resolver
+	}
+
+	tests := []struct {
+		forwarding ForwardingHeader
+		peer       string
+		header     http.Header
+		expected   string
+	}{
+		{XForwardedFor, "203.0.113.9:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{}, "10.0.0.1"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"6.6.6.6", "198.51.100.1:5000"}}, "198.51.100.1"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"Forwarded": {"for=1.2.3.4"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{XForwardedFor, "10.0.0.1:4000", http.Header{"X-Real-Ip": {"1.2.3.4"}}, "10.0.0.1"},
+		{XRealIP, "[::ffff:10.0.0.1]:4000", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{XRealIP, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "10.0.0.1"},
+		{ForwardedHeader, "[2001:db8::1]:4000", http.Header{"Forwarded": {`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https`}}, "2001:db8:cafe::17"},
+		{ForwardedHeader, "10.0.0.1:4000", http.Header{"Forwarded": {"For=198.51.100.1;by=10.0.0.1"}, "X-Forwarded-For": {"6.6.6.6"}}, "198.51.100.1"},
+		{ForwardedHeader, "10.0.0.1:4000", http.Header{"Forwarded": {"for=198.51.100.1, for=unknown"}}, "10.0.0.1"},
+		{ForwardedHeader, "10.0.0.1:4000", http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{ForwardedHeader, "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		if resolved := resolvers[test.forwarding].ResolveAddress(test.peer, test.header); resolved != test.expected {
+			t.Errorf("%s %s %v is resolved as %s, expected %s", test.forwarding, test.peer, test.header, resolved, test.expected)
+		}
+	}
+	var direct *RemoteAddressResolver
+	if resolved := direct.ResolveAddress("10.0.0.1:4000", http.Header{"X-Forwarded-For": {"6.6.6.6"}}); resolved != "10.0.0.1" {
+		t.Error("Headers are trusted without proxies")
+	}
+}
+
+func TestLoginAddress(t *testing.T) {
+	resolver, err := NewRemoteAddressResolver(XForwardedFor, "10.0.0.0/8")
+	check(err, t)
+	principal := ap{false, true, true}
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.LoginFilter = func(context interface{}) (AuthenticationPrincipal, string, error) {
+			return principal, "", nil
+		}
+		configuration.MultiLogin = AllowNewFromSameAddress
+		configuration.Binding = BindAddress
+		configuration.AddressResolver = resolver
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/login", nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	request.Header.Set("X-Forwarded-For", "[::ffff:198.51.100.1]:5000")
+	first, err := security.Login(request)
+	check(err, t)
+	if first.ID.RemoteAddress != "198.51.100.1" {
+		t.Errorf("Unexpected address %s", first.ID.RemoteAddress)
+	}
+
+	request.Header.Set("X-Forwarded-For", "198.51.100.1:6000")
+	second, err := security.Login(request)
+	check(err, t)
+	if _, err = security.Authenticate(first.ID); err != nil {
+		t.Error("Session from the same address is removed")
+	}
+	identifier := second.ID
+	identifier.RemoteAddress = "[::ffff:198.51.100.1]:7000"
+	if _, err = security.Authenticate(identifier); err != nil {
+		t.Error("Session is not found by an equal address")
+	}
+	identifier.RemoteAddress = "198.51.100.2"
+	if _, err = security.Authenticate(identifier); err == nil {
+		t.Error("Session is found by another address")
+	}
+
+	request.Header.Set("X-Forwarded-For", "198.51.100.2")
+	_, err = security.Login(request)
+	check(err, t)
+	if _, err = security.Authenticate(first.ID); err == nil {
+		t.Error("Session from another address is kept")
+	}
+}
+
+func TestAuthenticate_Proxied(t *testing.T) {
+	resolver, err := NewRemoteAddressResolver(XForwardedFor, "10.0.0.0/8")
+	check(err, t)
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.LoginFilter = func(context interface{}) (AuthenticationPrincipal, string, error) {
+			return ap{false, true, true}, "", nil
+		}
+		configuration.AuthenticationFilter = requestIdentifier
+		configuration.Binding = BindAddress
+		configuration.AddressResolver = resolver
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/login", nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	session, err := security.Login(request)
+	check(err, t)
+
+	request = sessionRequest(http.MethodGet, "/", session)
+	request.RemoteAddr = "10.0.0.2:4000"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	authenticated, err := security.Authenticate(request)
+	check(err, t)
+	if authenticated.ID.RemoteAddress != "198.51.100.1" {
+		t.Errorf("Unexpected address %s", authenticated.ID.RemoteAddress)
+	}
+
+	request.Header.Set("X-Forwarded-For", "198.51.100.2")
+	if _, err = security.Authenticate(request); err == nil {
+		t.Error("Session is found from another client behind the proxy")
+	}
+}
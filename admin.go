@@ -0,0 +1,329 @@
+package porter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The default and the maximum number of sessions returned by one listing of AdminHandler.
+*/
+const (
+	adminDefaultLimit = 100
+	adminMaxLimit     = 1000
+)
+
+/*
+Session as returned by AdminHandler. The ID is the SID, the SSID is never exposed.
+The internal attributes of porter, "porter.*", are not exposed either: they hold the CSRF secrets.
+*/
+type AdminSession struct {
+	ID            string            `json:"id"`
+	Realm         string            `json:"realm"`
+	PrincipalID   string            `json:"principal_id"`
+	RemoteAddress string            `json:"remote_addr"`
+	Created       time.Time         `json:"created"`
+	Refreshed     time.Time         `json:"refreshed"`
+	Expires       time.Time         `json:"expires"`
+	Expired       bool              `json:"expired"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+}
+
+/*
+Statistics of a realm as returned by AdminHandler.
+*/
+type AdminStats struct {
+	Realm      string      `json:"realm"`
+	Sessions   int         `json:"sessions"`
+	Principals int         `json:"principals"`
+	Expired    int         `json:"expired"`
+	Cache      *CacheStats `json:"cache,omitempty"`
+}
+
+/*
+http.Handler of the session management API. All responses are JSON.
+
+	GET    /sessions                   lists sessions, see: AdminHandler.list
+	GET    /sessions/{sid}             returns the session
+	DELETE /sessions/{sid}             revokes the session
+	DELETE /principals/{id}/sessions   revokes all sessions of the principal
+	GET    /stats                      returns the statistics of all realms
+
+Every endpoint accepts the realm query parameter, the default realm by default.
+Mount the handler with http.StripPrefix to serve it under a prefix.
+*/
+type AdminHandler struct {
+	security  *Security
+	authorize func(request *http.Request) bool
+}
+
+/*
+Creates the handler. Requests are served only if authorize returns TRUE, a nil authorize rejects all requests.
+*/
+func NewAdminHandler(security *Security, authorize func(request *http.Request) bool) *AdminHandler {
+	return &AdminHandler{security: security, authorize: authorize}
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(value)
+}
+
+func writeError(writer http.ResponseWriter, status int, code string) {
+	writeJSON(writer, status, adminError{code})
+}
+
+/*
+Writes the error of a session operation.
+*/
+func writeSessionError(writer http.ResponseWriter, err error) {
+	switch err.Error() {
+	case SessionNotFound, RealmNotFound:
+		writeError(writer, http.StatusNotFound, err.Error())
+	default:
+		writeError(writer, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *AdminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if h.authorize == nil || !h.authorize(request) {
+		writeError(writer, http.StatusForbidden, "Forbidden")
+		return
+	}
+	path := "/" + strings.Trim(request.URL.Path, "/")
+	switch {
+	case path == "/stats":
+		h.route(writer, request, h.stats, nil)
+	case path == "/sessions":
+		h.route(writer, request, h.list, nil)
+	case strings.HasPrefix(path, "/sessions/"):
+		sid := strings.TrimPrefix(path, "/sessions/")
+		h.route(writer, request, func(writer http.ResponseWriter, request *http.Request) {
+			h.inspect(writer, request, sid)
+		}, func(writer http.ResponseWriter, request *http.Request) {
+			h.revoke(writer, request, sid)
+		})
+	case strings.HasPrefix(path, "/principals/") && strings.HasSuffix(path, "/sessions"):
+		principalId := strings.TrimSuffix(strings.TrimPrefix(path, "/principals/"), "/sessions")
+		h.route(writer, request, nil, func(writer http.ResponseWriter, request *http.Request) {
+			h.revokePrincipal(writer, request, principalId)
+		})
+	default:
+		writeError(writer, http.StatusNotFound, "NotFound")
+	}
+}
+
+/*
+Dispatches the request by its method, nil handlers are not allowed.
+*/
+func (h *AdminHandler) route(writer http.ResponseWriter, request *http.Request, get http.HandlerFunc, remove http.HandlerFunc) {
+	switch {
+	case request.Method == http.MethodGet && get != nil:
+		get(writer, request)
+	case request.Method == http.MethodDelete && remove != nil:
+		remove(writer, request)
+	default:
+		writeError(writer, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (h *AdminHandler) realm(request *http.Request) (*Realm, error) {
+	return h.security.Realm(request.URL.Query().Get("realm"))
+}
+
+/*
+Returns TRUE for the attributes set by porter itself.
+*/
+func internalAttribute(key string) bool {
+	return strings.HasPrefix(key, "porter.")
+}
+
+func newAdminSession(session *Session, configuration *sessionConfiguration) AdminSession {
+	attributes := session.Attributes()
+	for key := range attributes {
+		if internalAttribute(key) {
+			delete(attributes, key)
+		}
+	}
+	return AdminSession{
+		ID:            session.ID.SID,
+		Realm:         session.ID.Realm,
+		PrincipalID:   session.Principal.ID(),
+		RemoteAddress: session.ID.RemoteAddress,
+		Created:       session.startTime,
+		Refreshed:     session.lastRefresh(),
+		Expires:       session.expirationTime,
+		Expired:       session.expiredBy(configuration) != "",
+		Attributes:    attributes,
+	}
+}
+
+/*
+Lists a page of the sessions of the realm, filtered by the query parameters:
+principal (ID), principal_prefix, remote (address or CIDR block),
+min_age and max_age (durations since the creation, "1h30m") and attribute (key=value, repeatable, not of the internal attributes).
+The order parameter is one of the SessionOrder values, desc=true reverses it.
+The limit parameter is the size of the page, 100 by default, 1000 at most.
+The response includes the cursor of the next page, pass it back as the cursor parameter.
+*/
+func (h *AdminHandler) list(writer http.ResponseWriter, request *http.Request) {
+	realm, err := h.realm(request)
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	query, ok := adminQuery(request)
+	if !ok {
+		writeError(writer, http.StatusBadRequest, InvalidSessionQuery)
+		return
+	}
+	page, err := realm.QuerySessions(query)
+	if err != nil {
+		if err.Error() == InvalidSessionQuery {
+			writeError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeSessionError(writer, err)
+		return
+	}
+	sessions := make([]AdminSession, 0, len(page.Sessions))
+	for _, session := range page.Sessions {
+		sessions = append(sessions, newAdminSession(session, realm.pool.configuration))
+	}
+	writeJSON(writer, http.StatusOK, struct {
+		Sessions []AdminSession `json:"sessions"`
+		Next     string         `json:"next,omitempty"`
+	}{sessions, page.Next})
+}
+
+/*
+Parses the query parameters of the session listing.
+*/
+func adminQuery(request *http.Request) (SessionQuery, bool) {
+	values := request.URL.Query()
+	query := SessionQuery{
+		PrincipalID:     values.Get("principal"),
+		PrincipalPrefix: values.Get("principal_prefix"),
+		RemoteAddress:   values.Get("remote"),
+		Order:           SessionOrder(values.Get("order")),
+		Descending:      values.Get("desc") == "true",
+		Limit:           adminDefaultLimit,
+		Cursor:          values.Get("cursor"),
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return query, false
+		}
+		if limit > adminMaxLimit {
+			limit = adminMaxLimit
+		}
+		query.Limit = limit
+	}
+	now := time.Now()
+	for name, created := range map[string]*time.Time{"min_age": &query.CreatedBefore, "max_age": &query.CreatedAfter} {
+		if value := values.Get(name); value != "" {
+			age, err := time.ParseDuration(value)
+			if err != nil {
+				return query, false
+			}
+			*created = now.Add(-age)
+		}
+	}
+	for _, attribute := range values["attribute"] {
+		split := strings.IndexByte(attribute, '=')
+		if split <= 0 || internalAttribute(attribute[:split]) {
+			return query, false
+		}
+		if query.Attributes == nil {
+			query.Attributes = map[string]string{}
+		}
+		query.Attributes[attribute[:split]] = attribute[split+1:]
+	}
+	return query, true
+}
+
+func (h *AdminHandler) inspect(writer http.ResponseWriter, request *http.Request, sid string) {
+	realm, err := h.realm(request)
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	session, err := realm.pool.store.Get(SessionIdentifier{SID: sid, Realm: realm.name})
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	if realm.pool.refresher != nil {
+		realm.pool.refresher.restore(session)
+	}
+	writeJSON(writer, http.StatusOK, newAdminSession(session, realm.pool.configuration))
+}
+
+func (h *AdminHandler) revoke(writer http.ResponseWriter, request *http.Request, sid string) {
+	realm, err := h.realm(request)
+	if err == nil {
+		err = realm.RevokeSession(sid)
+	}
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) revokePrincipal(writer http.ResponseWriter, request *http.Request, principalId string) {
+	realm, err := h.realm(request)
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	if principalId == "" {
+		writeSessionError(writer, errors.New(SessionNotFound))
+		return
+	}
+	revoked, err := realm.RevokePrincipal(principalId)
+	if err != nil {
+		writeSessionError(writer, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, struct {
+		Revoked int `json:"revoked"`
+	}{revoked})
+}
+
+func (h *AdminHandler) stats(writer http.ResponseWriter, request *http.Request) {
+	stats := []AdminStats{}
+	for _, realm := range h.security.Realms() {
+		realmStats := AdminStats{Realm: realm.name}
+		principals := map[string]bool{}
+		err := realm.pool.rangeSessions(func(session *Session) bool {
+			realmStats.Sessions++
+			principals[session.Principal.ID()] = true
+			if session.expiredBy(realm.pool.configuration) != "" {
+				realmStats.Expired++
+			}
+			return true
+		})
+		if err != nil {
+			writeSessionError(writer, err)
+			return
+		}
+		realmStats.Principals = len(principals)
+		if cache, ok := realm.pool.store.(interface{ Stats() CacheStats }); ok {
+			cacheStats := cache.Stats()
+			realmStats.Cache = &cacheStats
+		}
+		stats = append(stats, realmStats)
+	}
+	writeJSON(writer, http.StatusOK, stats)
+}
@@ -0,0 +1,202 @@
+package porter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(handler http.Handler, method string, target string, value interface{}) int {
+	request := httptest.NewRequest(method, target, nil)
+	request.Header.Set("Authorization", "admin")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if value != nil {
+		_ = json.Unmarshal(recorder.Body.Bytes(), value)
+	}
+	return recorder.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	events := []Event{}
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		AuthenticationFilter: func(context interface{}) SessionIdentifier {
+			return context.(SessionIdentifier)
+		},
+		Logger:         testingLogger,
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     AllowNew,
+		Listeners: []EventListener{EventListenerFunc(func(event Event) {
+			events = append(events, event)
+		})},
+	})
+	other, err := security.AddRealm("other", &Configuration{
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     AllowNew,
+	})
+	check(err, t)
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	alice := pp{ap{false, true, true}, "alice", policy}
+	bob := pp{ap{false, true, true}, "bob", policy}
+	realm := security.defaultRealm
+
+	first, err := realm.login(background(), nil, alice, "remote1")
+	check(err, t)
+	first.SetAttribute("device", "phone")
+	first.SetAttribute(SessionAttributeCSRF, "1.secret")
+	time.Sleep(20 * time.Millisecond)
+	_, err = realm.login(background(), nil, alice, "remote2")
+	check(err, t)
+	_, err = realm.login(background(), nil, bob, "remote1")
+	check(err, t)
+	_, err = other.login(background(), nil, alice, "remote1")
+	check(err, t)
+
+	handler := NewAdminHandler(security, func(request *http.Request) bool {
+		return request.Header.Get("Authorization") == "admin"
+	})
+
+	if code := adminRequest(handler, http.MethodGet, "/sessions", nil); code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	unauthorized := httptest.NewRecorder()
+	handler.ServeHTTP(unauthorized, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	if unauthorized.Code != http.StatusForbidden {
+		t.Error("Unauthorized request is served")
+	}
+	unauthorized = httptest.NewRecorder()
+	NewAdminHandler(security, nil).ServeHTTP(unauthorized, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	if unauthorized.Code != http.StatusForbidden {
+		t.Error("Request is served without authorization check")
+	}
+
+	type list struct {
+		Sessions []AdminSession `json:"sessions"`
+		Next     string         `json:"next"`
+	}
+	filters := map[string]int{
+		"/sessions":                              3,
+		"/sessions?realm=other":                  1,
+		"/sessions?principal=alice":              2,
+		"/sessions?remote=remote1":               2,
+		"/sessions?principal=bob&remote=remote2": 0,
+		"/sessions?min_age=15ms":                 1,
+		"/sessions?max_age=15ms":                 2,
+		"/sessions?principal_prefix=al":          2,
+		"/sessions?attribute=device=phone":       1,
+	}
+	for target, expected := range filters {
+		result := list{}
+		if code := adminRequest(handler, http.MethodGet, target, &result); code != http.StatusOK || len(result.Sessions) != expected {
+			t.Errorf("%s returned %d sessions, expected %d", target, len(result.Sessions), expected)
+		}
+	}
+	result := list{}
+	adminRequest(handler, http.MethodGet, "/sessions?limit=2&order=principal&desc=true", &result)
+	if len(result.Sessions) != 2 || result.Next == "" || result.Sessions[0].PrincipalID != "bob" {
+		t.Error("Listing is not limited")
+	}
+	next := list{}
+	adminRequest(handler, http.MethodGet, "/sessions?limit=2&order=principal&desc=true&cursor="+result.Next, &next)
+	if len(next.Sessions) != 1 || next.Next != "" || next.Sessions[0].ID == result.Sessions[1].ID {
+		t.Error("Next page is not listed")
+	}
+	for _, target := range []string{"/sessions?limit=0", "/sessions?min_age=1", "/sessions?max_age=x",
+		"/sessions?attribute=device", "/sessions?attribute=porter.csrf=1.secret", "/sessions?order=unknown", "/sessions?cursor=unknown"} {
+		if code := adminRequest(handler, http.MethodGet, target, nil); code != http.StatusBadRequest {
+			t.Errorf("%s returned %d", target, code)
+		}
+	}
+	if code := adminRequest(handler, http.MethodGet, "/sessions?realm=unknown", nil); code != http.StatusNotFound {
+		t.Error("Unknown realm is listed")
+	}
+
+	inspected := AdminSession{}
+	if code := adminRequest(handler, http.MethodGet, "/sessions/"+first.ID.SID, &inspected); code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if inspected.ID != first.ID.SID || inspected.PrincipalID != "alice" || inspected.RemoteAddress != "remote1" ||
+		inspected.Attributes["device"] != "phone" || inspected.Expired || !inspected.Expires.Equal(first.expirationTime) {
+		t.Errorf("Unexpected session %+v", inspected)
+	}
+	if _, ok := inspected.Attributes[SessionAttributeCSRF]; ok {
+		t.Error("CSRF secret is exposed")
+	}
+	if code := adminRequest(handler, http.MethodGet, "/sessions/"+first.ID.SID+"?realm=other", nil); code != http.StatusNotFound {
+		t.Error("Session is found in another realm")
+	}
+	if code := adminRequest(handler, http.MethodPost, "/sessions/"+first.ID.SID, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	stats := []AdminStats{}
+	adminRequest(handler, http.MethodGet, "/stats", &stats)
+	if len(stats) != 2 || stats[0].Realm != DefaultRealm || stats[0].Sessions != 3 || stats[0].Principals != 2 ||
+		stats[1].Realm != "other" || stats[1].Sessions != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	events = nil
+	if code := adminRequest(handler, http.MethodDelete, "/sessions/"+first.ID.SID, nil); code != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if _, err := security.Authenticate(first.ID); err == nil {
+		t.Error("Revoked session is authenticated")
+	}
+	if len(events) != 1 || events[0].Kind != EventSessionEnded || events[0].Reason != ReasonRevoked {
+		t.Errorf("Unexpected events %v", events)
+	}
+	if code := adminRequest(handler, http.MethodDelete, "/sessions/"+first.ID.SID, nil); code != http.StatusNotFound {
+		t.Error("Revoked session is revoked again")
+	}
+
+	revoked := struct {
+		Revoked int `json:"revoked"`
+	}{}
+	if code := adminRequest(handler, http.MethodDelete, "/principals/alice/sessions", &revoked); code != http.StatusOK || revoked.Revoked != 1 {
+		t.Errorf("Unexpected revocation %d %d", code, revoked.Revoked)
+	}
+	result = list{}
+	adminRequest(handler, http.MethodGet, "/sessions", &result)
+	if len(result.Sessions) != 1 || result.Sessions[0].PrincipalID != "bob" {
+		t.Error("Sessions of the principal are not revoked")
+	}
+	result = list{}
+	adminRequest(handler, http.MethodGet, "/sessions?realm=other", &result)
+	if len(result.Sessions) != 1 {
+		t.Error("Sessions of another realm are revoked")
+	}
+	if code := adminRequest(handler, http.MethodGet, "/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d", code)
+	}
+}
+
+func TestAdminHandler_CoalescedRefresh(t *testing.T) {
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.Store = newCopyingStore()
+		configuration.RefreshThreshold = 0.9
+	}))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	time.Sleep(20 * time.Millisecond)
+	_, err = security.Authenticate(session.ID)
+	check(err, t)
+
+	handler := NewAdminHandler(security, func(request *http.Request) bool {
+		return true
+	})
+	inspected := AdminSession{}
+	if code := adminRequest(handler, http.MethodGet, "/sessions/"+session.ID.SID, &inspected); code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if inspected.Refreshed.Sub(inspected.Created) < 20*time.Millisecond {
+		t.Errorf("Stored refresh time is shown: created %s, refreshed %s", inspected.Created, inspected.Refreshed)
+	}
+}
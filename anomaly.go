@@ -0,0 +1,372 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+The reaction to an anomaly, in the order of severity.
+*/
+type AnomalyAction uint8
+
+const (
+	/*
+		Logs the anomaly and emits EventAnomaly.
+	*/
+	ActionLog AnomalyAction = iota
+	/*
+		Requires the owner of the session to confirm the identity.
+		Authenticate returns the session together with the StepUpRequired error until Realm.CompleteStepUp.
+	*/
+	ActionStepUp
+	/*
+		Ends the session. Without a session ends all sessions of the principal.
+	*/
+	ActionRevoke
+)
+
+func (a AnomalyAction) String() string {
+	switch a {
+	case ActionLog:
+		return "log"
+	case ActionStepUp:
+		return "step_up"
+	case ActionRevoke:
+		return "revoke"
+	}
+	return "unknown"
+}
+
+/*
+Session attribute set while the session requires the step-up, the rule of the anomaly.
+*/
+const SessionAttributeStepUp = "porter.step_up"
+
+type ObservationKind string
+
+const (
+	ObservationLogin                ObservationKind = "login"
+	ObservationLoginFailed          ObservationKind = "login_failed"
+	ObservationAuthentication       ObservationKind = "authentication"
+	ObservationAuthenticationFailed ObservationKind = "authentication_failed"
+)
+
+/*
+Usage of a session inspected by the anomaly detectors.
+*/
+type Observation struct {
+	Kind  ObservationKind
+	Time  time.Time
+	Realm string
+	/*
+		The session, nil for failed logins and authentications of unknown sessions.
+	*/
+	Session     *Session
+	PrincipalID string
+	/*
+		The normalized address of the request.
+	*/
+	RemoteAddress string
+	/*
+		The error of a failed login or authentication.
+	*/
+	Err error
+}
+
+type Anomaly struct {
+	/*
+		The name of the rule detecting the anomaly, "impossible_travel" for example.
+	*/
+	Rule   string
+	Action AnomalyAction
+	Detail string
+}
+
+/*
+Inspects logins and authentications. See: Configuration.AnomalyDetectors
+
+Detectors are called synchronously by the goroutine of the request, so they must be fast and safe for concurrent use.
+*/
+type AnomalyDetector interface {
+	Inspect(observation Observation) []Anomaly
+}
+
+/*
+Adapter of ordinary functions to AnomalyDetector.
+*/
+type AnomalyDetectorFunc func(observation Observation) []Anomaly
+
+func (f AnomalyDetectorFunc) Inspect(observation Observation) []Anomaly {
+	return f(observation)
+}
+
+/*
+Passes the observation through the detectors and applies the most severe action of the detected anomalies.
+Returns the applied action.
+*/
+func (sp *SessionPool) inspect(observation Observation) AnomalyAction {
+	if len(sp.configuration.AnomalyDetectors) == 0 {
+		return ActionLog
+	}
+	observation.Time = time.Now()
+	observation.Realm = sp.configuration.Realm
+	if observation.Session != nil {
+		observation.PrincipalID = observation.Session.Principal.ID()
+	}
+	action, rule := ActionLog, ""
+	for _, detector := range sp.configuration.AnomalyDetectors {
+		for _, anomaly := range detector.Inspect(observation) {
+			anomaly := anomaly
+			sp.configuration.logger().Warn("Anomaly detected", "rule", anomaly.Rule, "action", anomaly.Action.String(),
+				"detail", anomaly.Detail, "principal_id", observation.PrincipalID, "remote_addr", observation.RemoteAddress)
+			sp.emit(Event{Kind: EventAnomaly, Session: observation.Session, PrincipalID: observation.PrincipalID,
+				RemoteAddress: observation.RemoteAddress, Reason: anomaly.Rule, Anomaly: &anomaly})
+			if anomaly.Action > action {
+				action, rule = anomaly.Action, anomaly.Rule
+			}
+		}
+	}
+	switch action {
+	case ActionStepUp:
+		if observation.Session != nil {
+			observation.Session.SetAttribute(SessionAttributeStepUp, rule)
+			_ = sp.saveAttributes(observation.Session)
+		}
+	case ActionRevoke:
+		if observation.Session != nil {
+			sp.endSession(background(), observation.Session, ReasonAnomaly)
+		} else if observation.PrincipalID != "" {
+			if _, err := sp.revokePrincipal(observation.PrincipalID, ReasonAnomaly); err != nil {
+				sp.configuration.logger().Error("Revocation failed", "principal_id", observation.PrincipalID, "error", err)
+			}
+		}
+	}
+	return action
+}
+
+/*
+Returns the StepUpRequired error if the session requires the step-up.
+*/
+func stepUpRequired(session *Session) error {
+	if _, ok := session.Attribute(SessionAttributeStepUp); ok {
+		return errors.New(StepUpRequired)
+	}
+	return nil
+}
+
+/*
+Clears the step-up requirement of the session after the owner confirmed the identity and writes it to the store.
+Rotates the CSRF token of the session, see: CSRF
+*/
+func (r *Realm) CompleteStepUp(session *Session) error {
+	session.removeAttribute(SessionAttributeStepUp)
+	resetCSRF(session)
+	return r.pool.saveAttributes(session)
+}
+
+/*
+Clears the step-up requirement of the session. See: Realm.CompleteStepUp
+*/
+func (s *Security) CompleteStepUp(session *Session) error {
+	realm, err := s.realmFor(session.ID)
+	if err != nil {
+		return err
+	}
+	return realm.CompleteStepUp(session)
+}
+
+/*
+The maximum number of recent samples kept for one key of a detector.
+*/
+const maxAnomalySamples = 256
+
+type anomalySample struct {
+	time    time.Time
+	address string
+}
+
+/*
+Recent samples of the detector by keys, SIDs or principal IDs, dropped after the window.
+*/
+type anomalyWindow struct {
+	lock      sync.Mutex
+	window    time.Duration
+	samples   map[string][]anomalySample
+	lastSweep time.Time
+}
+
+func newAnomalyWindow(window time.Duration) *anomalyWindow {
+	return &anomalyWindow{window: window, samples: map[string][]anomalySample{}, lastSweep: time.Now()}
+}
+
+/*
+Adds the sample and returns the samples of the key within the window, the new one last.
+The result is valid until the lock is released.
+*/
+func (w *anomalyWindow) add(key string, sample anomalySample) []anomalySample {
+	since := sample.time.Add(-w.window)
+	if sample.time.Sub(w.lastSweep) > w.window {
+		for k, samples := range w.samples {
+			if samples[len(samples)-1].time.Before(since) {
+				delete(w.samples, k)
+			}
+		}
+		w.lastSweep = sample.time
+	}
+	samples := w.samples[key]
+	first := 0
+	for first < len(samples) && samples[first].time.Before(since) {
+		first++
+	}
+	if len(samples)-first >= maxAnomalySamples {
+		first = len(samples) - maxAnomalySamples + 1
+	}
+	samples = append(samples[first:], sample)
+	w.samples[key] = samples
+	return samples
+}
+
+/*
+Returns TRUE if the addresses belong to different /16 IPv4 or /48 IPv6 networks.
+Addresses that are not IP addresses are far if they differ.
+*/
+func DifferentNetworks(a string, b string) bool {
+	first, second := parseIP(NormalizeAddress(a)), parseIP(NormalizeAddress(b))
+	if first == nil || second == nil {
+		return !sameAddress(a, b)
+	}
+	if len(first) != len(second) {
+		return true
+	}
+	mask := net.CIDRMask(16, 32)
+	if len(first) == net.IPv6len {
+		mask = net.CIDRMask(48, 128)
+	}
+	return !first.Mask(mask).Equal(second.Mask(mask))
+}
+
+type travelDetector struct {
+	samples *anomalyWindow
+	far     func(a string, b string) bool
+	action  AnomalyAction
+}
+
+/*
+Detects a session used from far apart addresses within the window, "impossible_travel".
+A nil far compares the networks of the addresses, see: DifferentNetworks.
+A geolocation lookup may tell the distance instead.
+*/
+func NewImpossibleTravelDetector(window time.Duration, far func(a string, b string) bool, action AnomalyAction) AnomalyDetector {
+	if far == nil {
+		far = DifferentNetworks
+	}
+	return &travelDetector{samples: newAnomalyWindow(window), far: far, action: action}
+}
+
+func (d *travelDetector) Inspect(observation Observation) []Anomaly {
+	if (observation.Kind != ObservationLogin && observation.Kind != ObservationAuthentication) || observation.Session == nil {
+		return nil
+	}
+	d.samples.lock.Lock()
+	defer d.samples.lock.Unlock()
+	samples := d.samples.add(observation.Session.ID.SID, anomalySample{observation.Time, observation.RemoteAddress})
+	previous := samples[:len(samples)-1]
+	if addressSeen(previous, observation.RemoteAddress) {
+		return nil
+	}
+	for _, sample := range previous {
+		if d.far(sample.address, observation.RemoteAddress) {
+			return []Anomaly{{
+				Rule:   "impossible_travel",
+				Action: d.action,
+				Detail: fmt.Sprintf("%s and %s within %s", sample.address, observation.RemoteAddress, observation.Time.Sub(sample.time)),
+			}}
+		}
+	}
+	return nil
+}
+
+type churnDetector struct {
+	samples      *anomalyWindow
+	maxAddresses int
+	action       AnomalyAction
+}
+
+/*
+Detects a session used from more than maxAddresses distinct addresses within the window, "address_churn".
+*/
+func NewAddressChurnDetector(window time.Duration, maxAddresses int, action AnomalyAction) AnomalyDetector {
+	return &churnDetector{samples: newAnomalyWindow(window), maxAddresses: maxAddresses, action: action}
+}
+
+func (d *churnDetector) Inspect(observation Observation) []Anomaly {
+	if (observation.Kind != ObservationLogin && observation.Kind != ObservationAuthentication) || observation.Session == nil {
+		return nil
+	}
+	d.samples.lock.Lock()
+	defer d.samples.lock.Unlock()
+	samples := d.samples.add(observation.Session.ID.SID, anomalySample{observation.Time, observation.RemoteAddress})
+	addresses := map[string]bool{}
+	for _, sample := range samples {
+		addresses[sample.address] = true
+	}
+	if len(addresses) > d.maxAddresses && !addressSeen(samples[:len(samples)-1], observation.RemoteAddress) {
+		return []Anomaly{{
+			Rule:   "address_churn",
+			Action: d.action,
+			Detail: fmt.Sprintf("%d addresses within %s", len(addresses), d.samples.window),
+		}}
+	}
+	return nil
+}
+
+/*
+Returns TRUE if the address is one of the samples, so anomalies are reported once per new address.
+*/
+func addressSeen(samples []anomalySample, address string) bool {
+	for _, sample := range samples {
+		if sample.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+type failureDetector struct {
+	samples     *anomalyWindow
+	maxFailures int
+	action      AnomalyAction
+}
+
+/*
+Detects more than maxFailures failed authentications of the sessions of one principal within the window, "failure_spike".
+Authentications of unknown sessions do not tell the principal and are not counted.
+The maximum number of failures is limited to 255.
+*/
+func NewFailureSpikeDetector(window time.Duration, maxFailures int, action AnomalyAction) AnomalyDetector {
+	if maxFailures >= maxAnomalySamples {
+		maxFailures = maxAnomalySamples - 1
+	}
+	return &failureDetector{samples: newAnomalyWindow(window), maxFailures: maxFailures, action: action}
+}
+
+func (d *failureDetector) Inspect(observation Observation) []Anomaly {
+	if observation.Kind != ObservationAuthenticationFailed || observation.PrincipalID == "" {
+		return nil
+	}
+	d.samples.lock.Lock()
+	defer d.samples.lock.Unlock()
+	samples := d.samples.add(observation.PrincipalID, anomalySample{observation.Time, observation.RemoteAddress})
+	if len(samples) == d.maxFailures+1 {
+		return []Anomaly{{
+			Rule:   "failure_spike",
+			Action: d.action,
+			Detail: fmt.Sprintf("%d failed authentications within %s", len(samples), d.samples.window),
+		}}
+	}
+	return nil
+}
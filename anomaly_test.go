@@ -0,0 +1,170 @@
+package porter
+
+import (
+	"testing"
+	"time"
+)
+
+func newAnomalySecurity(events *[]Event, detectors ...AnomalyDetector) *Security {
+	return CreateNew(testConfiguration(events, func(configuration *Configuration) {
+		configuration.AnomalyDetectors = detectors
+	}))
+}
+
+func anomalies(events []Event) []string {
+	rules := []string{}
+	for _, event := range events {
+		if event.Kind == EventAnomaly {
+			rules = append(rules, event.Anomaly.Rule+":"+event.Anomaly.Action.String())
+		}
+	}
+	return rules
+}
+
+func from(identifier SessionIdentifier, address string) SessionIdentifier {
+	identifier.RemoteAddress = address
+	return identifier
+}
+
+func TestDifferentNetworks(t *testing.T) {
+	if DifferentNetworks("198.51.100.1", "198.51.7.1:4000") || !DifferentNetworks("198.51.100.1", "203.0.113.1") ||
+		DifferentNetworks("2001:db8:1:2::1", "2001:db8:1:3::1") || !DifferentNetworks("2001:db8:1::1", "2001:db8:2::1") ||
+		!DifferentNetworks("198.51.100.1", "2001:db8::1") || DifferentNetworks("remote1", "remote1") || !DifferentNetworks("remote1", "remote2") {
+		t.Error("Unexpected network comparison")
+	}
+}
+
+func TestImpossibleTravel(t *testing.T) {
+	events := []Event{}
+	security := newAnomalySecurity(&events, NewImpossibleTravelDetector(time.Minute, nil, ActionStepUp))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	_, err = security.Authenticate(from(session.ID, "198.51.7.7"))
+	check(err, t)
+	if len(anomalies(events)) != 0 {
+		t.Errorf("Unexpected anomalies %v", anomalies(events))
+	}
+
+	found, err := security.Authenticate(from(session.ID, "203.0.113.1"))
+	if err == nil || err.Error() != StepUpRequired || found != session {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if rules := anomalies(events); len(rules) != 1 || rules[0] != "impossible_travel:step_up" {
+		t.Errorf("Unexpected anomalies %v", rules)
+	}
+	if event := events[len(events)-1]; event.Reason != "impossible_travel" || event.RemoteAddress != "203.0.113.1" || event.Session != session {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if _, err = security.Authenticate(session.ID); err == nil || err.Error() != StepUpRequired {
+		t.Error("Step-up is not required")
+	}
+
+	check(security.CompleteStepUp(session), t)
+	events = nil
+	_, err = security.Authenticate(from(session.ID, "203.0.113.1"))
+	check(err, t)
+	if len(anomalies(events)) != 0 {
+		t.Error("Anomaly is reported twice")
+	}
+}
+
+func TestStepUpStored(t *testing.T) {
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.Store = newCopyingStore()
+		configuration.AnomalyDetectors = []AnomalyDetector{NewImpossibleTravelDetector(time.Minute, nil, ActionStepUp)}
+	}))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	if _, err = security.Authenticate(from(session.ID, "203.0.113.1")); err == nil || err.Error() != StepUpRequired {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	found, err := security.Authenticate(session.ID)
+	if err == nil || err.Error() != StepUpRequired {
+		t.Fatal("Step-up is not stored")
+	}
+	check(security.CompleteStepUp(found), t)
+	_, err = security.Authenticate(session.ID)
+	check(err, t)
+}
+
+func TestAddressChurn(t *testing.T) {
+	events := []Event{}
+	security := newAnomalySecurity(&events, NewAddressChurnDetector(time.Minute, 2, ActionRevoke))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	for _, address := range []string{"198.51.100.2", "198.51.100.1", "198.51.100.2"} {
+		_, err = security.Authenticate(from(session.ID, address))
+		check(err, t)
+	}
+	if _, err = security.Authenticate(from(session.ID, "198.51.100.3")); err == nil || err.Error() != SessionRevoked {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if rules := anomalies(events); len(rules) != 1 || rules[0] != "address_churn:revoke" {
+		t.Errorf("Unexpected anomalies %v", rules)
+	}
+	if event := events[len(events)-1]; event.Kind != EventSessionEnded || event.Reason != ReasonAnomaly {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if _, err = security.Authenticate(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Revoked session is authenticated")
+	}
+}
+
+func TestFailureSpike(t *testing.T) {
+	events := []Event{}
+	security := newAnomalySecurity(&events, NewFailureSpikeDetector(time.Minute, 2, ActionLog))
+	principal := ap{false, true, true}
+	session, err := security.Login(deviceLogin{principal, "198.51.100.1", ""})
+	check(err, t)
+	guessed := session.ID
+	guessed.SSID = "guess"
+	for i := 0; i < 4; i++ {
+		if _, err = security.Authenticate(guessed); err == nil || err.Error() != SessionNotFound {
+			t.Fatal("Session is found by a wrong SSID")
+		}
+	}
+	if rules := anomalies(events); len(rules) != 1 || rules[0] != "failure_spike:log" {
+		t.Errorf("Unexpected anomalies %v", rules)
+	}
+	if _, err = security.Authenticate(session.ID); err != nil {
+		t.Error("Session is ended by a logged anomaly")
+	}
+}
+
+func TestAnomalyDetectorFunc(t *testing.T) {
+	events := []Event{}
+	observations := []Observation{}
+	security := newAnomalySecurity(&events, AnomalyDetectorFunc(func(observation Observation) []Anomaly {
+		observations = append(observations, observation)
+		if observation.Kind == ObservationLogin && observation.RemoteAddress == "203.0.113.1" {
+			return []Anomaly{{Rule: "blocked", Action: ActionRevoke}, {Rule: "suspicious", Action: ActionStepUp}}
+		}
+		return nil
+	}))
+	principal := ap{false, true, true}
+	session, err := security.Login(deviceLogin{principal, "198.51.100.1", ""})
+	check(err, t)
+	if _, err = security.Login(deviceLogin{principal, "203.0.113.1", ""}); err == nil || err.Error() != SessionRevoked {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if rules := anomalies(events); len(rules) != 2 {
+		t.Errorf("Unexpected anomalies %v", rules)
+	}
+	if event := events[len(events)-1]; event.Kind != EventLoginFailed || event.Reason != ReasonAnomaly {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if sessions := security.GetAllSessions(principal); len(sessions) != 1 || sessions[0] != session {
+		t.Error("Revoked session is kept")
+	}
+	_, err = security.Authenticate(session.ID)
+	check(err, t)
+	kinds := []ObservationKind{ObservationLogin, ObservationLogin, ObservationLoginFailed, ObservationAuthentication}
+	if len(observations) != len(kinds) {
+		t.Fatalf("Unexpected observations %+v", observations)
+	}
+	for i, kind := range kinds {
+		if observations[i].Kind != kind || observations[i].PrincipalID != principal.ID() || observations[i].Realm != DefaultRealm {
+			t.Errorf("Unexpected observation %+v", observations[i])
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package porter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+The hash preceding the first record of an audit log.
+*/
+var auditGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+/*
+The suffix of every audit line after the record: ,"hash":"<64 hex digits>"}
+*/
+const auditHashPrefix = `,"hash":"`
+const auditHashSuffixLength = len(auditHashPrefix) + 2*sha256.Size + 2
+
+/*
+Record of an audit log line.
+*/
+type AuditRecord struct {
+	/*
+		The number of the record, starting from 1.
+	*/
+	Seq           uint64    `json:"seq"`
+	Time          time.Time `json:"time"`
+	Event         EventKind `json:"event"`
+	Realm         string    `json:"realm"`
+	PrincipalID   string    `json:"principal_id,omitempty"`
+	RemoteAddress string    `json:"remote_addr,omitempty"`
+	/*
+		The fingerprint of the session. See: SessionFingerprint
+	*/
+	Session string `json:"session_fp,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+	/*
+		The hash of the previous record.
+	*/
+	Prev string `json:"prev"`
+}
+
+/*
+EventListener appending the session events to a tamper-evident log of JSON lines.
+
+Every line is a record followed by the HMAC-SHA256 of the hash of the previous record and of the record itself,
+so editing, inserting or deleting a record breaks the chain. See: VerifyAuditLog.
+The key must be kept away from the log: whoever holds both can rewrite the records and recompute the chain.
+Deleting the last records is detected only by comparing the last hash with one kept elsewhere,
+see: AuditLog.Head
+*/
+type AuditLog struct {
+	lock       sync.Mutex
+	file       *os.File
+	key        []byte
+	seq        uint64
+	prev       string
+	syncWrites bool
+	err        error
+	closed     bool
+}
+
+/*
+Opens the audit log for appending, continuing the chain of the existing records signed with the key.
+With syncWrites every record is flushed to the disk before the event returns.
+Returns the KeyRequired error if the key is empty,
+the AuditChainBroken error if the existing records do not verify.
+*/
+func OpenAuditLog(path string, key []byte, syncWrites bool) (*AuditLog, error) {
+	if len(key) == 0 {
+		return nil, errors.New(KeyRequired)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	count, head, err := VerifyAuditLog(file, key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &AuditLog{file: file, key: key, seq: count, prev: head, syncWrites: syncWrites}, nil
+}
+
+func (a *AuditLog) OnEvent(event Event) {
+	record := &AuditRecord{
+		Time:          event.Time.UTC(),
+		Event:         event.Kind,
+		Realm:         event.Realm,
+		PrincipalID:   event.PrincipalID,
+		RemoteAddress: event.RemoteAddress,
+		Reason:        event.Reason,
+	}
+	if event.Session != nil {
+		record.Session = SessionFingerprint(event.Session.ID)
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+	if err := a.Append(record); err != nil {
+		a.lock.Lock()
+		a.err = err
+		a.lock.Unlock()
+	}
+}
+
+/*
+Appends the record, setting its sequence number and the hash of the previous record.
+*/
+func (a *AuditLog) Append(record *AuditRecord) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return errors.New(StoreClosed)
+	}
+	record.Seq = a.seq + 1
+	record.Prev = a.prev
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	hash := auditHash(a.key, a.prev, body)
+	line := make([]byte, 0, len(body)+auditHashSuffixLength)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, auditHashPrefix...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	if _, err = a.file.Write(line); err != nil {
+		return err
+	}
+	if a.syncWrites {
+		if err = a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	a.seq = record.Seq
+	a.prev = hash
+	return nil
+}
+
+/*
+Returns the number of records and the hash of the last one.
+Keeping the head outside of the log allows detecting truncation.
+*/
+func (a *AuditLog) Head() (uint64, string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.seq, a.prev
+}
+
+/*
+Returns the last error of writing an event.
+*/
+func (a *AuditLog) Err() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.err
+}
+
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.file.Close()
+}
+
+func auditHash(key []byte, prev string, body []byte) string {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(prev))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+Verifies the hash chain of the audit log signed with the key.
+Returns the number of records and the hash of the last one,
+the AuditChainBroken error with the number of records verified before the broken one.
+*/
+func VerifyAuditLog(reader io.Reader, key []byte) (uint64, string, error) {
+	if len(key) == 0 {
+		return 0, auditGenesis, errors.New(KeyRequired)
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	count := uint64(0)
+	prev := auditGenesis
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		hash, body, ok := splitAuditLine(line)
+		if !ok {
+			return count, prev, errors.New(AuditChainBroken)
+		}
+		record := AuditRecord{}
+		if err := json.Unmarshal(body, &record); err != nil {
+			return count, prev, errors.New(AuditChainBroken)
+		}
+		if record.Seq != count+1 || record.Prev != prev || auditHash(key, prev, body) != hash {
+			return count, prev, errors.New(AuditChainBroken)
+		}
+		count++
+		prev = hash
+	}
+	return count, prev, scanner.Err()
+}
+
+/*
+Splits the line into the hash and the record without the hash.
+*/
+func splitAuditLine(line []byte) (string, []byte, bool) {
+	if len(line) < auditHashSuffixLength+2 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return "", nil, false
+	}
+	split := len(line) - auditHashSuffixLength
+	if !bytes.HasPrefix(line[split:], []byte(auditHashPrefix)) {
+		return "", nil, false
+	}
+	hash := string(line[split+len(auditHashPrefix) : len(line)-2])
+	body := make([]byte, 0, split+1)
+	body = append(body, line[:split]...)
+	body = append(body, '}')
+	return hash, body, true
+}
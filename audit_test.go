@@ -0,0 +1,109 @@
+package porter
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var auditKey = []byte("audit key")
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, auditKey, true)
+	check(err, t)
+	fail := false
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		LoginFilter: func(context interface{}) (AuthenticationPrincipal, string, error) {
+			if fail {
+				return nil, "remote2", errors.New("wrong password")
+			}
+			return fileStorePrincipal, "remote1", nil
+		},
+		AuthenticationFilter: func(context interface{}) SessionIdentifier {
+			return context.(SessionIdentifier)
+		},
+		Logger:         testingLogger,
+		ExpirationTime: 10 * time.Second,
+		Timeout:        20 * time.Millisecond,
+		MultiLogin:     AllowNew,
+		Listeners:      []EventListener{audit},
+	})
+
+	first, err := security.Login(nil)
+	check(err, t)
+	second, err := security.Login(nil)
+	check(err, t)
+	fail = true
+	if _, err = security.Login(nil); err == nil {
+		t.Fatal("Login filter error is ignored")
+	}
+	security.EndSession(first)
+	time.Sleep(30 * time.Millisecond)
+	if _, err = security.Authenticate(second.ID); err == nil {
+		t.Fatal("Session is not expired")
+	}
+	check(audit.Err(), t)
+	count, head := audit.Head()
+	check(audit.Close(), t)
+
+	data, err := ioutil.ReadFile(path)
+	check(err, t)
+	verified, verifiedHead, err := VerifyAuditLog(bytes.NewReader(data), auditKey)
+	check(err, t)
+	if verified != 5 || count != 5 || verifiedHead != head {
+		t.Fatalf("Verified %d records, expected 5", verified)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i, expected := range []string{`"event":"login"`, `"event":"login"`, `"error":"wrong password"`, `"reason":"logout"`, `"reason":"timeout"`} {
+		if !strings.Contains(lines[i], expected) {
+			t.Errorf("Record %d %s does not contain %s", i+1, lines[i], expected)
+		}
+	}
+	if strings.Contains(string(data), first.ID.SID) {
+		t.Error("SID is written to the audit log")
+	}
+
+	reopened, err := OpenAuditLog(path, auditKey, false)
+	check(err, t)
+	check(reopened.Append(&AuditRecord{Time: time.Now().UTC(), Event: EventLogin}), t)
+	check(reopened.Close(), t)
+	data, err = ioutil.ReadFile(path)
+	check(err, t)
+	if verified, _, err = VerifyAuditLog(bytes.NewReader(data), auditKey); err != nil || verified != 6 {
+		t.Error("Reopened log does not continue the chain")
+	}
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	tampered := map[string][]string{
+		"edited":    {lines[0], strings.Replace(lines[1], "remote1", "remote9", 1), lines[2]},
+		"deleted":   {lines[0], lines[2], lines[3]},
+		"reordered": {lines[1], lines[0]},
+		"truncated": {lines[0], lines[1][:len(lines[1])-10]},
+	}
+	for name, records := range tampered {
+		verified, _, err := VerifyAuditLog(strings.NewReader(strings.Join(records, "\n")+"\n"), auditKey)
+		if err == nil || err.Error() != AuditChainBroken {
+			t.Errorf("The %s log is verified", name)
+		}
+		if name != "reordered" && verified != 1 {
+			t.Errorf("The %s log verified %d records, expected 1", name, verified)
+		}
+	}
+
+	check(ioutil.WriteFile(path, []byte(strings.Join(tampered["edited"], "\n")+"\n"), 0600), t)
+	if _, err = OpenAuditLog(path, auditKey, false); err == nil || err.Error() != AuditChainBroken {
+		t.Error("Tampered log is opened")
+	}
+	if _, _, err = VerifyAuditLog(bytes.NewReader(data), []byte("other key")); err == nil || err.Error() != AuditChainBroken {
+		t.Error("Log is verified with another key")
+	}
+	if _, err = OpenAuditLog(path, nil, false); err == nil || err.Error() != KeyRequired {
+		t.Error("Log is opened without a key")
+	}
+}
@@ -1,53 +1,137 @@
 package porter
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"sync"
 )
 
 func CreateNew(configuration *Configuration) *Security {
+	defaultRealm := newRealm(DefaultRealm, configuration)
 	return &Security{
-		newSessionPool(configuration.getSessionConfiguration()),
+		defaultRealm,
+		map[string]*Realm{DefaultRealm: defaultRealm},
+		sync.RWMutex{},
 		configuration,
 	}
 }
 
 type Security struct {
-	pool          *SessionPool
+	defaultRealm  *Realm
+	realms        map[string]*Realm
+	lock          sync.RWMutex
 	configuration *Configuration
 }
 
 /*
-Creates a new session for the found Authentication Principal.
-Executes SuccessLoginHandler on successful session creation.
+Registers a new realm with its own SessionPool.
+
+Delegates, the logger and the event listeners not set in the configuration are inherited from the root configuration.
+If the configuration is nil, the root configuration is used.
 */
-func (s *Security) Login(context interface{}) (*Session, error) {
-	if s.configuration.LoginFilter == nil {
-		return nil, errors.New(LoginFilterNotImplemented)
+func (s *Security) AddRealm(name string, configuration *Configuration) (*Realm, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.realms[name]; ok {
+		return nil, errors.New(RealmAlreadyExists)
 	}
-	principal, remote, err := s.configuration.LoginFilter(context)
-	if err != nil {
-		return nil, err
+	realm := newRealm(name, inheritConfiguration(s.configuration, configuration))
+	s.realms[name] = realm
+	return realm, nil
+}
+
+/*
+Finds a realm by name.
+*/
+func (s *Security) Realm(name string) (*Realm, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	realm, ok := s.realms[name]
+	if !ok {
+		return nil, errors.New(RealmNotFound)
 	}
-	return s.login(context, principal, remote)
+	return realm, nil
+}
+
+/*
+Returns all realms sorted by name.
+*/
+func (s *Security) Realms() []*Realm {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	realms := make([]*Realm, 0, len(s.realms))
+	for _, realm := range s.realms {
+		realms = append(realms, realm)
+	}
+	sort.Slice(realms, func(i, j int) bool {
+		return realms[i].name < realms[j].name
+	})
+	return realms
+}
+
+/*
+Creates a new session in the default realm for the found Authentication Principal.
+Executes SuccessLoginHandler on successful session creation.
+*/
+func (s *Security) Login(context interface{}) (*Session, error) {
+	return s.defaultRealm.Login(context)
+}
+
+/*
+Login traced as a child of the span of ctx. See: Configuration.Tracer
+*/
+func (s *Security) LoginWithContext(ctx context.Context, context interface{}) (*Session, error) {
+	return s.defaultRealm.LoginWithContext(ctx, context)
 }
 
 /*
 Finds an existing session for the current context.
 Uses the AuthenticationFilter delegate to retrieve the session ID.
+The session is searched in the realm specified by the identifier.
 */
 func (s *Security) Authenticate(context interface{}) (*Session, error) {
+	return s.AuthenticateWithContext(background(), context)
+}
 
+/*
+Authenticate traced as a child of the span of ctx. See: Configuration.Tracer
+*/
+func (s *Security) AuthenticateWithContext(ctx context.Context, context interface{}) (*Session, error) {
 	if s.configuration.AuthenticationFilter == nil {
 		return nil, errors.New(AuthenticationFilterNotImplemented)
 	}
-	return s.pool.getSession(s.configuration.AuthenticationFilter(context))
+	identifier := s.configuration.AuthenticationFilter(context)
+	realm, err := s.realmFor(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return realm.authenticate(ctx, context, identifier)
+}
+
+/*
+Sets the attribute of the session and writes the attributes to the store of its realm.
+*/
+func (s *Security) SetAttribute(session *Session, key string, value string) error {
+	realm, err := s.realmFor(session.ID)
+	if err != nil {
+		return err
+	}
+	return realm.SetAttribute(session, key, value)
 }
 
 /**
 Stops the specified session.
 */
 func (s *Security) EndSession(session *Session) {
-	s.pool.removeSession(session)
+	realm, err := s.realmFor(session.ID)
+	if err != nil {
+		return
+	}
+	realm.EndSession(session)
 }
 
 /*
@@ -55,14 +139,22 @@ Stops the current session for the current context.
 Uses the AuthenticationFilter delegate to retrieve the session ID.
 */
 func (s *Security) EndCurrentSession(context interface{}) error {
-	return s.pool.removeSessionById(s.configuration.AuthenticationFilter(context))
+	if s.configuration.AuthenticationFilter == nil {
+		return errors.New(AuthenticationFilterNotImplemented)
+	}
+	identifier := s.configuration.AuthenticationFilter(context)
+	realm, err := s.realmFor(identifier)
+	if err != nil {
+		return err
+	}
+	return realm.pool.removeSessionById(identifier)
 }
 
 /**
-Gets all sessions for the specified Authentication Principal.
+Gets all sessions of the default realm for the specified Authentication Principal.
 */
 func (s *Security) GetAllSessions(principal AuthenticationPrincipal) []*Session {
-	return s.pool.getAllSessions(principal)
+	return s.defaultRealm.GetAllSessions(principal)
 }
 
 /*
@@ -70,22 +162,66 @@ Gets all sessions for the current Authentication Principal.
 Uses the AuthenticationFilter delegate to retrieve the session ID.
 */
 func (s *Security) GetAllSessionsForCurrent(context interface{}) ([]*Session, error) {
+	if s.configuration.AuthenticationFilter == nil {
+		return nil, errors.New(AuthenticationFilterNotImplemented)
+	}
 	identifier := s.configuration.AuthenticationFilter(context)
-	session, err := s.pool.getSession(identifier)
+	realm, err := s.realmFor(identifier)
 	if err != nil {
 		return nil, err
 	}
-	return s.pool.getAllSessions(session.Principal), err
+	return realm.getAllSessionsFor(identifier)
+}
+
+/*
+Returns a page of the sessions of the default realm matching the query. See: Realm.QuerySessions
+*/
+func (s *Security) QuerySessions(query SessionQuery) (*SessionPage, error) {
+	return s.defaultRealm.QuerySessions(query)
 }
 
-func (s *Security) login(context interface{}, principal AuthenticationPrincipal, remote string) (*Session, error) {
-	if !principal.CanLogin() {
-		return nil, errors.New(CannotLoginPrincipal)
+/*
+Atomically writes all sessions of the default realm to the snapshot file.
+*/
+func (s *Security) SaveSnapshot(path string) error {
+	return s.defaultRealm.SaveSnapshot(path)
+}
+
+/*
+Loads the sessions of the default realm from the snapshot file written by SaveSnapshot.
+See: Realm.RestoreSnapshot
+*/
+func (s *Security) RestoreSnapshot(path string, resolver PrincipalResolver) (int, error) {
+	return s.defaultRealm.RestoreSnapshot(path, resolver)
+}
+
+/*
+Finds the realm the identifier was issued by.
+Identifiers of unknown realms are reported as not found sessions.
+*/
+func (s *Security) realmFor(identifier SessionIdentifier) (*Realm, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	realm, ok := s.realms[identifier.Realm]
+	if !ok {
+		return nil, errors.New(SessionNotFound)
 	}
-	session, err := s.pool.startSession(principal, remote)
-	if err != nil {
-		return nil, err
+	return realm, nil
+}
+
+/*
+Stops the background work of all realms and writes the coalesced refresh times to the stores.
+*/
+func (s *Security) Close() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var result error
+	for _, realm := range s.realms {
+		if err := realm.pool.close(); err != nil {
+			result = err
+		}
 	}
-	s.configuration.SuccessLoginHandler(context, session)
-	return session, nil
+	return result
 }
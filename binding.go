@@ -0,0 +1,101 @@
+package porter
+
+import (
+	"errors"
+	"net"
+)
+
+/*
+The binding of sessions to the remote address of the login.
+Authentications from addresses outside of the binding fail with the SessionBindingViolation error.
+*/
+type BindingMode uint8
+
+const (
+	/*
+		Accepts the session from the login address only.
+	*/
+	BindAddress BindingMode = iota
+	/*
+		Accepts the session from the /24 IPv4 or /64 IPv6 subnet of the login address.
+	*/
+	BindSubnet
+	/*
+		Accepts the session from the addresses of the same group as the login address.
+		See: Configuration.AddressGroup
+	*/
+	BindGroup
+	/*
+		Accepts the session from any address.
+	*/
+	BindNone
+)
+
+func (m BindingMode) String() string {
+	switch m {
+	case BindAddress:
+		return "BindAddress"
+	case BindSubnet:
+		return "BindSubnet"
+	case BindGroup:
+		return "BindGroup"
+	case BindNone:
+		return "BindNone"
+	}
+	return "Unknown"
+}
+
+/*
+Returns TRUE if the session started from the login address is accepted from the address.
+Addresses that are not IP addresses are compared exactly by all modes except BindNone.
+*/
+func (c *sessionConfiguration) bound(login string, address string) bool {
+	if sameAddress(login, address) {
+		return true
+	}
+	switch c.Binding {
+	case BindSubnet:
+		first, second := parseIP(NormalizeAddress(login)), parseIP(NormalizeAddress(address))
+		if first == nil || second == nil || len(first) != len(second) {
+			return false
+		}
+		mask := net.CIDRMask(24, 32)
+		if len(first) == net.IPv6len {
+			mask = net.CIDRMask(64, 128)
+		}
+		return first.Mask(mask).Equal(second.Mask(mask))
+	case BindGroup:
+		if c.AddressGroup == nil {
+			return false
+		}
+		group := c.AddressGroup(NormalizeAddress(login))
+		return group != "" && group == c.AddressGroup(NormalizeAddress(address))
+	case BindNone:
+		return true
+	}
+	return false
+}
+
+/*
+Returns the SessionBindingViolation error if the session is not accepted from the address of the identifier
+or, with Configuration.BindUserAgent, from the user agent.
+*/
+func (sp *SessionPool) checkBinding(session *Session, sessionId SessionIdentifier, userAgent string) error {
+	if !sp.configuration.bound(session.ID.RemoteAddress, sessionId.RemoteAddress) {
+		return sp.bindingViolated(session, sessionId.RemoteAddress, ReasonAddress)
+	}
+	if sp.configuration.BindUserAgent && userAgent != "" {
+		if device, ok := session.Attribute(SessionAttributeDevice); ok && device != DeviceLabel(userAgent) {
+			return sp.bindingViolated(session, sessionId.RemoteAddress, ReasonUserAgent)
+		}
+	}
+	return nil
+}
+
+func (sp *SessionPool) bindingViolated(session *Session, address string, reason string) error {
+	err := errors.New(SessionBindingViolation)
+	sp.configuration.logger().Warn("Session binding violated", sessionFields(session, "address", address, "reason", reason)...)
+	sp.emit(Event{Kind: EventBindingViolation, Session: session, RemoteAddress: address, Reason: reason, Err: err})
+	sp.inspect(Observation{Kind: ObservationAuthenticationFailed, Session: session, RemoteAddress: NormalizeAddress(address), Err: err})
+	return err
+}
@@ -0,0 +1,112 @@
+package porter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBindingModes(t *testing.T) {
+	group := func(address string) string {
+		if strings.HasPrefix(address, "198.51.") {
+			return "carrier"
+		}
+		return ""
+	}
+	tests := []struct {
+		mode     BindingMode
+		login    string
+		address  string
+		expected bool
+	}{
+		{BindAddress, "198.51.100.1", "198.51.100.1:4000", true},
+		{BindAddress, "198.51.100.1", "::ffff:198.51.100.1", true},
+		{BindAddress, "198.51.100.1", "198.51.100.2", false},
+		{BindSubnet, "198.51.100.1", "198.51.100.200", true},
+		{BindSubnet, "198.51.100.1", "198.51.101.1", false},
+		{BindSubnet, "2001:db8::1", "[2001:db8::ffff:1]:4000", true},
+		{BindSubnet, "2001:db8::1", "2001:db8:0:1::1", false},
+		{BindSubnet, "198.51.100.1", "2001:db8::1", false},
+		{BindSubnet, "remote1", "remote2", false},
+		{BindGroup, "198.51.100.1", "198.51.7.7", true},
+		{BindGroup, "203.0.113.1", "203.0.113.2", false},
+		{BindGroup, "203.0.113.1", "203.0.113.1", true},
+		{BindNone, "198.51.100.1", "203.0.113.1", true},
+	}
+	for _, test := range tests {
+		configuration := &sessionConfiguration{Binding: test.mode, AddressGroup: group}
+		if bound := configuration.bound(test.login, test.address); bound != test.expected {
+			t.Errorf("%s of %s accepts %s: %t", test.mode, test.login, test.address, bound)
+		}
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	events := []Event{}
+	security := CreateNew(testConfiguration(&events, func(configuration *Configuration) {
+		configuration.AuthenticationFilter = func(context interface{}) SessionIdentifier {
+			return context.(deviceRequest).identifier
+		}
+		configuration.UserAgentFilter = func(context interface{}) string {
+			if request, ok := context.(deviceRequest); ok {
+				return request.userAgent
+			}
+			return context.(deviceLogin).userAgent
+		}
+		configuration.Binding = BindSubnet
+		configuration.BindUserAgent = true
+	}))
+	firefox := "Mozilla/5.0 (Windows NT 10.0; rv:120.0) Gecko/20100101 Firefox/120.0"
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", firefox})
+	check(err, t)
+
+	identifier := session.ID
+	identifier.RemoteAddress = "198.51.100.7:4000"
+	updated := strings.Replace(firefox, "120.0", "121.0", -1)
+	if _, err = security.Authenticate(deviceRequest{identifier, updated}); err != nil {
+		t.Fatal("Session is not accepted from the subnet")
+	}
+	if address, _ := session.Attribute(SessionAttributeLastAddress); address != "198.51.100.7" {
+		t.Errorf("Unexpected last address %s", address)
+	}
+	devices, err := security.ListDevices(deviceRequest{identifier, firefox})
+	check(err, t)
+	if devices[0].FirstAddress != "198.51.100.1" || devices[0].LastAddress != "198.51.100.7" {
+		t.Errorf("Unexpected device %+v", devices[0])
+	}
+
+	events = nil
+	identifier.RemoteAddress = "203.0.113.1"
+	if _, err = security.Authenticate(deviceRequest{identifier, firefox}); err == nil || err.Error() != SessionBindingViolation {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != EventBindingViolation || events[0].Reason != ReasonAddress ||
+		events[0].RemoteAddress != "203.0.113.1" || events[0].PrincipalID != session.Principal.ID() {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if err = security.EndCurrentSession(deviceRequest{identifier, firefox}); err == nil || err.Error() != SessionBindingViolation {
+		t.Error("Session is ended from another network")
+	}
+
+	events = nil
+	identifier.RemoteAddress = "198.51.100.1"
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0.0.0 Safari/537.36"
+	if _, err = security.Authenticate(deviceRequest{identifier, chrome}); err == nil || err.Error() != SessionBindingViolation {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(events) != 1 || events[0].Reason != ReasonUserAgent {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	identifier.SSID = "unknown"
+	if _, err = security.Authenticate(deviceRequest{identifier, firefox}); err == nil || err.Error() != SessionNotFound {
+		t.Error("Session is found by a wrong SSID")
+	}
+	if _, err = security.Authenticate(deviceRequest{session.ID, firefox}); err != nil {
+		t.Error("Session is ended by binding violations")
+	}
+}
+
+type deviceRequest struct {
+	identifier SessionIdentifier
+	userAgent  string
+}
@@ -0,0 +1,231 @@
+package porter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type CachedStoreOptions struct {
+	/*
+		The maximum number of cached sessions. Defaults to 10000.
+	*/
+	Size int
+	/*
+		The maximum age of a cached session, older sessions are loaded again. Defaults to 1 second.
+	*/
+	MaxAge time.Duration
+}
+
+/*
+Statistics of a CachedStore.
+*/
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+/*
+SessionStore caching the sessions loaded from another store, usually a remote one.
+
+Lookups are served from a bounded LRU cache while the cached session is younger than the maximum age,
+so a session removed by another instance may be found during this time at most.
+Removals of the pool and revocations received from other instances drop the cached session immediately,
+see: Configuration.RevocationBus. Writes and principal lookups go to the underlying store.
+*/
+type CachedStore struct {
+	store   SessionStore
+	options CachedStoreOptions
+
+	lock    sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	stats   CacheStats
+	drops   uint64
+}
+
+type cacheKey struct {
+	realm string
+	sid   string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	session *Session
+	loaded  time.Time
+}
+
+func NewCachedStore(store SessionStore, options CachedStoreOptions) *CachedStore {
+	if options.Size <= 0 {
+		options.Size = 10000
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = time.Second
+	}
+	return &CachedStore{
+		store:   store,
+		options: options,
+		entries: map[cacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+/*
+Returns the cached session if it is not older than the maximum age.
+*/
+func (cs *CachedStore) cached(key cacheKey, now time.Time) (*Session, bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	element, ok := cs.entries[key]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if now.Sub(entry.loaded) < cs.options.MaxAge {
+			cs.lru.MoveToFront(element)
+			cs.stats.Hits++
+			return entry.session, true
+		}
+		cs.lru.Remove(element)
+		delete(cs.entries, key)
+	}
+	cs.stats.Misses++
+	return nil, false
+}
+
+func (cs *CachedStore) put(session *Session, now time.Time) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.insert(session, now)
+}
+
+/*
+Caches the session loaded from the store unless a session was dropped since the load started.
+*/
+func (cs *CachedStore) fill(session *Session, now time.Time, drops uint64) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.drops == drops {
+		cs.insert(session, now)
+	}
+}
+
+func (cs *CachedStore) insert(session *Session, now time.Time) {
+	key := cacheKey{session.ID.Realm, session.ID.SID}
+	if element, ok := cs.entries[key]; ok {
+		element.Value = &cacheEntry{key, session, now}
+		cs.lru.MoveToFront(element)
+		return
+	}
+	cs.entries[key] = cs.lru.PushFront(&cacheEntry{key, session, now})
+	for cs.lru.Len() > cs.options.Size {
+		oldest := cs.lru.Back()
+		cs.lru.Remove(oldest)
+		delete(cs.entries, oldest.Value.(*cacheEntry).key)
+		cs.stats.Evictions++
+	}
+}
+
+func (cs *CachedStore) drop(key cacheKey) bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.drops++
+
+	element, ok := cs.entries[key]
+	if ok {
+		cs.lru.Remove(element)
+		delete(cs.entries, key)
+	}
+	return ok
+}
+
+func (cs *CachedStore) Save(session *Session) error {
+	if err := cs.store.Save(session); err != nil {
+		return err
+	}
+	cs.put(session, time.Now())
+	return nil
+}
+
+func (cs *CachedStore) Get(identifier SessionIdentifier) (*Session, error) {
+	key := cacheKey{identifier.Realm, identifier.SID}
+	now := time.Now()
+	if session, ok := cs.cached(key, now); ok {
+		return session, nil
+	}
+	drops := cs.dropCount()
+	session, err := cs.store.Get(identifier)
+	if err != nil {
+		return nil, err
+	}
+	cs.fill(session, now, drops)
+	return session, nil
+}
+
+func (cs *CachedStore) Touch(sessions []*Session) error {
+	return cs.store.Touch(sessions)
+}
+
+func (cs *CachedStore) SaveAttributes(session *Session) error {
+	return cs.store.SaveAttributes(session)
+}
+
+/*
+Drops the cached session before and after the removal from the underlying store,
+so a concurrent lookup cannot keep the removed session in the cache.
+*/
+func (cs *CachedStore) Remove(session *Session) (bool, error) {
+	key := cacheKey{session.ID.Realm, session.ID.SID}
+	cs.drop(key)
+	removed, err := cs.store.Remove(session)
+	cs.drop(key)
+	return removed, err
+}
+
+func (cs *CachedStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	return cs.store.ByPrincipal(realm, principalId)
+}
+
+func (cs *CachedStore) Range(fn func(session *Session) bool) error {
+	return cs.store.Range(fn)
+}
+
+func (cs *CachedStore) Query(realm string, query SessionQuery) (*SessionPage, error) {
+	return QuerySessions(cs.store, realm, query)
+}
+
+/*
+Drops the cached session. Called by the pool for the sessions removed by other instances.
+*/
+func (cs *CachedStore) Invalidate(realm string, sid string) {
+	if cs.drop(cacheKey{realm, sid}) {
+		cs.lock.Lock()
+		cs.stats.Invalidations++
+		cs.lock.Unlock()
+	}
+	if store, ok := cs.store.(InvalidatingStore); ok {
+		store.Invalidate(realm, sid)
+	}
+}
+
+func (cs *CachedStore) dropCount() uint64 {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.drops
+}
+
+/*
+Returns the number of cached sessions.
+*/
+func (cs *CachedStore) Len() int {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.lru.Len()
+}
+
+func (cs *CachedStore) Stats() CacheStats {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.stats
+}
@@ -0,0 +1,138 @@
+package porter
+
+import (
+	"testing"
+	"time"
+)
+
+func newCachedStorePool(store SessionStore, bus RevocationBus) *SessionPool {
+	return newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+		RevocationBus:      bus,
+	})
+}
+
+func TestCachedStore_Lookups(t *testing.T) {
+	cache := NewCachedStore(newCopyingStore(), CachedStoreOptions{Size: 2, MaxAge: 50 * time.Millisecond})
+	pool := newCachedStorePool(cache, nil)
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	_, err = pool.getSession(session.ID)
+	check(err, t)
+	found, err := pool.getSession(session.ID)
+	check(err, t)
+	if found != session {
+		t.Error("Session is not served from the cache")
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 0 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	found, err = pool.getSession(session.ID)
+	check(err, t)
+	if found == session || cache.Stats().Misses != 1 {
+		t.Error("Stale session is not loaded again")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = pool.startSession(fileStorePrincipal, "remote1")
+		check(err, t)
+	}
+	if cache.Len() != 2 || cache.Stats().Evictions != 1 {
+		t.Errorf("Cache is not bounded: %d sessions, %+v", cache.Len(), cache.Stats())
+	}
+
+	pool.removeSession(found)
+	if _, err = pool.getSession(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Removed session found")
+	}
+}
+
+func TestCachedStore_Revocation(t *testing.T) {
+	bus := NewLocalRevocationBus()
+	shared := newCopyingStore()
+	first := NewCachedStore(shared, CachedStoreOptions{MaxAge: time.Hour})
+	second := NewCachedStore(shared, CachedStoreOptions{MaxAge: time.Hour})
+	firstPool := newCachedStorePool(first, bus)
+	secondPool := newCachedStorePool(second, bus)
+
+	session, err := firstPool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	_, err = secondPool.getSession(session.ID)
+	check(err, t)
+	if second.Len() != 1 {
+		t.Fatal("Session is not cached")
+	}
+
+	firstPool.removeSession(session)
+	if _, err = secondPool.getSession(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Revoked session served from the cache")
+	}
+	if stats := second.Stats(); stats.Invalidations != 1 || stats.Misses != 2 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+/*
+Runs the hooks in the middle of the store operations to interleave lookups and removals.
+*/
+type interleavingStore struct {
+	*copyingStore
+	onGet    func()
+	onRemove func()
+}
+
+func (s *interleavingStore) Get(identifier SessionIdentifier) (*Session, error) {
+	session, err := s.copyingStore.Get(identifier)
+	if hook := s.onGet; hook != nil {
+		s.onGet = nil
+		hook()
+	}
+	return session, err
+}
+
+func (s *interleavingStore) Remove(session *Session) (bool, error) {
+	if hook := s.onRemove; hook != nil {
+		s.onRemove = nil
+		hook()
+	}
+	return s.copyingStore.Remove(session)
+}
+
+func TestCachedStore_RemoveRace(t *testing.T) {
+	store := &interleavingStore{copyingStore: newCopyingStore()}
+	cache := NewCachedStore(store, CachedStoreOptions{MaxAge: time.Hour})
+	pool := newCachedStorePool(cache, nil)
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	cache.Invalidate(session.ID.Realm, session.ID.SID)
+	store.onRemove = func() {
+		_, err := cache.Get(session.ID)
+		check(err, t)
+	}
+	_, err = cache.Remove(session)
+	check(err, t)
+	if _, err = cache.Get(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Session loaded during the removal is cached")
+	}
+
+	session, err = pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	cache.Invalidate(session.ID.Realm, session.ID.SID)
+	store.onGet = func() {
+		_, err := cache.Remove(session)
+		check(err, t)
+	}
+	_, err = cache.Get(session.ID)
+	check(err, t)
+	if _, err = cache.Get(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Session loaded before the removal is cached")
+	}
+}
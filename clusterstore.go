@@ -0,0 +1,665 @@
+package porter
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	clusterOpSave       = "save"
+	clusterOpTouch      = "touch"
+	clusterOpRemove     = "remove"
+	clusterOpGet        = "get"
+	clusterOpSync       = "sync"
+	clusterOpAttributes = "attributes"
+)
+
+type ClusterOptions struct {
+	/*
+		The address the node listens on for its peers, also used as the node identity.
+		Port zero selects a free port, see: ClusterStore.Address
+	*/
+	Address string
+	/*
+		The addresses of the other nodes.
+	*/
+	Peers []string
+	/*
+		The number of points of every node on the hash ring. Defaults to 64.
+	*/
+	VirtualNodes int
+	/*
+		The timeout of dialing and of every request to a peer. Defaults to 2 seconds.
+	*/
+	IOTimeout time.Duration
+	/*
+		The number of shards of the in-memory store. See: NewMemoryStore
+	*/
+	Shards int
+	/*
+		The secret shared by all nodes authenticating every message with HMAC-SHA256.
+		The messages are not encrypted, use TLS as well on networks open to eavesdroppers.
+	*/
+	Key []byte
+	/*
+		The mutual TLS configuration of listening and of dialing the peers.
+		It must hold the certificate of the node, trust the certificates of the peers by RootCAs and ClientCAs,
+		and require them by ClientAuth tls.RequireAndVerifyClientCert.
+	*/
+	TLS *tls.Config
+}
+
+/*
+SessionStore replicating in-memory sessions between several instances over TCP.
+
+Every node keeps a replica of all sessions and sends every save, refresh, attribute change and removal to all peers.
+The owner of a session is selected by the consistent hash of its SID,
+lookups of sessions owned by another node are forwarded to the owner,
+falling back to the local replica when the owner is unreachable.
+A started node pulls the state from the first reachable peer,
+so a restarted node recovers the sessions created while it was down.
+
+Peers are trusted with everything: a peer reads the SID and SSID of every session,
+which are bearer credentials, and may save a session for any principal.
+So the nodes must authenticate each other by ClusterOptions.Key or by mutual TLS, the store does not start without one of them.
+The key binds the messages to the random nonces both nodes send on connecting and to their order,
+so recorded messages cannot be replayed to either node.
+*/
+type ClusterStore struct {
+	memory   *MemoryStore
+	resolver PrincipalResolver
+	options  ClusterOptions
+	listener net.Listener
+	address  string
+
+	lock  sync.RWMutex
+	ring  []clusterPoint
+	peers map[string]*clusterPeer
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]bool
+	closed    bool
+	done      sync.WaitGroup
+}
+
+type clusterPoint struct {
+	hash    uint32
+	address string
+}
+
+type clusterTouch struct {
+	Realm       string    `json:"realm"`
+	SID         string    `json:"sid"`
+	RefreshTime time.Time `json:"refresh_time"`
+}
+
+type clusterMessage struct {
+	Op         string            `json:"op,omitempty"`
+	Record     *sessionRecord    `json:"record,omitempty"`
+	Realm      string            `json:"realm,omitempty"`
+	SID        string            `json:"sid,omitempty"`
+	Touches    []clusterTouch    `json:"touches,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Nonce      []byte            `json:"nonce,omitempty"`
+	Found      bool              `json:"found,omitempty"`
+	Done       bool              `json:"done,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+/*
+A message authenticated by the key of the cluster.
+*/
+type clusterFrame struct {
+	Message json.RawMessage `json:"message"`
+	MAC     []byte          `json:"mac"`
+}
+
+const (
+	clusterRequest  = 'q'
+	clusterResponse = 'r'
+)
+
+/*
+The size of the nonce every node sends on connecting.
+*/
+const clusterNonceSize = 16
+
+/*
+Encodes the messages of a connection. With a key every message is framed with the HMAC
+of its direction, the nonces of the dialing and of the listening node, its sequence number and its body.
+*/
+type clusterCodec struct {
+	key      []byte
+	nonce    []byte
+	in       byte
+	out      byte
+	sent     uint64
+	received uint64
+	encoder  *json.Encoder
+	decoder  *json.Decoder
+}
+
+func (c *clusterCodec) mac(direction byte, sequence uint64, body []byte) []byte {
+	hash := hmac.New(sha256.New, c.key)
+	hash.Write([]byte{direction})
+	hash.Write(c.nonce)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], sequence)
+	hash.Write(counter[:])
+	hash.Write(body)
+	return hash.Sum(nil)
+}
+
+func (c *clusterCodec) encode(message *clusterMessage) error {
+	if len(c.key) == 0 {
+		return c.encoder.Encode(message)
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.sent++
+	return c.encoder.Encode(&clusterFrame{Message: body, MAC: c.mac(c.out, c.sent, body)})
+}
+
+func (c *clusterCodec) decode(message *clusterMessage) error {
+	if len(c.key) == 0 {
+		return c.decoder.Decode(message)
+	}
+	frame := &clusterFrame{}
+	if err := c.decoder.Decode(frame); err != nil {
+		return err
+	}
+	c.received++
+	if !hmac.Equal(frame.MAC, c.mac(c.in, c.received, frame.Message)) {
+		return errors.New(PeerNotAuthenticated)
+	}
+	return json.Unmarshal(frame.Message, message)
+}
+
+/*
+Connection to a peer, requests are sent one by one.
+*/
+type clusterPeer struct {
+	address   string
+	timeout   time.Duration
+	key       []byte
+	tlsConfig *tls.Config
+	lock      sync.Mutex
+	conn      net.Conn
+	codec     *clusterCodec
+}
+
+/*
+Starts the node: listens for the peers and pulls the state from them.
+Uses the resolver to restore the Authentication Principals of the replicated sessions.
+Returns the KeyRequired error if neither the key nor the TLS configuration requiring client certificates is set,
+the ResolverRequired error if the resolver is nil.
+*/
+func NewClusterStore(resolver PrincipalResolver, options ClusterOptions) (*ClusterStore, error) {
+	if resolver == nil {
+		return nil, errors.New(ResolverRequired)
+	}
+	if len(options.Key) == 0 && (options.TLS == nil || options.TLS.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return nil, errors.New(KeyRequired)
+	}
+	if options.VirtualNodes <= 0 {
+		options.VirtualNodes = 64
+	}
+	if options.IOTimeout <= 0 {
+		options.IOTimeout = 2 * time.Second
+	}
+	var listener net.Listener
+	var err error
+	if options.TLS != nil {
+		listener, err = tls.Listen("tcp", options.Address, options.TLS)
+	} else {
+		listener, err = net.Listen("tcp", options.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cs := &ClusterStore{
+		memory:   NewMemoryStore(options.Shards),
+		resolver: resolver,
+		options:  options,
+		listener: listener,
+		address:  listener.Addr().String(),
+		conns:    map[net.Conn]bool{},
+	}
+	cs.SetPeers(options.Peers)
+	cs.done.Add(1)
+	go cs.serve()
+	if len(options.Peers) > 0 {
+		_ = cs.Sync()
+	}
+	return cs, nil
+}
+
+/*
+Returns the address of the node.
+*/
+func (cs *ClusterStore) Address() string {
+	return cs.address
+}
+
+/*
+Replaces the peers of the node and rebuilds the hash ring.
+*/
+func (cs *ClusterStore) SetPeers(peers []string) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	current := cs.peers
+	cs.peers = map[string]*clusterPeer{}
+	for _, address := range peers {
+		if address == cs.address {
+			continue
+		}
+		if peer, ok := current[address]; ok {
+			cs.peers[address] = peer
+			delete(current, address)
+		} else {
+			cs.peers[address] = &clusterPeer{address: address, timeout: cs.options.IOTimeout, key: cs.options.Key, tlsConfig: cs.options.TLS}
+		}
+	}
+	for _, peer := range current {
+		peer.close()
+	}
+
+	cs.ring = cs.ring[:0]
+	cs.addPoints(cs.address)
+	for address := range cs.peers {
+		cs.addPoints(address)
+	}
+	sort.Slice(cs.ring, func(i, j int) bool {
+		return cs.ring[i].hash < cs.ring[j].hash
+	})
+}
+
+func (cs *ClusterStore) addPoints(address string) {
+	for i := 0; i < cs.options.VirtualNodes; i++ {
+		cs.ring = append(cs.ring, clusterPoint{shardHash(address + "#" + strconv.Itoa(i)), address})
+	}
+}
+
+/*
+Returns the owner of the SID and its peer, nil for the node itself.
+*/
+func (cs *ClusterStore) owner(sid string) (string, *clusterPeer) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	hash := shardHash(sid)
+	i := sort.Search(len(cs.ring), func(i int) bool {
+		return cs.ring[i].hash >= hash
+	})
+	if i == len(cs.ring) {
+		i = 0
+	}
+	address := cs.ring[i].address
+	return address, cs.peers[address]
+}
+
+func (cs *ClusterStore) allPeers() []*clusterPeer {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	peers := make([]*clusterPeer, 0, len(cs.peers))
+	for _, peer := range cs.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+/*
+Sends the message to all peers. Unreachable peers recover the state on their start.
+*/
+func (cs *ClusterStore) broadcast(message *clusterMessage) {
+	var wg sync.WaitGroup
+	for _, peer := range cs.allPeers() {
+		wg.Add(1)
+		go func(peer *clusterPeer) {
+			defer wg.Done()
+			_, _ = peer.request(message, nil)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+/*
+Pulls all sessions from the first reachable peer.
+*/
+func (cs *ClusterStore) Sync() error {
+	err := errors.New(PeerUnavailable)
+	for _, peer := range cs.allPeers() {
+		_, err = peer.request(&clusterMessage{Op: clusterOpSync}, func(record *sessionRecord) {
+			if _, err := cs.memory.Get(record.identifier()); err == nil {
+				return
+			}
+			if session, err := record.session(cs.resolver); err == nil {
+				_ = cs.memory.Save(session)
+			}
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (cs *ClusterStore) Save(session *Session) error {
+	if err := cs.memory.Save(session); err != nil {
+		return err
+	}
+	session.stored(session.lastRefresh())
+	cs.broadcast(&clusterMessage{Op: clusterOpSave, Record: newSessionRecord(session)})
+	return nil
+}
+
+func (cs *ClusterStore) Get(identifier SessionIdentifier) (*Session, error) {
+	address, peer := cs.owner(identifier.SID)
+	if address == cs.address || peer == nil {
+		return cs.memory.Get(identifier)
+	}
+	response, err := peer.request(&clusterMessage{Op: clusterOpGet, Realm: identifier.Realm, SID: identifier.SID}, nil)
+	if err != nil {
+		return cs.memory.Get(identifier)
+	}
+	if !response.Found || response.Record == nil {
+		return nil, errors.New(SessionNotFound)
+	}
+	return response.Record.session(cs.resolver)
+}
+
+func (cs *ClusterStore) touchLocal(touches []clusterTouch) {
+	for _, touch := range touches {
+		if local, err := cs.memory.Get(SessionIdentifier{SID: touch.SID, Realm: touch.Realm}); err == nil {
+			local.restoreRefresh(touch.RefreshTime)
+			local.stored(touch.RefreshTime)
+		}
+	}
+}
+
+func (cs *ClusterStore) Touch(sessions []*Session) error {
+	touches := make([]clusterTouch, len(sessions))
+	for i, session := range sessions {
+		touches[i] = clusterTouch{session.ID.Realm, session.ID.SID, session.lastRefresh()}
+	}
+	cs.touchLocal(touches)
+	for i, session := range sessions {
+		session.stored(touches[i].RefreshTime)
+	}
+	cs.broadcast(&clusterMessage{Op: clusterOpTouch, Touches: touches})
+	return nil
+}
+
+func (cs *ClusterStore) attributesLocal(realm string, sid string, attributes map[string]string) {
+	if local, err := cs.memory.Get(SessionIdentifier{SID: sid, Realm: realm}); err == nil {
+		local.restoreAttributes(attributes)
+	}
+}
+
+func (cs *ClusterStore) SaveAttributes(session *Session) error {
+	attributes := session.Attributes()
+	cs.attributesLocal(session.ID.Realm, session.ID.SID, attributes)
+	cs.broadcast(&clusterMessage{Op: clusterOpAttributes, Realm: session.ID.Realm, SID: session.ID.SID, Attributes: attributes})
+	return nil
+}
+
+func (cs *ClusterStore) removeLocal(realm string, sid string) (bool, error) {
+	local, err := cs.memory.Get(SessionIdentifier{SID: sid, Realm: realm})
+	if err != nil {
+		return false, nil
+	}
+	return cs.memory.Remove(local)
+}
+
+func (cs *ClusterStore) Remove(session *Session) (bool, error) {
+	removed, err := cs.removeLocal(session.ID.Realm, session.ID.SID)
+	if err != nil {
+		return false, err
+	}
+	cs.broadcast(&clusterMessage{Op: clusterOpRemove, Realm: session.ID.Realm, SID: session.ID.SID})
+	return removed, nil
+}
+
+func (cs *ClusterStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	return cs.memory.ByPrincipal(realm, principalId)
+}
+
+func (cs *ClusterStore) Range(fn func(session *Session) bool) error {
+	return cs.memory.Range(fn)
+}
+
+func (cs *ClusterStore) serve() {
+	defer cs.done.Done()
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			return
+		}
+		cs.connsLock.Lock()
+		if cs.closed {
+			cs.connsLock.Unlock()
+			conn.Close()
+			return
+		}
+		cs.conns[conn] = true
+		cs.done.Add(1)
+		cs.connsLock.Unlock()
+		go cs.handle(conn)
+	}
+}
+
+/*
+Applies the messages of a peer without sending them further.
+*/
+func (cs *ClusterStore) handle(conn net.Conn) {
+	defer func() {
+		cs.connsLock.Lock()
+		delete(cs.conns, conn)
+		cs.connsLock.Unlock()
+		conn.Close()
+		cs.done.Done()
+	}()
+	writer := bufio.NewWriter(conn)
+	codec := &clusterCodec{
+		key:     cs.options.Key,
+		in:      clusterRequest,
+		out:     clusterResponse,
+		encoder: json.NewEncoder(writer),
+		decoder: json.NewDecoder(bufio.NewReader(conn)),
+	}
+	if len(codec.key) > 0 {
+		hello := &clusterMessage{}
+		if codec.decoder.Decode(hello) != nil || len(hello.Nonce) != clusterNonceSize {
+			return
+		}
+		nonce := generateRandom(clusterNonceSize)
+		if codec.encoder.Encode(&clusterMessage{Nonce: nonce}) != nil || writer.Flush() != nil {
+			return
+		}
+		codec.nonce = append(hello.Nonce, nonce...)
+	}
+	for {
+		message := &clusterMessage{}
+		if err := codec.decode(message); err != nil {
+			return
+		}
+		response := &clusterMessage{Done: true}
+		switch message.Op {
+		case clusterOpSave:
+			if message.Record != nil {
+				if session, err := message.Record.session(cs.resolver); err == nil {
+					_, _ = cs.removeLocal(session.ID.Realm, session.ID.SID)
+					_ = cs.memory.Save(session)
+				}
+			}
+		case clusterOpTouch:
+			cs.touchLocal(message.Touches)
+		case clusterOpAttributes:
+			cs.attributesLocal(message.Realm, message.SID, message.Attributes)
+		case clusterOpRemove:
+			_, _ = cs.removeLocal(message.Realm, message.SID)
+		case clusterOpGet:
+			if session, err := cs.memory.Get(SessionIdentifier{SID: message.SID, Realm: message.Realm}); err == nil {
+				response.Found = true
+				response.Record = newSessionRecord(session)
+			}
+		case clusterOpSync:
+			var err error
+			_ = cs.memory.Range(func(session *Session) bool {
+				err = codec.encode(&clusterMessage{Record: newSessionRecord(session)})
+				return err == nil
+			})
+			if err != nil {
+				return
+			}
+		default:
+			response.Error = "unknown operation " + message.Op
+		}
+		if codec.encode(response) != nil || writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+/*
+Stops listening, closes the connections of the peers and waits for their handlers.
+*/
+func (cs *ClusterStore) Close() error {
+	cs.connsLock.Lock()
+	cs.closed = true
+	err := cs.listener.Close()
+	for conn := range cs.conns {
+		conn.Close()
+	}
+	cs.connsLock.Unlock()
+
+	for _, peer := range cs.allPeers() {
+		peer.close()
+	}
+	cs.done.Wait()
+	return err
+}
+
+/*
+Sends the request and reads the response.
+Records preceding the final response are passed to the function.
+A request failed on a reused connection is retried once on a new one, the peer may have been restarted.
+*/
+func (p *clusterPeer) request(message *clusterMessage, records func(record *sessionRecord)) (*clusterMessage, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	reused := p.conn != nil
+	for {
+		if p.conn == nil {
+			if err := p.dial(); err != nil {
+				return nil, err
+			}
+		}
+		response, err := p.exchange(message, records)
+		if err == nil {
+			return response, nil
+		}
+		p.conn.Close()
+		p.conn = nil
+		if !reused {
+			return nil, err
+		}
+		reused = false
+	}
+}
+
+/*
+Connects to the peer and exchanges the nonces of the connection if the messages are authenticated.
+*/
+func (p *clusterPeer) dial() error {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var conn net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.address, p.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", p.address)
+	}
+	if err != nil {
+		return err
+	}
+	codec := &clusterCodec{
+		key:     p.key,
+		in:      clusterResponse,
+		out:     clusterRequest,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(bufio.NewReader(conn)),
+	}
+	if len(codec.key) > 0 {
+		nonce := generateRandom(clusterNonceSize)
+		hello := &clusterMessage{}
+		if err = conn.SetDeadline(time.Now().Add(p.timeout)); err == nil {
+			err = codec.encoder.Encode(&clusterMessage{Nonce: nonce})
+		}
+		if err == nil {
+			err = codec.decoder.Decode(hello)
+		}
+		if err == nil && len(hello.Nonce) != clusterNonceSize {
+			err = errors.New(PeerNotAuthenticated)
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		codec.nonce = append(nonce, hello.Nonce...)
+	}
+	p.conn = conn
+	p.codec = codec
+	return nil
+}
+
+func (p *clusterPeer) exchange(message *clusterMessage, records func(record *sessionRecord)) (*clusterMessage, error) {
+	if err := p.conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	if err := p.codec.encode(message); err != nil {
+		return nil, err
+	}
+	for {
+		response := &clusterMessage{}
+		if err := p.codec.decode(response); err != nil {
+			return nil, err
+		}
+		if response.Done {
+			if response.Error != "" {
+				return nil, errors.New(response.Error)
+			}
+			return response, nil
+		}
+		if records != nil && response.Record != nil {
+			records(response.Record)
+		}
+		if err := p.conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *clusterPeer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
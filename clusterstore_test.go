@@ -0,0 +1,351 @@
+package porter
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var clusterKey = []byte("cluster key")
+
+func startClusterNode(t *testing.T, address string, peers ...string) *ClusterStore {
+	store, err := NewClusterStore(fileStoreResolver, ClusterOptions{
+		Address:   address,
+		Peers:     peers,
+		IOTimeout: time.Second,
+		Key:       clusterKey,
+	})
+	check(err, t)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func newClusterPool(store *ClusterStore) *SessionPool {
+	return newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+	})
+}
+
+func startCluster(t *testing.T, size int) []*ClusterStore {
+	nodes := make([]*ClusterStore, size)
+	addresses := make([]string, size)
+	for i := range nodes {
+		nodes[i] = startClusterNode(t, "127.0.0.1:0")
+		addresses[i] = nodes[i].Address()
+	}
+	for _, node := range nodes {
+		node.SetPeers(addresses)
+	}
+	return nodes
+}
+
+func TestClusterStore_Replication(t *testing.T) {
+	nodes := startCluster(t, 3)
+	pools := []*SessionPool{newClusterPool(nodes[0]), newClusterPool(nodes[1]), newClusterPool(nodes[2])}
+
+	session, err := pools[0].startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	for i, node := range nodes {
+		if _, err = node.memory.Get(session.ID); err != nil {
+			t.Errorf("Session is not replicated to node %d", i)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	refreshed, err := pools[1].getSession(session.ID)
+	check(err, t)
+	for i, node := range nodes {
+		replica, err := node.memory.Get(session.ID)
+		check(err, t)
+		if replica.lastRefresh().Before(refreshed.lastRefresh()) {
+			t.Errorf("Refresh is not replicated to node %d", i)
+		}
+	}
+	if len(pools[2].getAllSessions(fileStorePrincipal)) != 1 {
+		t.Error("Sessions of the principal are not replicated")
+	}
+
+	refreshed.SetAttribute("theme", "dark")
+	check(pools[1].saveAttributes(refreshed), t)
+	for i, node := range nodes {
+		replica, err := node.memory.Get(session.ID)
+		check(err, t)
+		if value, _ := replica.Attribute("theme"); value != "dark" {
+			t.Errorf("Attributes are not replicated to node %d", i)
+		}
+	}
+
+	pools[2].removeSession(refreshed)
+	for i, pool := range pools {
+		if _, err = pool.getSession(session.ID); err == nil || err.Error() != SessionNotFound {
+			t.Errorf("Removed session found on node %d", i)
+		}
+	}
+}
+
+func TestClusterStore_Ownership(t *testing.T) {
+	nodes := startCluster(t, 3)
+	pool := newClusterPool(nodes[0])
+
+	owners := map[string]int{}
+	for i := 0; i < 30; i++ {
+		session, err := pool.startSession(fileStorePrincipal, "remote1")
+		check(err, t)
+		first, _ := nodes[0].owner(session.ID.SID)
+		for _, node := range nodes[1:] {
+			if owner, _ := node.owner(session.ID.SID); owner != first {
+				t.Fatal("Nodes disagree on the owner")
+			}
+		}
+		owners[first]++
+	}
+	if len(owners) != 3 {
+		t.Errorf("Sessions are not spread over the nodes: %v", owners)
+	}
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	owner, _ := nodes[0].owner(session.ID.SID)
+	var other *ClusterStore
+	for _, node := range nodes {
+		if node.Address() != owner {
+			other = node
+		}
+	}
+	found, err := other.Get(session.ID)
+	check(err, t)
+	if found.ID != session.ID {
+		t.Error("Forwarded lookup returned another session")
+	}
+	if owner != other.Address() {
+		if replica, _ := other.memory.Get(session.ID); replica == found {
+			t.Error("Lookup is not forwarded to the owner")
+		}
+	}
+}
+
+func TestClusterStore_Restart(t *testing.T) {
+	nodes := startCluster(t, 3)
+	pool := newClusterPool(nodes[0])
+
+	before, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	address := nodes[2].Address()
+	check(nodes[2].Close(), t)
+
+	during, err := pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	for _, session := range []*Session{before, during} {
+		if _, err = nodes[1].Get(session.ID); err != nil {
+			t.Error("Lookup fails while a node is down")
+		}
+	}
+
+	restarted := startClusterNode(t, address, nodes[0].Address(), nodes[1].Address())
+	for _, session := range []*Session{before, during} {
+		if _, err = restarted.memory.Get(session.ID); err != nil {
+			t.Error("Restarted node did not pull the state")
+		}
+	}
+
+	after, err := pool.startSession(fileStorePrincipal, "remote3")
+	check(err, t)
+	if _, err = restarted.memory.Get(after.ID); err != nil {
+		t.Error("Session is not replicated to the restarted node")
+	}
+}
+
+func TestClusterStore_Authentication(t *testing.T) {
+	if _, err := NewClusterStore(fileStoreResolver, ClusterOptions{Address: "127.0.0.1:0"}); err == nil || err.Error() != KeyRequired {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := NewClusterStore(fileStoreResolver, ClusterOptions{Address: "127.0.0.1:0", TLS: &tls.Config{}}); err == nil || err.Error() != KeyRequired {
+		t.Fatalf("TLS without client certificates is accepted: %v", err)
+	}
+	if _, err := NewClusterStore(nil, ClusterOptions{Address: "127.0.0.1:0", Key: clusterKey}); err == nil || err.Error() != ResolverRequired {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	node := startClusterNode(t, "127.0.0.1:0")
+	session, err := newClusterPool(node).startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+
+	conn, err := net.Dial("tcp", node.Address())
+	check(err, t)
+	defer conn.Close()
+	_, err = conn.Write([]byte(`{"nonce":"AAAAAAAAAAAAAAAAAAAAAA=="}` + "\n" + `{"op":"sync"}` + "\n" + `{"message":{"op":"sync"},"mac":""}` + "\n"))
+	check(err, t)
+	check(conn.SetDeadline(time.Now().Add(time.Second)), t)
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.Contains(line, "nonce") {
+		t.Fatalf("Unexpected greeting %q %v", line, err)
+	}
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Unauthenticated request is answered %q", line)
+	}
+
+	forged, err := NewClusterStore(fileStoreResolver, ClusterOptions{
+		Address:   "127.0.0.1:0",
+		Peers:     []string{node.Address()},
+		IOTimeout: time.Second,
+		Key:       []byte("wrong key"),
+	})
+	check(err, t)
+	defer forged.Close()
+	if err = forged.Sync(); err == nil {
+		t.Error("Node with a wrong key pulled the state")
+	}
+	if _, err = forged.memory.Get(session.ID); err == nil {
+		t.Error("Session is replicated to a node with a wrong key")
+	}
+}
+
+/*
+Proxy recording the bytes the node sends to the dialer.
+*/
+func recordingProxy(t *testing.T, target string) (string, *[]byte, *sync.Mutex) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	check(err, t)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	recorded := &[]byte{}
+	lock := &sync.Mutex{}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, conn)
+		buffer := make([]byte, 4096)
+		for {
+			n, err := upstream.Read(buffer)
+			lock.Lock()
+			*recorded = append(*recorded, buffer[:n]...)
+			lock.Unlock()
+			if _, writeErr := conn.Write(buffer[:n]); err != nil || writeErr != nil {
+				return
+			}
+		}
+	}()
+	return listener.Addr().String(), recorded, lock
+}
+
+func TestClusterStore_Replay(t *testing.T) {
+	node := startClusterNode(t, "127.0.0.1:0")
+	session, err := newClusterPool(node).startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+
+	address, recorded, lock := recordingProxy(t, node.Address())
+	peer := &clusterPeer{address: address, timeout: time.Second, key: clusterKey}
+	get := &clusterMessage{Op: clusterOpGet, Realm: session.ID.Realm, SID: session.ID.SID}
+	response, err := peer.request(get, nil)
+	check(err, t)
+	if !response.Found {
+		t.Fatal("Session is not found through the proxy")
+	}
+	peer.close()
+
+	spoofed, err := net.Listen("tcp", "127.0.0.1:0")
+	check(err, t)
+	defer spoofed.Close()
+	go func() {
+		conn, err := spoofed.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err = bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		lock.Lock()
+		replayed := append([]byte{}, *recorded...)
+		lock.Unlock()
+		conn.Write(replayed)
+		time.Sleep(100 * time.Millisecond)
+	}()
+	victim := &clusterPeer{address: spoofed.Addr().String(), timeout: time.Second, key: clusterKey}
+	defer victim.close()
+	if response, err = victim.request(get, nil); err == nil || err.Error() != PeerNotAuthenticated {
+		t.Errorf("Replayed response is accepted: %+v %v", response, err)
+	}
+}
+
+func TestClusterStore_TLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(err, t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "porter"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	check(err, t)
+	certificate, err := x509.ParseCertificate(der)
+	check(err, t)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	nodes := make([]*ClusterStore, 2)
+	for i := range nodes {
+		nodes[i], err = NewClusterStore(fileStoreResolver, ClusterOptions{Address: "127.0.0.1:0", IOTimeout: time.Second, TLS: config})
+		check(err, t)
+		defer nodes[i].Close()
+	}
+	for _, node := range nodes {
+		node.SetPeers([]string{nodes[0].Address(), nodes[1].Address()})
+	}
+	session, err := newClusterPool(nodes[0]).startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	if _, err = nodes[1].memory.Get(session.ID); err != nil {
+		t.Error("Session is not replicated over TLS")
+	}
+
+	conn, err := tls.Dial("tcp", nodes[0].Address(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		_, err = conn.Write([]byte(`{"op":"sync"}` + "\n"))
+		if err == nil {
+			check(conn.SetDeadline(time.Now().Add(time.Second)), t)
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("Peer without a certificate is answered")
+	}
+}
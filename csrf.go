@@ -0,0 +1,328 @@
+package porter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+How the CSRF token is verified.
+*/
+type CSRFMode uint8
+
+const (
+	/*
+		The token is kept by the session, the request must submit it in the header or the form field.
+	*/
+	CSRFSynchronizer CSRFMode = iota
+	/*
+		The token is signed for the session and set as a cookie readable by scripts,
+		the request must submit the value of the cookie in the header or the form field.
+	*/
+	CSRFDoubleSubmit
+)
+
+func (m CSRFMode) String() string {
+	switch m {
+	case CSRFSynchronizer:
+		return "synchronizer"
+	case CSRFDoubleSubmit:
+		return "double_submit"
+	}
+	return "unknown"
+}
+
+/*
+Session attributes of the CSRF secret: the issue time and the current secret, and the secret before the last rotation.
+*/
+const (
+	SessionAttributeCSRF         = "porter.csrf"
+	SessionAttributeCSRFPrevious = "porter.csrf_previous"
+)
+
+/*
+Returns TRUE for the attributes holding the CSRF secrets.
+*/
+func csrfAttribute(key string) bool {
+	return key == SessionAttributeCSRF || key == SessionAttributeCSRFPrevious
+}
+
+type CSRFOptions struct {
+	Mode CSRFMode
+	/*
+		The key of the signatures of CSRFDoubleSubmit. Random by default.
+		Instances sharing the store must share the key to accept the tokens of each other.
+	*/
+	Key []byte
+	/*
+		The age of the token after which it is rotated by the next request of the session.
+		The previous token is accepted until the next rotation. Defaults to one hour, negative rotates on step-up only.
+	*/
+	Rotation time.Duration
+	/*
+		Rotates the token by the next request after the session is refreshed, in addition to Rotation.
+		The previous token is accepted until the next rotation,
+		so pages open in other tabs submit rejected tokens after two refreshes.
+	*/
+	RotateOnRefresh bool
+	/*
+		The header of the submitted token. Defaults to "X-CSRF-Token".
+	*/
+	HeaderName string
+	/*
+		The form field of the submitted token. Defaults to "csrf_token".
+	*/
+	FieldName string
+	/*
+		The cookie of CSRFDoubleSubmit. Defaults to "porter_csrf".
+	*/
+	CookieName string
+	/*
+		Finds the session of the request without refreshing it, the next handler authenticates the request.
+		Defaults to the AuthenticationFilter with the request as the context,
+		the default takes no rate limits since the next handler takes them.
+	*/
+	Session func(request *http.Request) (*Session, error)
+	/*
+		Serves the rejected requests. Defaults to 403 Forbidden with the CSRFTokenInvalid error.
+	*/
+	FailureHandler http.Handler
+}
+
+/*
+CSRF protection bound to the session. See: CSRF.Middleware
+*/
+type CSRF struct {
+	security *Security
+	options  CSRFOptions
+	locks    []sync.Mutex
+}
+
+/*
+Creates the protection of the sessions of the security. Unset options take their defaults.
+*/
+func NewCSRF(security *Security, options CSRFOptions) *CSRF {
+	if len(options.Key) == 0 {
+		options.Key = generateRandom(32)
+	}
+	if options.HeaderName == "" {
+		options.HeaderName = "X-CSRF-Token"
+	}
+	if options.FieldName == "" {
+		options.FieldName = "csrf_token"
+	}
+	if options.CookieName == "" {
+		options.CookieName = "porter_csrf"
+	}
+	if options.Rotation == 0 {
+		options.Rotation = time.Hour
+	}
+	if options.Session == nil {
+		options.Session = func(request *http.Request) (*Session, error) {
+			_, _, session, err := security.lookup(request, false)
+			return session, err
+		}
+	}
+	return &CSRF{security: security, options: options, locks: make([]sync.Mutex, shardCount(0))}
+}
+
+type csrfContextKey struct{}
+
+type csrfState struct {
+	token string
+	field string
+}
+
+/*
+Returns the CSRF token of the request passed through CSRF.Middleware, empty if the request has no session.
+*/
+func CSRFToken(request *http.Request) string {
+	if state, ok := request.Context().Value(csrfContextKey{}).(csrfState); ok {
+		return state.token
+	}
+	return ""
+}
+
+/*
+Returns the hidden form field of the CSRF token for templates, empty if the request has no session.
+*/
+func CSRFField(request *http.Request) template.HTML {
+	state, ok := request.Context().Value(csrfContextKey{}).(csrfState)
+	if !ok || state.token == "" {
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(state.field) +
+		`" value="` + template.HTMLEscapeString(state.token) + `">`)
+}
+
+/*
+Returns TRUE for the methods that must not change the state.
+*/
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+/*
+Verifies the token of the requests of unsafe methods and exposes the token to the next handler, see: CSRFToken.
+Requests without a session, or with a session not found, are passed through, the next handler is expected to reject them.
+*/
+func (c *CSRF) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		session, _ := c.options.Session(request)
+		if session == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		current, previous := c.secrets(session)
+		token := current
+		if c.options.Mode == CSRFDoubleSubmit {
+			token = c.cookieToken(writer, request, session, current)
+		}
+		if !safeMethod(request.Method) && !c.verify(request, session, current, previous) {
+			c.reject(writer, request, session)
+			return
+		}
+		ctx := context.WithValue(request.Context(), csrfContextKey{}, csrfState{token: token, field: c.options.FieldName})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+/*
+Returns the current and the previous secrets of the session, issuing or rotating the current one if due.
+Issued secrets are written to the store of the session after the lock of the session is released.
+*/
+func (c *CSRF) secrets(session *Session) (string, string) {
+	lock := &c.locks[shardHash(session.ID.Realm+"\x00"+session.ID.SID)%uint32(len(c.locks))]
+	lock.Lock()
+	current, previous, issued := c.issue(session)
+	lock.Unlock()
+	if issued {
+		if realm, err := c.security.realmFor(session.ID); err == nil {
+			_ = realm.pool.saveAttributes(session)
+		}
+	}
+	return current, previous
+}
+
+/*
+Issues a new secret of the session if it has none or the current one is due for rotation.
+The issue time is kept in nanoseconds to compare it with the refresh time of the session.
+*/
+func (c *CSRF) issue(session *Session) (string, string, bool) {
+	now := time.Now()
+	previous, _ := session.Attribute(SessionAttributeCSRFPrevious)
+	value, ok := session.Attribute(SessionAttributeCSRF)
+	if ok {
+		if separator := strings.IndexByte(value, '.'); separator > 0 {
+			nanos, err := strconv.ParseInt(value[:separator], 10, 64)
+			issued := time.Unix(0, nanos)
+			current := value[separator+1:]
+			if err == nil && (c.options.Rotation <= 0 || now.Sub(issued) < c.options.Rotation) &&
+				(!c.options.RotateOnRefresh || !session.lastRefresh().After(issued)) {
+				return current, previous, false
+			}
+			previous = current
+			session.SetAttribute(SessionAttributeCSRFPrevious, previous)
+		}
+	}
+	current := base64.RawURLEncoding.EncodeToString(generateRandom(32))
+	session.SetAttribute(SessionAttributeCSRF, strconv.FormatInt(now.UnixNano(), 10)+"."+current)
+	return current, previous, true
+}
+
+/*
+Clears the CSRF secrets of the session, so the next request issues a new token and the old ones are rejected.
+The caller writes the attributes to the store.
+*/
+func resetCSRF(session *Session) {
+	session.removeAttribute(SessionAttributeCSRF)
+	session.removeAttribute(SessionAttributeCSRFPrevious)
+}
+
+/*
+Signs the nonce for the session and the secret, "nonce.signature".
+*/
+func (c *CSRF) sign(session *Session, secret string, nonce string) string {
+	mac := hmac.New(sha256.New, c.options.Key)
+	mac.Write([]byte(session.ID.Realm + "\x00" + session.ID.SID + "\x00" + secret + "\x00" + nonce))
+	return nonce + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Returns TRUE if the token is signed for the session and the secret.
+*/
+func (c *CSRF) signed(session *Session, secret string, token string) bool {
+	separator := strings.IndexByte(token, '.')
+	if secret == "" || separator <= 0 {
+		return false
+	}
+	return equalTokens(token, c.sign(session, secret, token[:separator]))
+}
+
+/*
+Returns the token of the cookie, setting a new cookie if it is missing or signed with another secret.
+*/
+func (c *CSRF) cookieToken(writer http.ResponseWriter, request *http.Request, session *Session, secret string) string {
+	if cookie, err := request.Cookie(c.options.CookieName); err == nil && c.signed(session, secret, cookie.Value) {
+		return cookie.Value
+	}
+	token := c.sign(session, secret, base64.RawURLEncoding.EncodeToString(generateRandom(16)))
+	http.SetCookie(writer, &http.Cookie{
+		Name:     c.options.CookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+/*
+Returns TRUE if the request submits a valid token of the session.
+*/
+func (c *CSRF) verify(request *http.Request, session *Session, current string, previous string) bool {
+	submitted := request.Header.Get(c.options.HeaderName)
+	if submitted == "" {
+		submitted = request.PostFormValue(c.options.FieldName)
+	}
+	if submitted == "" {
+		return false
+	}
+	if c.options.Mode == CSRFDoubleSubmit {
+		cookie, err := request.Cookie(c.options.CookieName)
+		return err == nil && equalTokens(submitted, cookie.Value) &&
+			(c.signed(session, current, submitted) || c.signed(session, previous, submitted))
+	}
+	return equalTokens(submitted, current) || (previous != "" && equalTokens(submitted, previous))
+}
+
+func equalTokens(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (c *CSRF) reject(writer http.ResponseWriter, request *http.Request, session *Session) {
+	err := errors.New(CSRFTokenInvalid)
+	if realm, realmErr := c.security.realmFor(session.ID); realmErr == nil {
+		realm.pool.configuration.logger().Warn("CSRF token rejected", sessionFields(session, "method", request.Method, "path", request.URL.Path)...)
+		realm.pool.emit(Event{Kind: EventAccessDenied, Session: session, Reason: ReasonCSRF, Err: err})
+	}
+	if c.options.FailureHandler != nil {
+		c.options.FailureHandler.ServeHTTP(writer, request)
+		return
+	}
+	writeError(writer, http.StatusForbidden, CSRFTokenInvalid)
+}
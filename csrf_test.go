@@ -0,0 +1,202 @@
+package porter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+The session is found by the default lookup in a store returning copies,
+so the secrets must be written to the store to be kept between the requests.
+Requests with the Authorization header are sent with the session.
+*/
+func newCSRFFixture(t *testing.T, options CSRFOptions) (*Security, *Session, http.Handler, *[]Event) {
+	events := []Event{}
+	security := CreateNew(testConfiguration(&events, func(configuration *Configuration) {
+		configuration.AuthenticationFilter = requestIdentifier
+		configuration.Store = newCopyingStore()
+	}))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	protected := NewCSRF(security, options).Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(CSRFToken(request)))
+	}))
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "" {
+			request.Header.Set("X-SID", session.ID.SID)
+			request.Header.Set("X-SSID", session.ID.SSID)
+		}
+		protected.ServeHTTP(writer, request)
+	})
+	return security, session, handler, &events
+}
+
+func csrfRequest(handler http.Handler, method string, token string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/", nil)
+	request.Header.Set("Authorization", "session")
+	if token != "" {
+		request.Header.Set("X-CSRF-Token", token)
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCSRFSynchronizer(t *testing.T) {
+	security, session, handler, events := newCSRFFixture(t, CSRFOptions{})
+	token := csrfRequest(handler, http.MethodGet, "", nil).Body.String()
+	if token == "" || csrfRequest(handler, http.MethodGet, "", nil).Body.String() != token {
+		t.Fatal("Token is not kept by the session")
+	}
+	if response := csrfRequest(handler, http.MethodPost, token, nil); response.Code != http.StatusOK {
+		t.Errorf("Valid token is rejected: %d", response.Code)
+	}
+
+	*events = nil
+	if response := csrfRequest(handler, http.MethodDelete, "forged", nil); response.Code != http.StatusForbidden ||
+		!strings.Contains(response.Body.String(), CSRFTokenInvalid) {
+		t.Errorf("Forged token is accepted: %d", response.Code)
+	}
+	if len(*events) != 1 || (*events)[0].Kind != EventAccessDenied || (*events)[0].Reason != ReasonCSRF || (*events)[0].Session.ID != session.ID {
+		t.Errorf("Unexpected events %+v", *events)
+	}
+	if response := csrfRequest(handler, http.MethodPost, "", nil); response.Code != http.StatusForbidden {
+		t.Error("Missing token is accepted")
+	}
+
+	form := url.Values{"csrf_token": {token}}
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	request.Header.Set("Authorization", "session")
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Token of the form field is rejected")
+	}
+
+	check(security.CompleteStepUp(session), t)
+	if response := csrfRequest(handler, http.MethodPost, token, nil); response.Code != http.StatusForbidden {
+		t.Error("Token is not rotated by the step-up")
+	}
+
+	anonymous := httptest.NewRequest(http.MethodPost, "/", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, anonymous)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "" {
+		t.Error("Request without a session is not passed through")
+	}
+}
+
+func TestCSRFRotation(t *testing.T) {
+	security, session, handler, _ := newCSRFFixture(t, CSRFOptions{Rotation: time.Hour})
+	first := csrfRequest(handler, http.MethodGet, "", nil).Body.String()
+	check(security.SetAttribute(session, SessionAttributeCSRF, "1."+first), t)
+
+	second := csrfRequest(handler, http.MethodGet, "", nil).Body.String()
+	if second == first {
+		t.Fatal("Token is not rotated")
+	}
+	if csrfRequest(handler, http.MethodPost, first, nil).Code != http.StatusOK ||
+		csrfRequest(handler, http.MethodPost, second, nil).Code != http.StatusOK {
+		t.Error("Token is rejected after the rotation")
+	}
+	if csrfRequest(handler, http.MethodGet, "", nil).Body.String() != second {
+		t.Error("Token is rotated before its age")
+	}
+}
+
+func TestCSRFRotateOnRefresh(t *testing.T) {
+	security, session, handler, _ := newCSRFFixture(t, CSRFOptions{RotateOnRefresh: true})
+	refresh := func() {
+		time.Sleep(time.Millisecond)
+		_, err := security.Authenticate(sessionRequest(http.MethodGet, "/", session))
+		check(err, t)
+	}
+	first := csrfRequest(handler, http.MethodGet, "", nil).Body.String()
+	if csrfRequest(handler, http.MethodGet, "", nil).Body.String() != first {
+		t.Fatal("Token is rotated without a refresh")
+	}
+
+	refresh()
+	second := csrfRequest(handler, http.MethodGet, "", nil).Body.String()
+	if second == first {
+		t.Fatal("Token is not rotated by the refresh")
+	}
+	if csrfRequest(handler, http.MethodPost, first, nil).Code != http.StatusOK {
+		t.Error("Previous token is rejected")
+	}
+
+	refresh()
+	if csrfRequest(handler, http.MethodPost, first, nil).Code != http.StatusForbidden {
+		t.Error("Token is accepted after two refreshes")
+	}
+	if csrfRequest(handler, http.MethodPost, second, nil).Code != http.StatusOK {
+		t.Error("Previous token is rejected")
+	}
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	security, session, handler, _ := newCSRFFixture(t, CSRFOptions{Mode: CSRFDoubleSubmit, Key: []byte("key")})
+	response := csrfRequest(handler, http.MethodGet, "", nil)
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "porter_csrf" || cookies[0].Value != response.Body.String() || cookies[0].HttpOnly {
+		t.Fatalf("Unexpected cookies %+v", cookies)
+	}
+	token := cookies[0].Value
+
+	response = csrfRequest(handler, http.MethodPost, token, cookies)
+	if response.Code != http.StatusOK || len(response.Result().Cookies()) != 0 {
+		t.Errorf("Valid token is rejected: %d", response.Code)
+	}
+	if csrfRequest(handler, http.MethodPost, token, nil).Code != http.StatusForbidden {
+		t.Error("Token without the cookie is accepted")
+	}
+	forged := []*http.Cookie{{Name: "porter_csrf", Value: "nonce.signature"}}
+	if csrfRequest(handler, http.MethodPost, "nonce.signature", forged).Code != http.StatusForbidden {
+		t.Error("Unsigned token is accepted")
+	}
+
+	other, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	stored, err := security.defaultRealm.pool.store.Get(session.ID)
+	check(err, t)
+	value, _ := stored.Attribute(SessionAttributeCSRF)
+	secret := value[strings.IndexByte(value, '.')+1:]
+	csrf := NewCSRF(security, CSRFOptions{Mode: CSRFDoubleSubmit, Key: []byte("key")})
+	if !csrf.signed(session, secret, token) || csrf.signed(other, secret, token) {
+		t.Error("Token is accepted for another session")
+	}
+
+	check(security.CompleteStepUp(session), t)
+	response = csrfRequest(handler, http.MethodPost, token, cookies)
+	if response.Code != http.StatusForbidden || len(response.Result().Cookies()) != 1 {
+		t.Error("Token is not rotated by the step-up")
+	}
+}
+
+func TestCSRFField(t *testing.T) {
+	events := []Event{}
+	security := newAnomalySecurity(&events)
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	csrf := NewCSRF(security, CSRFOptions{FieldName: "token", Session: func(request *http.Request) (*Session, error) {
+		return session, nil
+	}})
+	var token, field string
+	csrf.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token, field = CSRFToken(request), string(CSRFField(request))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if token == "" || field != `<input type="hidden" name="token" value="`+token+`">` {
+		t.Errorf("Unexpected field %s", field)
+	}
+	if CSRFField(httptest.NewRequest(http.MethodGet, "/", nil)) != "" {
+		t.Error("Field is rendered without the middleware")
+	}
+}
@@ -0,0 +1,287 @@
+package porter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Session attributes describing the device of the session. See: DeviceView
+*/
+const (
+	/*
+		The user agent of the login request. See: Configuration.UserAgentFilter
+	*/
+	SessionAttributeUserAgent = "porter.user_agent"
+	/*
+		The label of the browser and the operating system parsed from the user agent, "Firefox on Windows".
+	*/
+	SessionAttributeDevice = "porter.device"
+	/*
+		The address of the last authentication if it differs from the login address.
+	*/
+	SessionAttributeLastAddress = "porter.last_address"
+)
+
+/*
+The maximum length of the captured user agent.
+*/
+const maxUserAgentLength = 512
+
+/*
+Session as shown to its owner on a "manage my devices" page.
+
+The handle identifies the session to the owner without exposing the SID,
+see: Realm.RevokeDevice
+*/
+type DeviceView struct {
+	Handle string `json:"handle"`
+	/*
+		TRUE for the session of the request.
+	*/
+	Current      bool      `json:"current"`
+	Device       string    `json:"device"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	FirstAddress string    `json:"first_address"`
+	LastAddress  string    `json:"last_address"`
+	Created      time.Time `json:"created"`
+	LastActive   time.Time `json:"last_active"`
+}
+
+/*
+Returns the device attributes of a new session.
+*/
+func deviceAttributes(userAgent string) map[string]string {
+	if userAgent == "" {
+		return nil
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return map[string]string{
+		SessionAttributeUserAgent: userAgent,
+		SessionAttributeDevice:    DeviceLabel(userAgent),
+	}
+}
+
+/*
+Records the address of the authentication if it differs from the last one and writes it to the store.
+*/
+func (sp *SessionPool) recordAddress(session *Session, remoteAddress string) {
+	address := NormalizeAddress(remoteAddress)
+	last, ok := session.Attribute(SessionAttributeLastAddress)
+	if !ok {
+		last = NormalizeAddress(session.ID.RemoteAddress)
+	}
+	if address != "" && last != address {
+		session.SetAttribute(SessionAttributeLastAddress, address)
+		_ = sp.saveAttributes(session)
+	}
+}
+
+/*
+Returns the label of the browser and the operating system of the user agent, "Chrome on Android".
+Unknown parts are labeled "Unknown".
+*/
+func DeviceLabel(userAgent string) string {
+	return userAgentBrowser(userAgent) + " on " + userAgentOS(userAgent)
+}
+
+/*
+Browsers by their user agent tokens, in the order of checking.
+Chromium based browsers mention Chrome and Safari, so they go first.
+*/
+var userAgentBrowsers = []struct {
+	token string
+	name  string
+}{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"YaBrowser/", "Yandex Browser"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+	{"MSIE ", "Internet Explorer"},
+	{"Trident/", "Internet Explorer"},
+	{"curl/", "curl"},
+}
+
+var userAgentSystems = []struct {
+	token string
+	name  string
+}{
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+func userAgentBrowser(userAgent string) string {
+	for _, browser := range userAgentBrowsers {
+		if strings.Contains(userAgent, browser.token) {
+			return browser.name
+		}
+	}
+	return "Unknown"
+}
+
+func userAgentOS(userAgent string) string {
+	for _, system := range userAgentSystems {
+		if strings.Contains(userAgent, system.token) {
+			return system.name
+		}
+	}
+	return "Unknown"
+}
+
+/*
+Returns the opaque handle of the session, the HMAC of its realm and SID.
+*/
+func (sp *SessionPool) deviceHandle(session *Session) string {
+	mac := hmac.New(sha256.New, sp.configuration.DeviceKey)
+	mac.Write([]byte(session.ID.Realm))
+	mac.Write([]byte{0})
+	mac.Write([]byte(session.ID.SID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (sp *SessionPool) deviceView(session *Session, current *Session) DeviceView {
+	attributes := session.Attributes()
+	view := DeviceView{
+		Handle:       sp.deviceHandle(session),
+		Current:      session.ID.SID == current.ID.SID,
+		Device:       attributes[SessionAttributeDevice],
+		UserAgent:    attributes[SessionAttributeUserAgent],
+		FirstAddress: session.ID.RemoteAddress,
+		LastAddress:  attributes[SessionAttributeLastAddress],
+		Created:      session.startTime,
+		LastActive:   session.lastRefresh(),
+	}
+	if view.Device == "" {
+		view.Device = DeviceLabel("")
+	}
+	if view.LastAddress == "" {
+		view.LastAddress = view.FirstAddress
+	}
+	return view
+}
+
+/*
+Returns the devices of the principal of the current session, the most recently active first.
+Expired sessions not yet removed are skipped.
+*/
+func (sp *SessionPool) listDevices(current *Session) []DeviceView {
+	sessions := sp.getAllSessions(current.Principal)
+	devices := make([]DeviceView, 0, len(sessions))
+	for _, session := range sessions {
+		if session.ID.SID != current.ID.SID && session.expiredBy(sp.configuration) != "" {
+			continue
+		}
+		devices = append(devices, sp.deviceView(session, current))
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastActive.After(devices[j].LastActive)
+	})
+	return devices
+}
+
+/*
+Removes the session of the principal of the current session by its handle.
+Returns the SessionNotFound error if the principal has no such session.
+*/
+func (sp *SessionPool) revokeDevice(current *Session, handle string) error {
+	sessions, err := sp.store.ByPrincipal(sp.configuration.Realm, current.Principal.ID())
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if hmac.Equal([]byte(sp.deviceHandle(session)), []byte(handle)) {
+			sp.endSession(background(), session, ReasonRevoked)
+			return nil
+		}
+	}
+	return errors.New(SessionNotFound)
+}
+
+/*
+Returns the devices of the principal of the current session in this realm.
+Uses the AuthenticationFilter delegate to retrieve the session ID.
+*/
+func (r *Realm) ListDevices(context interface{}) ([]DeviceView, error) {
+	if r.configuration.AuthenticationFilter == nil {
+		return nil, errors.New(AuthenticationFilterNotImplemented)
+	}
+	return r.listDevicesFor(r.configuration.AuthenticationFilter(context))
+}
+
+/*
+Ends the session of the principal of the current session by the handle of its DeviceView.
+Uses the AuthenticationFilter delegate to retrieve the session ID.
+Returns the SessionNotFound error if the handle does not belong to the principal.
+*/
+func (r *Realm) RevokeDevice(context interface{}, handle string) error {
+	if r.configuration.AuthenticationFilter == nil {
+		return errors.New(AuthenticationFilterNotImplemented)
+	}
+	return r.revokeDeviceFor(r.configuration.AuthenticationFilter(context), handle)
+}
+
+func (r *Realm) listDevicesFor(identifier SessionIdentifier) ([]DeviceView, error) {
+	current, err := r.pool.getSession(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return r.pool.listDevices(current), nil
+}
+
+func (r *Realm) revokeDeviceFor(identifier SessionIdentifier, handle string) error {
+	current, err := r.pool.getSession(identifier)
+	if err != nil {
+		return err
+	}
+	return r.pool.revokeDevice(current, handle)
+}
+
+/*
+Returns the devices of the principal of the current session. See: Realm.ListDevices
+*/
+func (s *Security) ListDevices(context interface{}) ([]DeviceView, error) {
+	if s.configuration.AuthenticationFilter == nil {
+		return nil, errors.New(AuthenticationFilterNotImplemented)
+	}
+	identifier := s.configuration.AuthenticationFilter(context)
+	realm, err := s.realmFor(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return realm.listDevicesFor(identifier)
+}
+
+/*
+Ends the session of the principal of the current session by its handle. See: Realm.RevokeDevice
+*/
+func (s *Security) RevokeDevice(context interface{}, handle string) error {
+	if s.configuration.AuthenticationFilter == nil {
+		return errors.New(AuthenticationFilterNotImplemented)
+	}
+	identifier := s.configuration.AuthenticationFilter(context)
+	realm, err := s.realmFor(identifier)
+	if err != nil {
+		return err
+	}
+	return realm.revokeDeviceFor(identifier, handle)
+}
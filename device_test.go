@@ -0,0 +1,159 @@
+package porter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceLabel(t *testing.T) {
+	labels := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":             "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0": "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148":  "Safari on iPhone",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.1; rv:120.0) Gecko/20100101 Firefox/120.0":                                         "Firefox on macOS",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36":       "Chrome on Android",
+		"curl/8.4.0": "curl on Unknown",
+		"":           "Unknown on Unknown",
+	}
+	for userAgent, expected := range labels {
+		if label := DeviceLabel(userAgent); label != expected {
+			t.Errorf("Label %s of %s, expected %s", label, userAgent, expected)
+		}
+	}
+}
+
+func TestDeviceLastAddress(t *testing.T) {
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.Store = newCopyingStore()
+	}))
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	identifier := session.ID
+	identifier.RemoteAddress = "203.0.113.1:4000"
+	_, err = security.Authenticate(identifier)
+	check(err, t)
+
+	stored, err := security.defaultRealm.pool.store.Get(session.ID)
+	check(err, t)
+	if address, _ := stored.Attribute(SessionAttributeLastAddress); address != "203.0.113.1" {
+		t.Errorf("Unexpected last address %s", address)
+	}
+}
+
+type deviceLogin struct {
+	principal AuthenticationPrincipal
+	remote    string
+	userAgent string
+}
+
+/*
+Returns the configuration of the security tests: logins by deviceLogin, authentications by SessionIdentifier,
+no binding, and the events collected if events is not nil. The overrides are applied in order.
+*/
+func testConfiguration(events *[]Event, overrides ...func(configuration *Configuration)) *Configuration {
+	configuration := &Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		LoginFilter: func(context interface{}) (AuthenticationPrincipal, string, error) {
+			login := context.(deviceLogin)
+			return login.principal, login.remote, nil
+		},
+		AuthenticationFilter: func(context interface{}) SessionIdentifier {
+			return context.(SessionIdentifier)
+		},
+		Logger:         testingLogger,
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     AllowNew,
+		Binding:        BindNone,
+	}
+	if events != nil {
+		configuration.Listeners = []EventListener{EventListenerFunc(func(event Event) {
+			*events = append(*events, event)
+		})}
+	}
+	for _, override := range overrides {
+		override(configuration)
+	}
+	return configuration
+}
+
+/*
+The AuthenticationFilter of the tests authenticating requests by the X-SID and X-SSID headers.
+*/
+func requestIdentifier(context interface{}) SessionIdentifier {
+	request := context.(*http.Request)
+	return SessionIdentifier{
+		SID:           request.Header.Get("X-SID"),
+		SSID:          request.Header.Get("X-SSID"),
+		RemoteAddress: request.RemoteAddr,
+	}
+}
+
+func TestDevices(t *testing.T) {
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.UserAgentFilter = func(context interface{}) string {
+			return context.(deviceLogin).userAgent
+		}
+	}))
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	alice := pp{ap{false, true, true}, "alice", policy}
+	bob := pp{ap{false, true, true}, "bob", policy}
+
+	phone, err := security.Login(deviceLogin{alice, "remote1", "Mozilla/5.0 (Linux; Android 14) Chrome/120.0.0.0 Mobile Safari/537.36"})
+	check(err, t)
+	time.Sleep(5 * time.Millisecond)
+	laptop, err := security.Login(deviceLogin{alice, "remote2", strings.Repeat("x", 1000)})
+	check(err, t)
+	other, err := security.Login(deviceLogin{bob, "remote3", ""})
+	check(err, t)
+
+	if value, _ := phone.Attribute(SessionAttributeDevice); value != "Chrome on Android" {
+		t.Errorf("Unexpected device %s", value)
+	}
+	if value, _ := laptop.Attribute(SessionAttributeUserAgent); len(value) != maxUserAgentLength {
+		t.Error("User agent is not truncated")
+	}
+
+	devices, err := security.ListDevices(phone.ID)
+	check(err, t)
+	if len(devices) != 2 {
+		t.Fatalf("Unexpected devices %v", devices)
+	}
+	// The phone is refreshed by ListDevices.
+	current, another := devices[0], devices[1]
+	if !current.Current || another.Current || current.Device != "Chrome on Android" || current.FirstAddress != "remote1" ||
+		current.LastAddress != "remote1" || another.Device != "Unknown on Unknown" || another.FirstAddress != "remote2" {
+		t.Errorf("Unexpected devices %+v", devices)
+	}
+	if current.Handle == another.Handle || strings.Contains(current.Handle, phone.ID.SID) {
+		t.Error("Handles are not opaque")
+	}
+
+	bobDevices, err := security.ListDevices(other.ID)
+	check(err, t)
+	if err = security.RevokeDevice(phone.ID, bobDevices[0].Handle); err == nil || err.Error() != SessionNotFound {
+		t.Error("Session of another principal is revoked")
+	}
+	if err = security.RevokeDevice(phone.ID, "unknown"); err == nil || err.Error() != SessionNotFound {
+		t.Error("Unknown handle is revoked")
+	}
+	check(security.RevokeDevice(phone.ID, another.Handle), t)
+	if _, err = security.Authenticate(laptop.ID); err == nil {
+		t.Error("Revoked device is authenticated")
+	}
+	if _, err = security.Authenticate(other.ID); err != nil {
+		t.Error("Session of another principal is ended")
+	}
+	devices, err = security.ListDevices(phone.ID)
+	check(err, t)
+	if len(devices) != 1 || devices[0].Handle != current.Handle {
+		t.Errorf("Unexpected devices %+v", devices)
+	}
+	if _, err = security.ListDevices(laptop.ID); err == nil {
+		t.Error("Devices of a revoked session are listed")
+	}
+}
@@ -6,3 +6,25 @@ const AuthenticationFilterNotImplemented = "AuthenticationFilterNotImplemented"
 const CannotLoginPrincipal = "CannotLoginPrincipal"
 const SessionExpired = "SessionExpired"
 const SessionAlreadyStarted = "SessionAlreadyStarted"
+const RealmNotFound = "RealmNotFound"
+const RealmAlreadyExists = "RealmAlreadyExists"
+const UnsupportedSnapshot = "UnsupportedSnapshot"
+const StoreClosed = "StoreClosed"
+const ConcurrentModification = "ConcurrentModification"
+const RESPProtocolError = "RESPProtocolError"
+const PeerUnavailable = "PeerUnavailable"
+const AuditChainBroken = "AuditChainBroken"
+const InvalidSessionQuery = "InvalidSessionQuery"
+const InvalidAddress = "InvalidAddress"
+const SessionBindingViolation = "SessionBindingViolation"
+const StepUpRequired = "StepUpRequired"
+const SessionRevoked = "SessionRevoked"
+const AddressNotAllowed = "AddressNotAllowed"
+const InvalidNetworkPolicy = "InvalidNetworkPolicy"
+const RateLimited = "RateLimited"
+const CSRFTokenInvalid = "CSRFTokenInvalid"
+const KeyRequired = "KeyRequired"
+const PeerNotAuthenticated = "PeerNotAuthenticated"
+const RevocationQueueFull = "RevocationQueueFull"
+const ResolverRequired = "ResolverRequired"
+const EntryTooLarge = "EntryTooLarge"
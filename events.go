@@ -0,0 +1,200 @@
+package porter
+
+import (
+	"time"
+)
+
+type EventKind string
+
+const (
+	/*
+		A session is started.
+	*/
+	EventLogin EventKind = "login"
+	/*
+		A session is loaded from a snapshot. See: Realm.RestoreSnapshot
+	*/
+	EventSessionRestored EventKind = "session_restored"
+	/*
+		A login is rejected, the reason is the kind of the error.
+	*/
+	EventLoginFailed EventKind = "login_failed"
+	/*
+		A session is removed, the reason tells why.
+	*/
+	EventSessionEnded EventKind = "session_ended"
+	/*
+		A session is used from an address or a user agent outside of its binding, the reason tells which one.
+		The remote address is the address of the rejected authentication. See: Configuration.Binding
+	*/
+	EventBindingViolation EventKind = "binding_violation"
+	/*
+		An anomaly detector flags a login or an authentication, the reason is the rule. See: Event.Anomaly
+	*/
+	EventAnomaly EventKind = "anomaly"
+	/*
+		An authentication of a session is rejected without ending the session, the reason tells why.
+	*/
+	EventAccessDenied EventKind = "access_denied"
+)
+
+/*
+Reasons of events.
+*/
+const (
+	/*
+		The session is ended by EndSession or EndCurrentSession.
+	*/
+	ReasonLogout = "logout"
+	/*
+		The session has not been active during the timeout.
+	*/
+	ReasonTimeout = "timeout"
+	/*
+		The total lifetime of the session is over.
+	*/
+	ReasonAbsolute = "absolute"
+	/*
+		The session is closed by a new login of the principal. See: MultiLoginType
+	*/
+	ReasonMultiLogin = "multi_login"
+	/*
+		The session is closed by a new login of the principal over Configuration.MaxSessions.
+	*/
+	ReasonMaxSessions = "max_sessions"
+	/*
+		The session is revoked by an administrator or by its owner from another session.
+	*/
+	ReasonRevoked = "revoked"
+	/*
+		The remote address is outside of the binding of the session.
+	*/
+	ReasonAddress = "address"
+	/*
+		The user agent differs from the user agent of the login.
+	*/
+	ReasonUserAgent = "user_agent"
+	/*
+		The session is ended or the login is rejected by the anomaly detection.
+	*/
+	ReasonAnomaly = "anomaly"
+	/*
+		The remote address is not allowed by the network policy. See: Configuration.NetworkPolicy
+	*/
+	ReasonNetwork = "network"
+	/*
+		The login is rejected by the rate limits. See: Configuration.RateLimits
+	*/
+	ReasonRateLimited = "rate_limited"
+	/*
+		The request is rejected by the CSRF protection. See: CSRF.Middleware
+	*/
+	ReasonCSRF = "csrf"
+	/*
+		The principal is not allowed to login. See: AuthenticationPrincipal.CanLogin
+	*/
+	ReasonCannotLogin = "cannot_login"
+	/*
+		The login is rejected since the principal has a session. See: MultiLoginType
+	*/
+	ReasonAlreadyStarted = "already_started"
+	/*
+		The authentication requires the step-up of the session. See: ActionStepUp
+	*/
+	ReasonStepUp = "step_up"
+	/*
+		The login is rejected by the LoginFilter.
+	*/
+	ReasonFilter = "filter"
+	/*
+		The session store failed.
+	*/
+	ReasonStore = "store"
+)
+
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	/*
+		The name of the realm the event happened in.
+	*/
+	Realm string
+	/*
+		The session of the event, nil for failed logins.
+	*/
+	Session       *Session
+	PrincipalID   string
+	RemoteAddress string
+	Reason        string
+	/*
+		The error of a failed login.
+	*/
+	Err error
+	/*
+		The anomaly of EventAnomaly.
+	*/
+	Anomaly *Anomaly
+}
+
+/*
+Receives the events of the session pools.
+Listeners are called synchronously by the goroutine causing the event, so they must be fast and safe for concurrent use.
+*/
+type EventListener interface {
+	OnEvent(event Event)
+}
+
+/*
+Adapter of ordinary functions to EventListener.
+*/
+type EventListenerFunc func(event Event)
+
+func (f EventListenerFunc) OnEvent(event Event) {
+	f(event)
+}
+
+/*
+Returns the reason of a failed login by its error. Errors of no policy are store failures.
+*/
+func failureReason(err error) string {
+	switch err.Error() {
+	case CannotLoginPrincipal:
+		return ReasonCannotLogin
+	case SessionAlreadyStarted:
+		return ReasonAlreadyStarted
+	case SessionRevoked:
+		return ReasonAnomaly
+	case AddressNotAllowed:
+		return ReasonNetwork
+	case RateLimited:
+		return ReasonRateLimited
+	case StepUpRequired:
+		return ReasonStepUp
+	case CSRFTokenInvalid:
+		return ReasonCSRF
+	}
+	return ReasonStore
+}
+
+func (sp *SessionPool) emit(event Event) {
+	if len(sp.configuration.Listeners) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	event.Realm = sp.configuration.Realm
+	if event.Session != nil {
+		event.PrincipalID = event.Session.Principal.ID()
+		if event.RemoteAddress == "" {
+			event.RemoteAddress = event.Session.ID.RemoteAddress
+		}
+	}
+	for _, listener := range sp.configuration.Listeners {
+		listener.OnEvent(event)
+	}
+}
+
+func (sp *SessionPool) loginFailed(principalId string, remoteAddress string, reason string, err error) {
+	event := Event{Kind: EventLoginFailed, PrincipalID: principalId, RemoteAddress: remoteAddress, Reason: reason, Err: err}
+	sp.emit(event)
+	sp.inspect(Observation{Kind: ObservationLoginFailed, PrincipalID: event.PrincipalID, RemoteAddress: remoteAddress, Err: err})
+}
@@ -0,0 +1,492 @@
+package porter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	fileStoreSnapshot = "sessions.snapshot"
+	fileStoreLog      = "sessions.wal"
+)
+
+const (
+	walSave       = "save"
+	walTouch      = "touch"
+	walRemove     = "remove"
+	walAttributes = "attributes"
+)
+
+/*
+Length and checksum preceding every log entry.
+*/
+const walFrameHeader = 8
+
+/*
+The largest log entry written. A longer length read from the log is treated as a torn tail.
+*/
+const walMaxEntry = 16 << 20
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+type SyncPolicy uint8
+
+const (
+	/*
+		Sync the log file after every write. Nothing is lost on a crash.
+	*/
+	SyncAlways SyncPolicy = iota
+	/*
+		Sync the log file in the background. Writes of the last interval may be lost on a crash.
+	*/
+	SyncInterval
+	/*
+		Never sync the log file, leaving it to the operating system.
+	*/
+	SyncNever
+)
+
+type FileStoreOptions struct {
+	/*
+		When the log file is synced to the disk.
+	*/
+	Sync SyncPolicy
+	/*
+		The interval of the background sync for SyncInterval. Defaults to one second.
+	*/
+	SyncInterval time.Duration
+	/*
+		The interval of the periodic compaction. Zero disables the periodic compaction.
+	*/
+	CompactInterval time.Duration
+	/*
+		The number of log entries triggering a compaction. Zero disables the compaction by size.
+	*/
+	CompactEntries int
+	/*
+		The number of shards of the in-memory store. See: NewMemoryStore
+	*/
+	Shards int
+	/*
+		Logs the failures of the background sync and compaction. Nil discards the messages.
+	*/
+	Logger Logger
+}
+
+/*
+Durable embedded SessionStore.
+
+Sessions are kept in memory, every save, refresh, attribute change and removal is appended to a write-ahead log file.
+On open the last snapshot is loaded and the log is replayed over it.
+A compaction writes a new snapshot and truncates the log.
+A torn tail of the log left by a crash is detected by the entry checksums and cut off.
+
+Expired sessions are left out of the snapshot but kept in memory until the pool removes them,
+so their end is reported to the event listeners.
+*/
+type FileStore struct {
+	memory   *MemoryStore
+	dir      string
+	options  FileStoreOptions
+	resolver PrincipalResolver
+
+	lock     sync.Mutex
+	log      *os.File
+	entries  int
+	unsynced bool
+	closed   bool
+
+	compact  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type walEntry struct {
+	Op          string            `json:"op"`
+	Record      *sessionRecord    `json:"record,omitempty"`
+	Realm       string            `json:"realm,omitempty"`
+	SID         string            `json:"sid,omitempty"`
+	RefreshTime time.Time         `json:"refresh_time"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+/*
+Opens the store in the directory, loading the snapshot and replaying the log.
+Uses the resolver to restore the Authentication Principals, sessions of not resolved principals are dropped.
+Returns the ResolverRequired error if the resolver is nil.
+*/
+func OpenFileStore(dir string, resolver PrincipalResolver, options FileStoreOptions) (*FileStore, error) {
+	if resolver == nil {
+		return nil, errors.New(ResolverRequired)
+	}
+	if options.Logger == nil {
+		options.Logger = discardLogger{}
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		memory:   NewMemoryStore(options.Shards),
+		dir:      dir,
+		options:  options,
+		resolver: resolver,
+		compact:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	go fs.run()
+	return fs, nil
+}
+
+func (fs *FileStore) path(name string) string {
+	return filepath.Join(fs.dir, name)
+}
+
+func (fs *FileStore) load() error {
+	now := time.Now()
+	err := readSnapshotFile(fs.path(fileStoreSnapshot), func(record *sessionRecord) error {
+		if record.ExpirationTime.Before(now) {
+			return nil
+		}
+		return fs.restore(record)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log, err := os.OpenFile(fs.path(fileStoreLog), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	valid, err := fs.replay(log)
+	if err == nil {
+		err = log.Truncate(valid)
+	}
+	if err == nil {
+		_, err = log.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		log.Close()
+		return err
+	}
+	fs.log = log
+	return nil
+}
+
+func (fs *FileStore) restore(record *sessionRecord) error {
+	session, err := record.session(fs.resolver)
+	if err != nil {
+		return nil
+	}
+	return fs.memory.Save(session)
+}
+
+/*
+Applies the log entries. Returns the offset of the end of the last valid entry.
+*/
+func (fs *FileStore) replay(log *os.File) (int64, error) {
+	reader := bufio.NewReader(log)
+	header := make([]byte, walFrameHeader)
+	var valid int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return valid, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > walMaxEntry {
+			return valid, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return valid, nil
+		}
+		if crc32.Checksum(payload, walTable) != checksum {
+			return valid, nil
+		}
+		entry := walEntry{}
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return valid, nil
+		}
+		if err := fs.apply(&entry); err != nil {
+			return valid, err
+		}
+		valid += int64(walFrameHeader + len(payload))
+		fs.entries++
+	}
+}
+
+func (fs *FileStore) apply(entry *walEntry) error {
+	switch entry.Op {
+	case walSave:
+		if entry.Record != nil {
+			return fs.restore(entry.Record)
+		}
+	case walTouch:
+		session, err := fs.memory.Get(SessionIdentifier{SID: entry.SID, Realm: entry.Realm})
+		if err == nil {
+			session.restoreRefresh(entry.RefreshTime)
+			session.stored(entry.RefreshTime)
+		}
+	case walAttributes:
+		session, err := fs.memory.Get(SessionIdentifier{SID: entry.SID, Realm: entry.Realm})
+		if err == nil {
+			session.restoreAttributes(entry.Attributes)
+		}
+	case walRemove:
+		session, err := fs.memory.Get(SessionIdentifier{SID: entry.SID, Realm: entry.Realm})
+		if err == nil {
+			_, err = fs.memory.Remove(session)
+		}
+		if err != nil && err.Error() != SessionNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeWalEntry(buffer []byte, entry *walEntry) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > walMaxEntry {
+		return nil, errors.New(EntryTooLarge)
+	}
+	header := make([]byte, walFrameHeader)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walTable))
+	buffer = append(buffer, header...)
+	return append(buffer, payload...), nil
+}
+
+/*
+Appends the entries to the log, the lock must be held.
+*/
+func (fs *FileStore) append(entries ...*walEntry) error {
+	if fs.closed {
+		return errors.New(StoreClosed)
+	}
+	var buffer []byte
+	var err error
+	for _, entry := range entries {
+		if buffer, err = encodeWalEntry(buffer, entry); err != nil {
+			return err
+		}
+	}
+	if _, err = fs.log.Write(buffer); err != nil {
+		return err
+	}
+	fs.entries += len(entries)
+	if fs.options.Sync == SyncAlways {
+		if err = fs.log.Sync(); err != nil {
+			return err
+		}
+	} else {
+		fs.unsynced = true
+	}
+	if fs.options.CompactEntries > 0 && fs.entries >= fs.options.CompactEntries {
+		select {
+		case fs.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) Save(session *Session) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := fs.append(&walEntry{Op: walSave, Record: newSessionRecord(session)}); err != nil {
+		return err
+	}
+	session.stored(session.lastRefresh())
+	return fs.memory.Save(session)
+}
+
+func (fs *FileStore) Get(identifier SessionIdentifier) (*Session, error) {
+	return fs.memory.Get(identifier)
+}
+
+func (fs *FileStore) Touch(sessions []*Session) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	entries := make([]*walEntry, 0, len(sessions))
+	refreshTimes := make([]time.Time, 0, len(sessions))
+	for _, session := range sessions {
+		refreshTime := session.lastRefresh()
+		refreshTimes = append(refreshTimes, refreshTime)
+		entries = append(entries, &walEntry{Op: walTouch, Realm: session.ID.Realm, SID: session.ID.SID, RefreshTime: refreshTime})
+	}
+	if err := fs.append(entries...); err != nil {
+		return err
+	}
+	for i, session := range sessions {
+		session.stored(refreshTimes[i])
+	}
+	return nil
+}
+
+func (fs *FileStore) SaveAttributes(session *Session) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	stored, err := fs.memory.Get(session.ID)
+	if err != nil {
+		return nil
+	}
+	attributes := session.Attributes()
+	if err = fs.append(&walEntry{Op: walAttributes, Realm: session.ID.Realm, SID: session.ID.SID, Attributes: attributes}); err != nil {
+		return err
+	}
+	if stored != session {
+		stored.restoreAttributes(attributes)
+	}
+	return nil
+}
+
+func (fs *FileStore) Remove(session *Session) (bool, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, err := fs.memory.Get(session.ID); err != nil {
+		return false, nil
+	}
+	if err := fs.append(&walEntry{Op: walRemove, Realm: session.ID.Realm, SID: session.ID.SID}); err != nil {
+		return false, err
+	}
+	return fs.memory.Remove(session)
+}
+
+func (fs *FileStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	return fs.memory.ByPrincipal(realm, principalId)
+}
+
+func (fs *FileStore) Range(fn func(session *Session) bool) error {
+	return fs.memory.Range(fn)
+}
+
+/*
+Writes a new snapshot without the expired sessions and truncates the log.
+*/
+func (fs *FileStore) Compact() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.closed {
+		return errors.New(StoreClosed)
+	}
+	now := time.Now()
+	err := writeSnapshotFile(fs.path(fileStoreSnapshot), func(emit func(record *sessionRecord) error) error {
+		var err error
+		rangeErr := fs.memory.Range(func(session *Session) bool {
+			if !session.expirationTime.Before(now) {
+				err = emit(newSessionRecord(session))
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return rangeErr
+	})
+	if err != nil {
+		return err
+	}
+	if err = fs.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = fs.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.entries = 0
+	fs.unsynced = false
+	return fs.log.Sync()
+}
+
+func (fs *FileStore) sync() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.closed || !fs.unsynced {
+		return nil
+	}
+	fs.unsynced = false
+	return fs.log.Sync()
+}
+
+func (fs *FileStore) run() {
+	defer close(fs.done)
+
+	var syncs, compactions <-chan time.Time
+	if fs.options.Sync == SyncInterval {
+		ticker := time.NewTicker(fs.options.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	if fs.options.CompactInterval > 0 {
+		ticker := time.NewTicker(fs.options.CompactInterval)
+		defer ticker.Stop()
+		compactions = ticker.C
+	}
+	for {
+		select {
+		case <-syncs:
+			if err := fs.sync(); err != nil {
+				fs.options.Logger.Error("Log sync failed", "dir", fs.dir, "error", err)
+			}
+		case <-compactions:
+			fs.compactLogged()
+		case <-fs.compact:
+			fs.compactLogged()
+		case <-fs.stop:
+			return
+		}
+	}
+}
+
+func (fs *FileStore) compactLogged() {
+	if err := fs.Compact(); err != nil {
+		fs.options.Logger.Error("Log compaction failed", "dir", fs.dir, "error", err)
+	}
+}
+
+/*
+Stops the background work, syncs and closes the log file.
+*/
+func (fs *FileStore) Close() error {
+	fs.stopOnce.Do(func() {
+		close(fs.stop)
+	})
+	<-fs.done
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	err := fs.log.Sync()
+	if closeErr := fs.log.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
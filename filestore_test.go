@@ -0,0 +1,177 @@
+package porter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var fileStorePrincipal = ap{false, true, true}
+
+func fileStoreResolver(id string) (AuthenticationPrincipal, error) {
+	return fileStorePrincipal, nil
+}
+
+func newFileStorePool(t *testing.T, dir string, options FileStoreOptions) (*SessionPool, *FileStore) {
+	store, err := OpenFileStore(dir, fileStoreResolver, options)
+	check(err, t)
+	return newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+	}), store
+}
+
+func TestFileStore_Replay(t *testing.T) {
+	dir := t.TempDir()
+	pool, store := newFileStorePool(t, dir, FileStoreOptions{Sync: SyncAlways})
+
+	kept, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	removed, err := pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	time.Sleep(10 * time.Millisecond)
+	_, err = pool.getSession(kept.ID)
+	check(err, t)
+	kept.SetAttribute("theme", "dark")
+	check(pool.saveAttributes(kept), t)
+	pool.removeSession(removed)
+	check(store.Close(), t)
+
+	pool, store = newFileStorePool(t, dir, FileStoreOptions{Sync: SyncAlways})
+	defer store.Close()
+
+	found, err := pool.getSession(kept.ID)
+	check(err, t)
+	if found.startTime.Equal(found.storedRefreshTime) {
+		t.Error("Refresh is not replayed")
+	}
+	if value, _ := found.Attribute("theme"); value != "dark" {
+		t.Error("Attributes are not replayed")
+	}
+	if _, err = pool.getSession(removed.ID); err == nil {
+		t.Error("Removal is not replayed")
+	}
+}
+
+func TestFileStore_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	pool, store := newFileStorePool(t, dir, FileStoreOptions{Sync: SyncNever})
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	check(store.Close(), t)
+
+	path := filepath.Join(dir, fileStoreLog)
+	info, err := os.Stat(path)
+	check(err, t)
+	valid := info.Size()
+
+	log, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	check(err, t)
+	_, err = log.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{', '"'})
+	check(err, t)
+	check(log.Close(), t)
+
+	pool, store = newFileStorePool(t, dir, FileStoreOptions{Sync: SyncNever})
+	info, err = os.Stat(path)
+	check(err, t)
+	if info.Size() != valid {
+		t.Errorf("Torn tail is not cut off: %d bytes, expected %d", info.Size(), valid)
+	}
+	_, err = pool.getSession(session.ID)
+	check(err, t)
+
+	second, err := pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	check(store.Close(), t)
+
+	pool, store = newFileStorePool(t, dir, FileStoreOptions{})
+	defer store.Close()
+	_, err = pool.getSession(second.ID)
+	check(err, t)
+}
+
+func TestFileStore_OversizedEntry(t *testing.T) {
+	dir := t.TempDir()
+	pool, store := newFileStorePool(t, dir, FileStoreOptions{Sync: SyncNever})
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	check(store.Close(), t)
+
+	path := filepath.Join(dir, fileStoreLog)
+	info, err := os.Stat(path)
+	check(err, t)
+	valid := info.Size()
+	log, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	check(err, t)
+	_, err = log.Write([]byte{0xff, 0xff, 0xff, 0xf0, 1, 2, 3, 4})
+	check(err, t)
+	check(log.Close(), t)
+
+	pool, store = newFileStorePool(t, dir, FileStoreOptions{Sync: SyncNever})
+	defer store.Close()
+	info, err = os.Stat(path)
+	check(err, t)
+	if info.Size() != valid {
+		t.Errorf("Oversized entry is not cut off: %d bytes, expected %d", info.Size(), valid)
+	}
+	_, err = pool.getSession(session.ID)
+	check(err, t)
+}
+
+func TestFileStore_Resolver(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenFileStore(dir, nil, FileStoreOptions{}); err == nil || err.Error() != ResolverRequired {
+		t.Errorf("Unexpected error %v", err)
+	}
+	pool, store := newFileStorePool(t, dir, FileStoreOptions{Sync: SyncAlways})
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	check(store.Close(), t)
+
+	store, err = OpenFileStore(dir, func(id string) (AuthenticationPrincipal, error) {
+		return nil, nil
+	}, FileStoreOptions{})
+	check(err, t)
+	defer store.Close()
+	if _, err = store.Get(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Errorf("Session of a missing principal is restored: %v", err)
+	}
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	dir := t.TempDir()
+	pool, store := newFileStorePool(t, dir, FileStoreOptions{Sync: SyncInterval, SyncInterval: time.Millisecond})
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	session.SetAttribute("theme", "dark")
+	expired, err := pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	expired.expirationTime = time.Now().Add(-time.Second)
+
+	check(store.Compact(), t)
+	info, err := os.Stat(filepath.Join(dir, fileStoreLog))
+	check(err, t)
+	if info.Size() != 0 {
+		t.Error("Log is not truncated")
+	}
+	if _, err = store.Get(expired.ID); err != nil {
+		t.Error("Expired session is removed without an event")
+	}
+	check(store.Close(), t)
+
+	pool, store = newFileStorePool(t, dir, FileStoreOptions{})
+	defer store.Close()
+	found, err := pool.getSession(session.ID)
+	check(err, t)
+	if value, _ := found.Attribute("theme"); value != "dark" {
+		t.Error("Attributes are not compacted")
+	}
+	if _, err = store.Get(expired.ID); err == nil {
+		t.Error("Expired session is compacted")
+	}
+}
@@ -1,7 +1,6 @@
 package porter
 
 import (
-	"log"
 	"time"
 )
 
@@ -19,12 +18,32 @@ type SuccessLoginHandler func(context interface{}, session *Session)
 Implements user authorization in any convenient way. Retrieves data from a context or request.
 
 Should return the correct AuthenticationPrincipal implementation and the remote address on successful authorization.
-Returns any error on failure.
+Returns any error on failure, a LoginFailedError if the attempted principal is known.
 
 Required! Implement this delegate.
 */
 type LoginFilter func(context interface{}) (AuthenticationPrincipal, string, error)
 
+/*
+The error of LoginFilter for a failed login of a known principal ID, a wrong password for example.
+The failure is charged to the principal: RateLimits.LoginPerPrincipal, the events and the anomaly detectors.
+*/
+type LoginFailedError struct {
+	/*
+		The ID of the attempted principal, whether it exists or not.
+	*/
+	PrincipalID string
+	Err         error
+}
+
+func (e *LoginFailedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoginFailedError) Unwrap() error {
+	return e.Err
+}
+
 /*
 Retrieves the session identifier from the current context.
 For example to get values from cookies or gin.Context.
@@ -33,6 +52,20 @@ Required! Implement this delegate to get session IDs from context.
 */
 type AuthenticationFilter func(context interface{}) SessionIdentifier
 
+/*
+Retrieves the user agent of the login request from the context, the User-Agent header for example.
+The user agent is kept in the session attributes, see: DeviceView
+
+Optional.
+*/
+type UserAgentFilter func(context interface{}) string
+
+/*
+Restores the Authentication Principal by its ID.
+Used to rehydrate sessions loaded from snapshots and persistent stores.
+*/
+type PrincipalResolver func(id string) (AuthenticationPrincipal, error)
+
 type AuthenticationPrincipal interface {
 	/*
 		Unique identifier
@@ -54,12 +87,49 @@ type AuthenticationPrincipal interface {
 	SaveSession() bool
 }
 
+/*
+Session settings applied to an Authentication Principal.
+*/
+type SessionPolicy struct {
+	/*
+		Session timeout. See: Configuration.Timeout
+	*/
+	Timeout time.Duration
+	/*
+		The total lifetime of the session. See: Configuration.ExpirationTime
+	*/
+	ExpirationTime time.Duration
+	/*
+		The parameter for creating a session for one user. See: Configuration.MultiLogin
+	*/
+	MultiLogin MultiLoginType
+	/*
+		The maximum number of sessions for one user. See: Configuration.MaxSessions
+	*/
+	MaxSessions int
+}
+
+/*
+Optional interface of AuthenticationPrincipal to override the session settings of the configuration.
+
+Receives the settings of the configuration and returns the settings for the principal.
+For example, admin accounts may shorten the timeout while kiosks keep sessions all day.
+*/
+type SessionPolicyProvider interface {
+	SessionPolicy(defaults SessionPolicy) SessionPolicy
+}
+
 type Configuration struct {
 	SuccessLoginHandler
 	LoginFilter
 	AuthenticationFilter
+	UserAgentFilter
 
-	Logger *log.Logger
+	/*
+		The structured logger, a *slog.Logger for example. Nil disables logging.
+		See: NewLogLogger
+	*/
+	Logger Logger
 	/*
 		The total lifetime of the session.
 
@@ -74,10 +144,97 @@ type Configuration struct {
 		The parameter for creating a session for one user.
 	*/
 	MultiLogin MultiLoginType
+	/*
+		The maximum number of sessions for one user. Zero means no limit.
+		The least recently refreshed sessions are closed when the limit is reached.
+	*/
+	MaxSessions int
 	/*
 		Can be disabled for a user. see: AuthenticationPrincipal.SaveSession()
 	*/
 	ForceExpire bool
+	/*
+		The number of lock-striped shards of the session pool. Defaults to 64.
+	*/
+	Shards int
+	/*
+		The store of the sessions. Defaults to the in-memory store.
+		Realms added with a nil configuration share the store of the root configuration.
+	*/
+	Store SessionStore
+	/*
+		The fraction of the timeout of the session policy the refresh time must advance by before it is written to the store.
+		Zero writes the refresh time on every successful authentication.
+	*/
+	RefreshThreshold float64
+	/*
+		The interval of writing refreshed sessions to the store in batches in the background.
+		Zero writes the refresh time immediately when the threshold is reached.
+	*/
+	RefreshInterval time.Duration
+	/*
+		The interval of ending the expired sessions of the store in the background,
+		so the end of the sessions never looked up again is reported to the listeners.
+		Instances sharing the store may sweep it from one instance only. Zero ends sessions on lookup only.
+	*/
+	SweepInterval time.Duration
+	/*
+		The bus the removals of sessions are published to and received from other instances
+		sharing the store. Nil disables the revocation broadcast.
+	*/
+	RevocationBus RevocationBus
+	/*
+		The listeners of the session events. Realms inherit the listeners of the root configuration if not set.
+	*/
+	Listeners []EventListener
+	/*
+		The tracer of logins and authentications started with a context. Nil disables tracing.
+		Realms inherit the tracer of the root configuration if not set.
+	*/
+	Tracer Tracer
+	/*
+		Resolves the remote address of logins and authentications when the context is an *http.Request
+		behind trusted proxies. Nil uses the address of the connection when LoginFilter returns an empty address.
+		See: NewRemoteAddressResolver
+	*/
+	AddressResolver *RemoteAddressResolver
+	/*
+		The detectors of suspicious logins and authentications. Realms inherit the detectors of the root configuration if not set.
+		See: NewImpossibleTravelDetector, NewAddressChurnDetector, NewFailureSpikeDetector
+	*/
+	AnomalyDetectors []AnomalyDetector
+	/*
+		The binding of sessions to the login address. Defaults to BindAddress.
+	*/
+	Binding BindingMode
+	/*
+		Returns the group of the address for BindGroup, the autonomous system or the carrier for example.
+		Addresses of the empty group are accepted from the login address only.
+	*/
+	AddressGroup func(address string) string
+	/*
+		Rejects authentications from another browser or operating system than the login one.
+		Requires UserAgentFilter, sessions started without the user agent are not bound.
+	*/
+	BindUserAgent bool
+	/*
+		The key of the handles of DeviceView. Random by default.
+		Instances sharing the store must share the key to accept the handles of each other.
+	*/
+	DeviceKey []byte
+	/*
+		Allowed and denied networks of logins and authentications. Nil allows all networks.
+		Checked against the address resolved by AddressResolver behind trusted proxies.
+		Principals may restrict their networks further, see: NetworkPolicyProvider.
+		Realms inherit the policy of the root configuration if not set.
+	*/
+	NetworkPolicy *NetworkPolicy
+	/*
+		The rate limits of logins and authentications. Nil disables rate limiting.
+		Rate limited requests fail with *RateLimitedError.
+		Realms inherit the limits of the root configuration if not set, counted separately for each realm.
+	*/
+	RateLimits *RateLimits
 }
 
 type MultiLoginType uint8
@@ -102,11 +259,27 @@ const (
 )
 
 type sessionConfiguration struct {
-	Logger             *log.Logger
+	Realm              string
+	Logger             Logger
 	ExpirationDuration time.Duration
 	Timeout            time.Duration
 	MultiLogin         MultiLoginType
+	MaxSessions        int
 	ForceExpire        bool
+	Shards             int
+	Store              SessionStore
+	RefreshThreshold   float64
+	RefreshInterval    time.Duration
+	SweepInterval      time.Duration
+	RevocationBus      RevocationBus
+	Listeners          []EventListener
+	Tracer             Tracer
+	AnomalyDetectors   []AnomalyDetector
+	Binding            BindingMode
+	AddressGroup       func(address string) string
+	BindUserAgent      bool
+	DeviceKey          []byte
+	NetworkPolicy      *NetworkPolicy
 }
 
 func (c *Configuration) getSessionConfiguration() *sessionConfiguration {
@@ -115,6 +288,38 @@ func (c *Configuration) getSessionConfiguration() *sessionConfiguration {
 		ExpirationDuration: c.ExpirationTime,
 		Timeout:            c.Timeout,
 		MultiLogin:         c.MultiLogin,
+		MaxSessions:        c.MaxSessions,
 		ForceExpire:        c.ForceExpire,
+		Shards:             c.Shards,
+		Store:              c.Store,
+		RefreshThreshold:   c.RefreshThreshold,
+		RefreshInterval:    c.RefreshInterval,
+		SweepInterval:      c.SweepInterval,
+		RevocationBus:      c.RevocationBus,
+		Listeners:          c.Listeners,
+		Tracer:             c.Tracer,
+		AnomalyDetectors:   c.AnomalyDetectors,
+		Binding:            c.Binding,
+		AddressGroup:       c.AddressGroup,
+		BindUserAgent:      c.BindUserAgent,
+		DeviceKey:          c.DeviceKey,
+		NetworkPolicy:      c.NetworkPolicy,
+	}
+}
+
+/*
+Returns the session settings for the principal.
+Principals implementing SessionPolicyProvider may override the settings of the configuration.
+*/
+func (c *sessionConfiguration) policyFor(principal AuthenticationPrincipal) SessionPolicy {
+	policy := SessionPolicy{
+		Timeout:        c.Timeout,
+		ExpirationTime: c.ExpirationDuration,
+		MultiLogin:     c.MultiLogin,
+		MaxSessions:    c.MaxSessions,
+	}
+	if provider, ok := principal.(SessionPolicyProvider); ok {
+		policy = provider.SessionPolicy(policy)
 	}
+	return policy
 }
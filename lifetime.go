@@ -0,0 +1,340 @@
+package porter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+The remaining lifetime of a session.
+*/
+type SessionLifetime struct {
+	/*
+		TRUE if the session ends after Timeout of inactivity. See: AuthenticationPrincipal.SaveSession
+	*/
+	IdleTimeout bool
+	/*
+		The time until the session times out unless refreshed, zero without the idle timeout.
+	*/
+	Idle time.Duration
+	/*
+		The time until the total lifetime of the session is over.
+	*/
+	Absolute time.Duration
+	/*
+		The time the session ends unless refreshed, the earliest of both.
+	*/
+	Expires time.Time
+}
+
+func (l SessionLifetime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IdleTimeout bool      `json:"idle_timeout"`
+		Idle        float64   `json:"idle_seconds"`
+		Absolute    float64   `json:"absolute_seconds"`
+		Expires     time.Time `json:"expires"`
+	}{l.IdleTimeout, l.Idle.Seconds(), l.Absolute.Seconds(), l.Expires})
+}
+
+func (sp *SessionPool) lifetime(session *Session) SessionLifetime {
+	now := time.Now()
+	lifetime := SessionLifetime{Expires: session.expirationTime}
+	if !session.Principal.SaveSession() || sp.configuration.ForceExpire {
+		idle := session.lastRefresh().Add(sp.configuration.policyFor(session.Principal).Timeout)
+		lifetime.IdleTimeout = true
+		lifetime.Idle = positive(idle.Sub(now))
+		if idle.Before(lifetime.Expires) {
+			lifetime.Expires = idle
+		}
+	}
+	lifetime.Absolute = positive(session.expirationTime.Sub(now))
+	return lifetime
+}
+
+func positive(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return 0
+	}
+	return duration
+}
+
+/*
+Returns the remaining lifetime of the session of this realm.
+*/
+func (r *Realm) Lifetime(session *Session) SessionLifetime {
+	return r.pool.lifetime(session)
+}
+
+/*
+Returns the remaining lifetime of the session. Returns the SessionNotFound error if the realm of the session is removed.
+*/
+func (s *Security) Lifetime(session *Session) (SessionLifetime, error) {
+	realm, err := s.realmFor(session.ID)
+	if err != nil {
+		return SessionLifetime{}, err
+	}
+	return realm.Lifetime(session), nil
+}
+
+/*
+Finds the session of the context without refreshing it.
+The limited lookup takes the authenticate rate limits of the realm like Security.Authenticate does.
+*/
+func (s *Security) lookup(ctx interface{}, limited bool) (*Realm, SessionIdentifier, *Session, error) {
+	if s.configuration.AuthenticationFilter == nil {
+		return nil, SessionIdentifier{}, nil, errors.New(AuthenticationFilterNotImplemented)
+	}
+	identifier := s.configuration.AuthenticationFilter(ctx)
+	realm, err := s.realmFor(identifier)
+	if err != nil {
+		return nil, identifier, nil, err
+	}
+	identifier.RemoteAddress = realm.resolveAddress(ctx, identifier.RemoteAddress)
+	if limited {
+		if err = realm.limitAuthentication(NormalizeAddress(identifier.RemoteAddress)); err != nil {
+			return realm, identifier, nil, err
+		}
+	}
+	session, err := realm.pool.lookupSession(background(), identifier, "")
+	if err == nil && limited {
+		err = realm.limitPrincipal(session)
+	}
+	if err != nil {
+		return realm, identifier, nil, err
+	}
+	return realm, identifier, session, nil
+}
+
+/*
+The channels notified of the end of the sessions by SID.
+*/
+type sessionWatchers struct {
+	lock     sync.Mutex
+	channels map[string]map[chan string]struct{}
+}
+
+/*
+Returns the channel receiving the reason of the end of the session and the function releasing it.
+*/
+func (w *sessionWatchers) watch(sid string) (chan string, func()) {
+	channel := make(chan string, 1)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.channels == nil {
+		w.channels = map[string]map[chan string]struct{}{}
+	}
+	if w.channels[sid] == nil {
+		w.channels[sid] = map[chan string]struct{}{}
+	}
+	w.channels[sid][channel] = struct{}{}
+	return channel, func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.channels[sid], channel)
+		if len(w.channels[sid]) == 0 {
+			delete(w.channels, sid)
+		}
+	}
+}
+
+func (w *sessionWatchers) ended(sid string, reason string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for channel := range w.channels[sid] {
+		select {
+		case channel <- reason:
+		default:
+		}
+	}
+}
+
+/*
+Writes the error of an authentication of KeepaliveHandler and SessionEventsHandler.
+*/
+func writeAuthenticationError(writer http.ResponseWriter, err error) {
+	limited := &RateLimitedError{}
+	switch {
+	case errors.As(err, &limited):
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+		writeError(writer, http.StatusTooManyRequests, err.Error())
+	case err.Error() == StepUpRequired:
+		writeError(writer, http.StatusForbidden, err.Error())
+	default:
+		writeError(writer, http.StatusUnauthorized, err.Error())
+	}
+}
+
+/*
+http.Handler refreshing the session of the request, answering POST requests with its SessionLifetime.
+The request is authenticated by Security.Authenticate with the request as the context.
+*/
+type KeepaliveHandler struct {
+	security *Security
+}
+
+/*
+Creates the keepalive handler of the sessions of the security.
+*/
+func NewKeepaliveHandler(security *Security) *KeepaliveHandler {
+	return &KeepaliveHandler{security: security}
+}
+
+func (h *KeepaliveHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Cache-Control", "no-store")
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writeError(writer, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	session, err := h.security.Authenticate(request)
+	if err != nil {
+		writeAuthenticationError(writer, err)
+		return
+	}
+	lifetime, err := h.security.Lifetime(session)
+	if err != nil {
+		writeAuthenticationError(writer, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, lifetime)
+}
+
+/*
+The interval of the comments keeping the idle event streams open.
+*/
+const sessionEventsHeartbeat = 30 * time.Second
+
+/*
+The interval of the checks of the session when the realm has no revocation bus.
+*/
+const sessionEventsPoll = 5 * time.Second
+
+/*
+The delay after the expected end of the session before it is checked, so the session is surely expired.
+*/
+const sessionEventsGrace = 10 * time.Millisecond
+
+/*
+http.Handler of the server-sent events of the session of the request. The stream does not refresh the session.
+
+	event: lifetime   the SessionLifetime, on connect and whenever the session is refreshed
+	event: warning    the SessionLifetime, once the idle time left is within the warning
+	event: ended      {"reason": ...}, when the session ends, then the stream is closed
+
+The session is found by the AuthenticationFilter with the request as the context,
+the connection takes the authenticate rate limits of the realm.
+The end of the session on this instance, or on another one announced by the Configuration.RevocationBus,
+is sent immediately. Without a bus the session is checked in the store every 5 seconds,
+so the end of the session on another instance is sent within that interval.
+*/
+type SessionEventsHandler struct {
+	security *Security
+	warning  time.Duration
+}
+
+/*
+Creates the handler warning the warning duration before the idle timeout.
+*/
+func NewSessionEventsHandler(security *Security, warning time.Duration) *SessionEventsHandler {
+	return &SessionEventsHandler{security: security, warning: warning}
+}
+
+type sessionEnded struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeEvent(writer http.ResponseWriter, event string, value interface{}) {
+	data, _ := json.Marshal(value)
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event, data)
+}
+
+func (h *SessionEventsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, http.StatusInternalServerError, "StreamingUnsupported")
+		return
+	}
+	realm, identifier, session, err := h.security.lookup(request, true)
+	if err != nil {
+		writeAuthenticationError(writer, err)
+		return
+	}
+	ended, release := realm.pool.watchers.watch(session.ID.SID)
+	defer release()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	lifetime := realm.Lifetime(session)
+	writeEvent(writer, "lifetime", lifetime)
+	flusher.Flush()
+
+	heartbeat := sessionEventsHeartbeat
+	if realm.pool.configuration.RevocationBus == nil {
+		heartbeat = sessionEventsPoll
+	}
+	warned := false
+	timer := time.NewTimer(heartbeat)
+	defer timer.Stop()
+	for {
+		wait := heartbeat
+		if until := time.Until(lifetime.Expires) + sessionEventsGrace; until < wait {
+			wait = until
+		}
+		if until := lifetime.Idle - h.warning; lifetime.IdleTimeout && !warned && until < wait {
+			wait = until
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(positive(wait))
+
+		select {
+		case <-request.Context().Done():
+			return
+		case reason := <-ended:
+			writeEvent(writer, "ended", sessionEnded{Reason: reason})
+			flusher.Flush()
+			return
+		case <-timer.C:
+		}
+
+		session, err = realm.pool.lookupSession(request.Context(), identifier, "")
+		if err != nil {
+			event := sessionEnded{Error: err.Error()}
+			select {
+			case event.Reason = <-ended:
+			default:
+				if err.Error() == SessionNotFound {
+					event.Reason = ReasonRevoked
+				}
+			}
+			writeEvent(writer, "ended", event)
+			flusher.Flush()
+			return
+		}
+		next := realm.Lifetime(session)
+		switch {
+		case next.Expires.After(lifetime.Expires):
+			warned = false
+			writeEvent(writer, "lifetime", next)
+		case next.IdleTimeout && !warned && next.Idle <= h.warning:
+			warned = true
+			writeEvent(writer, "warning", next)
+		default:
+			fmt.Fprint(writer, ": heartbeat\n\n")
+		}
+		lifetime = next
+		flusher.Flush()
+	}
+}
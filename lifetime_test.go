@@ -0,0 +1,196 @@
+package porter
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLifetimeSecurity(timeout time.Duration) *Security {
+	return CreateNew(lifetimeConfiguration(timeout))
+}
+
+func lifetimeConfiguration(timeout time.Duration) *Configuration {
+	return testConfiguration(nil, func(configuration *Configuration) {
+		configuration.AuthenticationFilter = requestIdentifier
+		configuration.Timeout = timeout
+	})
+}
+
+func sessionRequest(method string, target string, session *Session) *http.Request {
+	request, _ := http.NewRequest(method, target, nil)
+	request.Header.Set("X-SID", session.ID.SID)
+	request.Header.Set("X-SSID", session.ID.SSID)
+	return request
+}
+
+func TestSessionLifetime(t *testing.T) {
+	security := newLifetimeSecurity(5 * time.Second)
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	lifetime, err := security.Lifetime(session)
+	check(err, t)
+	if !lifetime.IdleTimeout || lifetime.Idle <= 4*time.Second || lifetime.Idle > 5*time.Second ||
+		lifetime.Absolute <= 9*time.Second || time.Until(lifetime.Expires) > 5*time.Second {
+		t.Errorf("Unexpected lifetime %+v", lifetime)
+	}
+
+	saved, err := security.Login(deviceLogin{ap{true, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	if lifetime, _ = security.Lifetime(saved); lifetime.IdleTimeout || lifetime.Idle != 0 || !lifetime.Expires.Equal(saved.expirationTime) {
+		t.Errorf("Unexpected lifetime %+v", lifetime)
+	}
+}
+
+func TestKeepaliveHandler(t *testing.T) {
+	security := newLifetimeSecurity(5 * time.Second)
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	handler := NewKeepaliveHandler(security)
+	refreshed := session.lastRefresh()
+	time.Sleep(10 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, sessionRequest(http.MethodPost, "/keepalive", session))
+	response := struct {
+		IdleTimeout bool    `json:"idle_timeout"`
+		Idle        float64 `json:"idle_seconds"`
+	}{}
+	check(json.Unmarshal(recorder.Body.Bytes(), &response), t)
+	if recorder.Code != http.StatusOK || !response.IdleTimeout || response.Idle < 4.9 || !session.lastRefresh().After(refreshed) {
+		t.Errorf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, sessionRequest(http.MethodGet, "/keepalive", session))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status %d", recorder.Code)
+	}
+	security.EndSession(session)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, sessionRequest(http.MethodPost, "/keepalive", session))
+	if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), SessionNotFound) {
+		t.Errorf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+type serverEvent struct {
+	name string
+	data string
+}
+
+func readEvents(t *testing.T, server *httptest.Server, session *Session) <-chan serverEvent {
+	response, err := http.DefaultClient.Do(sessionRequest(http.MethodGet, server.URL, session))
+	check(err, t)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d", response.StatusCode)
+	}
+	events := make(chan serverEvent, 16)
+	go func() {
+		defer close(events)
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		event := serverEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event.name != "":
+				events <- event
+				event = serverEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan serverEvent) serverEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("No event")
+	}
+	return serverEvent{}
+}
+
+func TestSessionEventsWarning(t *testing.T) {
+	security := newLifetimeSecurity(300 * time.Millisecond)
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	server := httptest.NewServer(NewSessionEventsHandler(security, 200*time.Millisecond))
+	defer server.Close()
+
+	events := readEvents(t, server, session)
+	if event := nextEvent(t, events); event.name != "lifetime" || !strings.Contains(event.data, `"idle_timeout":true`) {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if event := nextEvent(t, events); event.name != "warning" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	_, err = security.Authenticate(sessionRequest(http.MethodPost, "/", session))
+	check(err, t)
+	if event := nextEvent(t, events); event.name != "lifetime" {
+		t.Fatalf("Refresh is not signalled: %+v", event)
+	}
+	if event := nextEvent(t, events); event.name != "warning" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if event := nextEvent(t, events); event.name != "ended" || event.data != `{"reason":"timeout","error":"SessionExpired"}` {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Stream is not closed")
+	}
+}
+
+func TestSessionEventsRevocation(t *testing.T) {
+	security := newLifetimeSecurity(5 * time.Second)
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	server := httptest.NewServer(NewSessionEventsHandler(security, time.Second))
+	defer server.Close()
+
+	events := readEvents(t, server, session)
+	if event := nextEvent(t, events); event.name != "lifetime" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	started := time.Now()
+	realm, err := security.Realm(DefaultRealm)
+	check(err, t)
+	check(realm.RevokeSession(session.ID.SID), t)
+	if event := nextEvent(t, events); event.name != "ended" || event.data != `{"reason":"revoked"}` || time.Since(started) > time.Second {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	response, err := http.DefaultClient.Do(sessionRequest(http.MethodGet, server.URL, session))
+	check(err, t)
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %d", response.StatusCode)
+	}
+}
+
+func TestSessionEventsRateLimits(t *testing.T) {
+	configuration := lifetimeConfiguration(5 * time.Second)
+	configuration.RateLimits = &RateLimits{AuthenticatePerAddress: PerInterval(2, time.Minute)}
+	security := CreateNew(configuration)
+	handler := NewSessionEventsHandler(security, time.Second)
+	probe := &Session{ID: SessionIdentifier{SID: "guess", SSID: "guess"}}
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		request := sessionRequest(http.MethodGet, "/events", probe)
+		request.RemoteAddr = "198.51.100.1:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("Unexpected status %d of probe %d", recorder.Code, i)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package porter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+Structured leveled logger. Arguments are alternating keys and values.
+
+The method set matches *slog.Logger, so a *slog.Logger can be used directly.
+Porter logs the fields principal_id, remote_addr, session_fp (see: SessionFingerprint), reason and error.
+*/
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, args ...interface{}) {}
+func (discardLogger) Info(msg string, args ...interface{})  {}
+func (discardLogger) Warn(msg string, args ...interface{})  {}
+func (discardLogger) Error(msg string, args ...interface{}) {}
+
+/*
+Logger writing the messages to a standard logger as "LEVEL message key=value ...".
+*/
+type stdLogger struct {
+	logger *log.Logger
+}
+
+/*
+Adapts a standard logger to Logger.
+*/
+func NewLogLogger(logger *log.Logger) Logger {
+	return stdLogger{logger}
+}
+
+func (l stdLogger) print(level string, msg string, args []interface{}) {
+	line := strings.Builder{}
+	line.WriteString(level)
+	line.WriteByte(' ')
+	line.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		line.WriteByte(' ')
+		if i+1 == len(args) {
+			fmt.Fprintf(&line, "!BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&line, "%v=%v", args[i], args[i+1])
+	}
+	l.logger.Print(line.String())
+}
+
+func (l stdLogger) Debug(msg string, args ...interface{}) {
+	l.print("DEBUG", msg, args)
+}
+
+func (l stdLogger) Info(msg string, args ...interface{}) {
+	l.print("INFO", msg, args)
+}
+
+func (l stdLogger) Warn(msg string, args ...interface{}) {
+	l.print("WARN", msg, args)
+}
+
+func (l stdLogger) Error(msg string, args ...interface{}) {
+	l.print("ERROR", msg, args)
+}
+
+/*
+Returns the configured logger, a logger discarding all messages if it is not set.
+*/
+func (c *sessionConfiguration) logger() Logger {
+	if c.Logger == nil {
+		return discardLogger{}
+	}
+	return c.Logger
+}
+
+/*
+Returns a short stable fingerprint of the session identifier, safe to log instead of the SID.
+*/
+func SessionFingerprint(identifier SessionIdentifier) string {
+	sum := sha256.Sum256([]byte(identifier.Realm + "\x00" + identifier.SID))
+	return hex.EncodeToString(sum[:8])
+}
+
+/*
+Returns the log fields of the session followed by the arguments.
+*/
+func sessionFields(session *Session, args ...interface{}) []interface{} {
+	return append([]interface{}{
+		"principal_id", session.Principal.ID(),
+		"remote_addr", session.ID.RemoteAddress,
+		"session_fp", SessionFingerprint(session.ID),
+	}, args...)
+}
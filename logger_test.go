@@ -0,0 +1,99 @@
+package porter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) record(level string, msg string, args []interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (r *recordingLogger) Debug(msg string, args ...interface{}) {
+	r.record("DEBUG", msg, args)
+}
+
+func (r *recordingLogger) Info(msg string, args ...interface{}) {
+	r.record("INFO", msg, args)
+}
+
+func (r *recordingLogger) Warn(msg string, args ...interface{}) {
+	r.record("WARN", msg, args)
+}
+
+func (r *recordingLogger) Error(msg string, args ...interface{}) {
+	r.record("ERROR", msg, args)
+}
+
+func TestLogger_Fields(t *testing.T) {
+	logger := &recordingLogger{}
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             logger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            20 * time.Millisecond,
+		MultiLogin:         AllowNew,
+	})
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	time.Sleep(30 * time.Millisecond)
+	if _, err = pool.getSession(session.ID); err == nil {
+		t.Fatal("Session is not expired")
+	}
+	if pool.stopSession(session.ID) == nil {
+		t.Error("Removed session stopped")
+	}
+
+	expected := []string{
+		"INFO Session started [principal_id " + fileStorePrincipal.ID() + " remote_addr remote1 session_fp " + SessionFingerprint(session.ID) + "]",
+		"INFO Session expired [principal_id " + fileStorePrincipal.ID() + " remote_addr remote1 session_fp " + SessionFingerprint(session.ID) + " reason timeout]",
+		"INFO Session removed [principal_id " + fileStorePrincipal.ID() + " remote_addr remote1 session_fp " + SessionFingerprint(session.ID) + " reason timeout]",
+		"DEBUG Session not found [remote_addr remote1 session_fp " + SessionFingerprint(session.ID) + "]",
+	}
+	if len(logger.lines) != len(expected) {
+		t.Fatalf("Unexpected log %v", logger.lines)
+	}
+	for i, line := range logger.lines {
+		if line != expected[i] {
+			t.Errorf("Unexpected line %s, expected %s", line, expected[i])
+		}
+		if strings.Contains(line, session.ID.SID) || strings.Contains(line, session.ID.SSID) {
+			t.Errorf("Identifier leaked: %s", line)
+		}
+	}
+}
+
+func TestLogger_Silent(t *testing.T) {
+	pool := newSessionPool(&sessionConfiguration{
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            time.Millisecond,
+		MultiLogin:         AllowNew,
+	})
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	time.Sleep(2 * time.Millisecond)
+	if _, err = pool.getSession(session.ID); err == nil || err.Error() != SessionExpired {
+		t.Error("Session is not expired")
+	}
+}
+
+func TestNewLogLogger(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := NewLogLogger(log.New(buffer, "", 0))
+	logger.Warn("Refresh failed", "principal_id", "user", "error", "timeout", "dangling")
+	if line := buffer.String(); line != "WARN Refresh failed principal_id=user error=timeout !BADKEY=dangling\n" {
+		t.Errorf("Unexpected line %q", line)
+	}
+}
@@ -0,0 +1,167 @@
+package porter
+
+import (
+	"errors"
+)
+
+/*
+The default SessionStore keeping sessions in lock-striped in-memory shards.
+
+Sessions are split into shards by the SID hash,
+the per principal index is split by the principal ID hash.
+Lock order: principal shard, then session shard.
+*/
+type MemoryStore struct {
+	shards     []*sessionShard
+	principals []*principalShard
+}
+
+/*
+Creates an in-memory store with the number of shards. Zero means the default number.
+*/
+func NewMemoryStore(shards int) *MemoryStore {
+	count := shardCount(shards)
+	return &MemoryStore{
+		shards:     newSessionShards(count),
+		principals: newPrincipalShards(count),
+	}
+}
+
+func (ms *MemoryStore) sessionShard(sid string) *sessionShard {
+	return ms.shards[shardHash(sid)%uint32(len(ms.shards))]
+}
+
+func (ms *MemoryStore) principalShard(principalId string) *principalShard {
+	return ms.principals[shardHash(principalId)%uint32(len(ms.principals))]
+}
+
+func (ms *MemoryStore) Save(session *Session) error {
+	principals := ms.principalShard(session.Principal.ID())
+	principals.lock.Lock()
+	defer principals.lock.Unlock()
+
+	principals.add(principalKey{session.ID.Realm, session.Principal.ID()}, session)
+	shard := ms.sessionShard(session.ID.SID)
+	shard.lock.Lock()
+	shard.sessions[session.ID.SID] = session
+	shard.lock.Unlock()
+	return nil
+}
+
+func (ms *MemoryStore) Get(identifier SessionIdentifier) (*Session, error) {
+	shard := ms.sessionShard(identifier.SID)
+	shard.lock.RLock()
+	session, ok := shard.sessions[identifier.SID]
+	shard.lock.RUnlock()
+	if !ok || session.ID.Realm != identifier.Realm {
+		return nil, errors.New(SessionNotFound)
+	}
+	return session, nil
+}
+
+/*
+Sessions are kept by reference, so the refresh time is always up to date.
+*/
+func (ms *MemoryStore) Touch(sessions []*Session) error {
+	for _, session := range sessions {
+		session.stored(session.lastRefresh())
+	}
+	return nil
+}
+
+/*
+Sessions are kept by reference, so the attributes are always up to date.
+*/
+func (ms *MemoryStore) SaveAttributes(session *Session) error {
+	return nil
+}
+
+func (ms *MemoryStore) Remove(session *Session) (bool, error) {
+	principals := ms.principalShard(session.Principal.ID())
+	principals.lock.Lock()
+	defer principals.lock.Unlock()
+
+	shard := ms.sessionShard(session.ID.SID)
+	shard.lock.Lock()
+	existing, ok := shard.sessions[session.ID.SID]
+	if ok && existing.ID.Realm == session.ID.Realm {
+		delete(shard.sessions, session.ID.SID)
+	} else {
+		ok = false
+	}
+	shard.lock.Unlock()
+	if ok {
+		principals.remove(principalKey{session.ID.Realm, session.Principal.ID()}, session.ID.SID)
+	}
+	return ok, nil
+}
+
+func (ms *MemoryStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	principals := ms.principalShard(principalId)
+	principals.lock.RLock()
+	defer principals.lock.RUnlock()
+
+	return principals.list(principalKey{realm, principalId}), nil
+}
+
+/*
+Iterates over the shards one by one. Sessions added or removed during the iteration may be missed.
+*/
+func (ms *MemoryStore) Range(fn func(session *Session) bool) error {
+	for _, shard := range ms.shards {
+		shard.lock.RLock()
+		sessions := make([]*Session, 0, len(shard.sessions))
+		for _, session := range shard.sessions {
+			sessions = append(sessions, session)
+		}
+		shard.lock.RUnlock()
+		for _, session := range sessions {
+			if !fn(session) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Scans the shards under the read locks without copying them.
+Queries by the principal ID use the per principal index.
+*/
+func (ms *MemoryStore) Query(realm string, query SessionQuery) (*SessionPage, error) {
+	matcher, err := compileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	page := newPageCollector(matcher)
+	if query.PrincipalID != "" {
+		sessions, _ := ms.ByPrincipal(realm, query.PrincipalID)
+		for _, session := range sessions {
+			page.offer(session)
+		}
+		return page.page(), nil
+	}
+	for _, shard := range ms.shards {
+		shard.lock.RLock()
+		for _, session := range shard.sessions {
+			if session.ID.Realm == realm {
+				page.offer(session)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	return page.page(), nil
+}
+
+/*
+Returns the number of stored sessions.
+*/
+func (ms *MemoryStore) Len() int {
+	count := 0
+	for _, shard := range ms.shards {
+		shard.lock.RLock()
+		count += len(shard.sessions)
+		shard.lock.RUnlock()
+	}
+	return count
+}
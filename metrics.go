@@ -0,0 +1,210 @@
+package porter
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+The upper bounds of the buckets of the sessions per principal histogram.
+*/
+var sessionsPerPrincipalBuckets = []int{1, 2, 3, 5, 10, 20, 50}
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+EventListener maintaining session metrics, exposed as an http.Handler in the Prometheus text format.
+
+Gauges are computed from the sessions started, restored and ended by this instance,
+so sessions started by other instances sharing the store are not counted.
+Add the metrics to Configuration.Listeners of every instance and sum the gauges over the instances.
+Sessions expiring without a later lookup are ended, and so counted, by the sweep only, see: Configuration.SweepInterval
+*/
+type Metrics struct {
+	lock   sync.Mutex
+	realms map[string]*realmMetrics
+}
+
+type realmMetrics struct {
+	logins     uint64
+	failures   map[string]uint64
+	ended      map[string]uint64
+	principals map[string]int
+	active     int
+}
+
+/*
+Creates the metrics with names prefixed by "porter_".
+*/
+func NewMetrics() *Metrics {
+	return &Metrics{realms: map[string]*realmMetrics{}}
+}
+
+func (m *Metrics) realm(name string) *realmMetrics {
+	realm, ok := m.realms[name]
+	if !ok {
+		realm = &realmMetrics{
+			failures:   map[string]uint64{},
+			ended:      map[string]uint64{},
+			principals: map[string]int{},
+		}
+		m.realms[name] = realm
+	}
+	return realm
+}
+
+func (m *Metrics) OnEvent(event Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	realm := m.realm(event.Realm)
+	switch event.Kind {
+	case EventLogin:
+		realm.logins++
+		realm.active++
+		realm.principals[event.PrincipalID]++
+	case EventSessionRestored:
+		realm.active++
+		realm.principals[event.PrincipalID]++
+	case EventLoginFailed:
+		realm.failures[event.Reason]++
+	case EventSessionEnded:
+		realm.ended[event.Reason]++
+		if realm.active > 0 {
+			realm.active--
+		}
+		if count := realm.principals[event.PrincipalID]; count > 1 {
+			realm.principals[event.PrincipalID] = count - 1
+		} else {
+			delete(realm.principals, event.PrincipalID)
+		}
+	}
+}
+
+/*
+Writes the metrics in the Prometheus text exposition format.
+*/
+func (m *Metrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", metricsContentType)
+	buffered := bufio.NewWriter(writer)
+	m.write(buffered)
+	buffered.Flush()
+}
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name string, kind string, help string) {
+	w.WriteString("# HELP porter_" + name + " " + help + "\n")
+	w.WriteString("# TYPE porter_" + name + " " + kind + "\n")
+}
+
+func (w metricsWriter) sample(name string, labels []string, value string) {
+	w.WriteString("porter_" + name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + value + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatCount(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
+
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Metrics) write(buffered *bufio.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	w := metricsWriter{buffered}
+	names := make([]string, 0, len(m.realms))
+	for name := range m.realms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.header("active_sessions", "gauge", "Sessions started and not ended.")
+	for _, name := range names {
+		w.sample("active_sessions", []string{"realm", name}, strconv.Itoa(m.realms[name].active))
+	}
+
+	w.header("logins_total", "counter", "Started sessions.")
+	for _, name := range names {
+		w.sample("logins_total", []string{"realm", name}, formatCount(m.realms[name].logins))
+	}
+
+	w.header("login_failures_total", "counter", "Rejected logins by reason.")
+	for _, name := range names {
+		failures := m.realms[name].failures
+		for _, reason := range sortedKeys(failures) {
+			w.sample("login_failures_total", []string{"realm", name, "reason", reason}, formatCount(failures[reason]))
+		}
+	}
+
+	w.header("logouts_total", "counter", "Sessions ended by logout.")
+	for _, name := range names {
+		w.sample("logouts_total", []string{"realm", name}, formatCount(m.realms[name].ended[ReasonLogout]))
+	}
+
+	w.header("expirations_total", "counter", "Expired sessions by reason.")
+	for _, name := range names {
+		for _, reason := range []string{ReasonTimeout, ReasonAbsolute} {
+			w.sample("expirations_total", []string{"realm", name, "reason", reason}, formatCount(m.realms[name].ended[reason]))
+		}
+	}
+
+	w.header("multi_login_evictions_total", "counter", "Sessions closed by new logins of the principal by reason.")
+	for _, name := range names {
+		for _, reason := range []string{ReasonMultiLogin, ReasonMaxSessions} {
+			w.sample("multi_login_evictions_total", []string{"realm", name, "reason", reason}, formatCount(m.realms[name].ended[reason]))
+		}
+	}
+
+	w.header("sessions_per_principal", "histogram", "Active sessions per principal with sessions.")
+	for _, name := range names {
+		realm := m.realms[name]
+		buckets := make([]uint64, len(sessionsPerPrincipalBuckets))
+		sum := 0
+		for _, count := range realm.principals {
+			sum += count
+			for i, bound := range sessionsPerPrincipalBuckets {
+				if count <= bound {
+					buckets[i]++
+				}
+			}
+		}
+		for i, bound := range sessionsPerPrincipalBuckets {
+			w.sample("sessions_per_principal_bucket", []string{"realm", name, "le", strconv.Itoa(bound)}, formatCount(buckets[i]))
+		}
+		total := strconv.Itoa(len(realm.principals))
+		w.sample("sessions_per_principal_bucket", []string{"realm", name, "le", "+Inf"}, total)
+		w.sample("sessions_per_principal_sum", []string{"realm", name}, strconv.Itoa(sum))
+		w.sample("sessions_per_principal_count", []string{"realm", name}, total)
+	}
+}
@@ -0,0 +1,135 @@
+package porter
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	events := []Event{}
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		LoginFilter: func(context interface{}) (AuthenticationPrincipal, string, error) {
+			return nil, "remote1", errors.New("wrong password")
+		},
+		AuthenticationFilter: func(context interface{}) SessionIdentifier {
+			return context.(SessionIdentifier)
+		},
+		Logger:         testingLogger,
+		ExpirationTime: 10 * time.Second,
+		Timeout:        50 * time.Millisecond,
+		MultiLogin:     AllowNew,
+		MaxSessions:    2,
+		Listeners: []EventListener{metrics, EventListenerFunc(func(event Event) {
+			events = append(events, event)
+		})},
+	})
+	realm := security.defaultRealm
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	short := func(defaults SessionPolicy) SessionPolicy {
+		defaults.ExpirationTime = time.Millisecond
+		return defaults
+	}
+
+	if _, err := security.Login(nil); err == nil {
+		t.Fatal("Login filter error is ignored")
+	}
+	if _, err := realm.login(background(), nil, ap{false, false, true}, "remote1"); err == nil {
+		t.Fatal("Principal not allowed to login logged in")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := realm.login(background(), nil, pp{ap{false, true, true}, "evicted", policy}, "remote1")
+		check(err, t)
+	}
+	loggedOut, err := realm.login(background(), nil, pp{ap{false, true, true}, "logout", policy}, "remote1")
+	check(err, t)
+	security.EndSession(loggedOut)
+	timedOut, err := realm.login(background(), nil, pp{ap{false, true, true}, "timeout", policy}, "remote1")
+	check(err, t)
+	expired, err := realm.login(background(), nil, pp{ap{true, true, true}, "absolute", short}, "remote1")
+	check(err, t)
+	time.Sleep(60 * time.Millisecond)
+	for _, session := range []*Session{timedOut, expired} {
+		if _, err = security.Authenticate(session.ID); err == nil || err.Error() != SessionExpired {
+			t.Error("Session is not expired")
+		}
+	}
+
+	last := events[len(events)-1]
+	if last.Kind != EventSessionEnded || last.Reason != ReasonAbsolute || last.PrincipalID != "absolute" || last.Session != expired {
+		t.Errorf("Unexpected event %+v", last)
+	}
+	if events[0].Kind != EventLoginFailed || events[0].Err == nil || events[0].RemoteAddress != "remote1" {
+		t.Errorf("Unexpected event %+v", events[0])
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("Unexpected content type")
+	}
+	for _, line := range []string{
+		`porter_active_sessions{realm=""} 2`,
+		`porter_logins_total{realm=""} 6`,
+		`porter_login_failures_total{realm="",reason="cannot_login"} 1`,
+		`porter_login_failures_total{realm="",reason="filter"} 1`,
+		`porter_logouts_total{realm=""} 1`,
+		`porter_expirations_total{realm="",reason="timeout"} 1`,
+		`porter_expirations_total{realm="",reason="absolute"} 1`,
+		`porter_multi_login_evictions_total{realm="",reason="max_sessions"} 1`,
+		`porter_multi_login_evictions_total{realm="",reason="multi_login"} 0`,
+		`porter_sessions_per_principal_bucket{realm="",le="1"} 0`,
+		`porter_sessions_per_principal_bucket{realm="",le="2"} 1`,
+		`porter_sessions_per_principal_bucket{realm="",le="+Inf"} 1`,
+		`porter_sessions_per_principal_sum{realm=""} 2`,
+		`# TYPE porter_sessions_per_principal histogram`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Missing line %s in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_EscapeLabel(t *testing.T) {
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Errorf("Unexpected escaping %s", escaped)
+	}
+}
+
+func TestMetricsSweep(t *testing.T) {
+	metrics := NewMetrics()
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		Logger:              testingLogger,
+		ExpirationTime:      10 * time.Second,
+		Timeout:             30 * time.Millisecond,
+		MultiLogin:          AllowNew,
+		SweepInterval:       10 * time.Millisecond,
+		Listeners:           []EventListener{metrics},
+	})
+	defer security.Close()
+	_, err := security.defaultRealm.login(background(), nil, ap{false, true, true}, "remote1")
+	check(err, t)
+
+	read := func() string {
+		recorder := httptest.NewRecorder()
+		metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return recorder.Body.String()
+	}
+	if !strings.Contains(read(), `porter_active_sessions{realm=""} 1`) {
+		t.Fatal("Session is not counted")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if body := read(); !strings.Contains(body, `porter_active_sessions{realm=""} 0`) ||
+		!strings.Contains(body, `porter_expirations_total{realm="",reason="timeout"} 1`) {
+		t.Errorf("Expired session is not swept\n%s", body)
+	}
+}
@@ -0,0 +1,252 @@
+package porter
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Allow and deny lists of networks for logins and authentications.
+
+An address is allowed if it belongs to no denied network and, when the allow list is not empty,
+to an allowed network. Addresses that are not IP addresses belong to no network.
+The lists may be replaced at any time, see: NetworkPolicy.Update and OpenNetworkPolicy.
+*/
+type NetworkPolicy struct {
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	path     string
+	modified time.Time
+	size     int64
+	err      error
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+/*
+Optional interface of AuthenticationPrincipal restricting the networks of the principal,
+in addition to Configuration.NetworkPolicy. Nil applies the configuration policy only.
+*/
+type NetworkPolicyProvider interface {
+	NetworkPolicy() *NetworkPolicy
+}
+
+/*
+Creates the policy of the networks by their addresses or CIDR blocks ("10.0.0.0/8").
+Returns the InvalidAddress error if a network is neither of them.
+*/
+func NewNetworkPolicy(allow []string, deny []string) (*NetworkPolicy, error) {
+	policy := &NetworkPolicy{}
+	if err := policy.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+/*
+Atomically replaces the lists. Keeps the current lists on errors.
+*/
+func (p *NetworkPolicy) Update(allow []string, deny []string) error {
+	allowed, err := parseNetworks(allow)
+	if err != nil {
+		return err
+	}
+	denied, err := parseNetworks(deny)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.allow, p.deny = allowed, denied
+	p.lock.Unlock()
+	return nil
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+/*
+Returns TRUE if the policy allows the address. A nil policy allows all addresses.
+*/
+func (p *NetworkPolicy) Allows(address string) bool {
+	if p == nil {
+		return true
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	ip := parseIP(NormalizeAddress(address))
+	if ip == nil {
+		return len(p.allow) == 0
+	}
+	for _, network := range p.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, network := range p.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Loads the policy from the file and, with a positive interval, reloads it when the file changes.
+
+The file lists one network per line as "allow <network>" or "deny <network>",
+empty lines and lines starting with # are skipped.
+A file failing to load on reload keeps the current lists, see: NetworkPolicy.Err
+*/
+func OpenNetworkPolicy(path string, interval time.Duration) (*NetworkPolicy, error) {
+	policy := &NetworkPolicy{path: path}
+	if err := policy.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		policy.stop = make(chan struct{})
+		policy.done = make(chan struct{})
+		go policy.watch(interval)
+	}
+	return policy, nil
+}
+
+/*
+Loads the file if it is modified since the last load.
+*/
+func (p *NetworkPolicy) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.lock.RLock()
+	unchanged := info.ModTime().Equal(p.modified) && info.Size() == p.size
+	p.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	file, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	allow, deny, err := readNetworkPolicy(file)
+	if err != nil {
+		return err
+	}
+	if err = p.Update(allow, deny); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.modified, p.size = info.ModTime(), info.Size()
+	p.lock.Unlock()
+	return nil
+}
+
+func readNetworkPolicy(reader io.Reader) ([]string, []string, error) {
+	allow, deny := []string{}, []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, errors.New(InvalidNetworkPolicy)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return nil, nil, errors.New(InvalidNetworkPolicy)
+		}
+	}
+	return allow, deny, scanner.Err()
+}
+
+func (p *NetworkPolicy) watch(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := p.reload()
+			p.lock.Lock()
+			p.err = err
+			p.lock.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+/*
+Returns the error of the last reload of the file, nil if it succeeded.
+*/
+func (p *NetworkPolicy) Err() error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.err
+}
+
+/*
+Stops reloading the file.
+*/
+func (p *NetworkPolicy) Close() error {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+	return nil
+}
+
+/*
+Returns the AddressNotAllowed error if the configuration policy or the policy of the principal rejects the address.
+*/
+func (c *sessionConfiguration) checkNetwork(principal AuthenticationPrincipal, address string) error {
+	if !c.NetworkPolicy.Allows(address) {
+		return errors.New(AddressNotAllowed)
+	}
+	if provider, ok := principal.(NetworkPolicyProvider); ok && !provider.NetworkPolicy().Allows(address) {
+		return errors.New(AddressNotAllowed)
+	}
+	return nil
+}
+
+/*
+Rejects the authentication from the address not allowed for the principal of the session.
+*/
+func (sp *SessionPool) checkSessionNetwork(session *Session, address string) error {
+	err := sp.configuration.checkNetwork(session.Principal, address)
+	if err != nil {
+		sp.configuration.logger().Warn("Address not allowed", sessionFields(session, "address", address)...)
+		sp.emit(Event{Kind: EventAccessDenied, Session: session, RemoteAddress: NormalizeAddress(address), Reason: ReasonNetwork, Err: err})
+		sp.inspect(Observation{Kind: ObservationAuthenticationFailed, Session: session, RemoteAddress: NormalizeAddress(address), Err: err})
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package porter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNetworkPolicy(t *testing.T) {
+	policy, err := NewNetworkPolicy([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	check(err, t)
+	tests := []struct {
+		address  string
+		expected bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1:4000", true},
+		{"::ffff:10.0.0.1", true},
+		{"[2001:db8::1]:4000", true},
+		{"10.1.2.3", false},
+		{"10.2.3.4", false},
+		{"10.2.3.5", true},
+		{"192.0.2.1", false},
+		{"remote1", false},
+	}
+	for _, test := range tests {
+		if allowed := policy.Allows(test.address); allowed != test.expected {
+			t.Errorf("%s allowed: %t", test.address, allowed)
+		}
+	}
+
+	check(policy.Update(nil, []string{"192.0.2.0/24"}), t)
+	if !policy.Allows("10.1.2.3") || !policy.Allows("remote1") || policy.Allows("192.0.2.1") {
+		t.Error("Policy is not updated")
+	}
+	if err = policy.Update([]string{"10.0.0.0/33"}, nil); err == nil || err.Error() != InvalidAddress {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if policy.Allows("192.0.2.1") {
+		t.Error("Policy is changed by a failed update")
+	}
+	var none *NetworkPolicy
+	if !none.Allows("192.0.2.1") {
+		t.Error("Nil policy denies")
+	}
+}
+
+type officePrincipal struct {
+	ap
+	policy *NetworkPolicy
+}
+
+func (p officePrincipal) NetworkPolicy() *NetworkPolicy {
+	return p.policy
+}
+
+func TestLoginNetworkPolicy(t *testing.T) {
+	events := []Event{}
+	global, err := NewNetworkPolicy(nil, []string{"203.0.113.0/24"})
+	check(err, t)
+	office, err := NewNetworkPolicy([]string{"198.51.100.0/24"}, nil)
+	check(err, t)
+	security := CreateNew(testConfiguration(&events, func(configuration *Configuration) {
+		configuration.NetworkPolicy = global
+	}))
+
+	if _, err = security.Login(deviceLogin{ap{false, true, true}, "203.0.113.1", ""}); err == nil || err.Error() != AddressNotAllowed {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if event := events[len(events)-1]; event.Kind != EventLoginFailed || event.Reason != ReasonNetwork {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	_, err = security.Login(deviceLogin{ap{false, true, true}, "192.0.2.1", ""})
+	check(err, t)
+
+	admin := officePrincipal{ap{false, true, true}, office}
+	if _, err = security.Login(deviceLogin{admin, "192.0.2.1", ""}); err == nil || err.Error() != AddressNotAllowed {
+		t.Errorf("Unexpected error %v", err)
+	}
+	session, err := security.Login(deviceLogin{admin, "198.51.100.1", ""})
+	check(err, t)
+
+	events = nil
+	if _, err = security.Authenticate(from(session.ID, "192.0.2.1")); err == nil || err.Error() != AddressNotAllowed {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != EventAccessDenied || events[0].Reason != ReasonNetwork ||
+		events[0].RemoteAddress != "192.0.2.1" || events[0].Session != session {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if _, err = security.Authenticate(from(session.ID, "198.51.100.7")); err != nil {
+		t.Error("Session is ended by a denied authentication")
+	}
+	check(office.Update([]string{"192.0.2.0/24"}, nil), t)
+	if _, err = security.Authenticate(from(session.ID, "198.51.100.7")); err == nil || err.Error() != AddressNotAllowed {
+		t.Error("Updated policy is not applied to the session")
+	}
+}
+
+func TestProxiedNetworkPolicy(t *testing.T) {
+	resolver, err := NewRemoteAddressResolver(XForwardedFor, "10.0.0.0/8")
+	check(err, t)
+	office, err := NewNetworkPolicy([]string{"198.51.100.0/24"}, nil)
+	check(err, t)
+	security := CreateNew(testConfiguration(nil, func(configuration *Configuration) {
+		configuration.LoginFilter = func(context interface{}) (AuthenticationPrincipal, string, error) {
+			return ap{false, true, true}, "", nil
+		}
+		configuration.AuthenticationFilter = requestIdentifier
+		configuration.NetworkPolicy = office
+		configuration.AddressResolver = resolver
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/login", nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	request.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if _, err = security.Login(request); err == nil || err.Error() != AddressNotAllowed {
+		t.Errorf("Unexpected error %v", err)
+	}
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	session, err := security.Login(request)
+	check(err, t)
+
+	request = sessionRequest(http.MethodGet, "/", session)
+	request.RemoteAddr = "10.0.0.1:4000"
+	request.Header.Set("X-Forwarded-For", "198.51.100.2")
+	_, err = security.Authenticate(request)
+	check(err, t)
+	request.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if _, err = security.Authenticate(request); err == nil || err.Error() != AddressNotAllowed {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestOpenNetworkPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "porter")
+	check(err, t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "networks")
+	check(ioutil.WriteFile(path, []byte("# office\nallow 198.51.100.0/24\n\ndeny 198.51.100.13\n"), 0600), t)
+
+	policy, err := OpenNetworkPolicy(path, 10*time.Millisecond)
+	check(err, t)
+	defer policy.Close()
+	if !policy.Allows("198.51.100.1") || policy.Allows("198.51.100.13") || policy.Allows("192.0.2.1") {
+		t.Fatal("Unexpected policy")
+	}
+
+	check(ioutil.WriteFile(path, []byte("permit 192.0.2.0/24\n"), 0600), t)
+	waitFor(t, func() bool { return policy.Err() != nil })
+	if policy.Err().Error() != InvalidNetworkPolicy || !policy.Allows("198.51.100.1") {
+		t.Errorf("Unexpected reload %v", policy.Err())
+	}
+
+	check(ioutil.WriteFile(path, []byte("allow 192.0.2.0/24\n"), 0600), t)
+	waitFor(t, func() bool { return policy.Err() == nil && policy.Allows("192.0.2.1") })
+	if policy.Allows("198.51.100.1") {
+		t.Error("Policy is not reloaded")
+	}
+
+	if _, err = OpenNetworkPolicy(filepath.Join(dir, "missing"), 0); err == nil {
+		t.Error("Missing file is opened")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition is not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
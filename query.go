@@ -0,0 +1,353 @@
+package porter
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+The number of sessions of a page when SessionQuery.Limit is not set.
+*/
+const defaultQueryLimit = 100
+
+type SessionOrder string
+
+const (
+	/*
+		Orders sessions by the start time, the default order.
+	*/
+	OrderByCreated SessionOrder = "created"
+	/*
+		Orders sessions by the last refresh time. The refresh time changes on every authentication,
+		so sessions refreshed while paging may be skipped or returned twice.
+	*/
+	OrderByRefreshed SessionOrder = "refreshed"
+	/*
+		Orders sessions by the principal ID.
+	*/
+	OrderByPrincipal SessionOrder = "principal"
+)
+
+/*
+Filter, order and page of a session query. Zero fields do not filter.
+Sessions with equal order keys are ordered by the SID, so pages never overlap.
+*/
+type SessionQuery struct {
+	/*
+		The exact principal ID.
+	*/
+	PrincipalID string
+	/*
+		The prefix of the principal ID.
+	*/
+	PrincipalPrefix string
+	/*
+		The exact remote address, the host of the address or a CIDR block ("10.0.0.0/8") containing the host.
+	*/
+	RemoteAddress string
+	/*
+		The start time range, exclusive.
+	*/
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	/*
+		The last refresh time range, exclusive.
+	*/
+	RefreshedAfter  time.Time
+	RefreshedBefore time.Time
+	/*
+		The attributes the sessions must have with equal values.
+	*/
+	Attributes map[string]string
+	Order      SessionOrder
+	Descending bool
+	/*
+		The maximum number of sessions of the page, 100 by default.
+	*/
+	Limit int
+	/*
+		The cursor of the page, SessionPage.Next of the previous page. Empty for the first page.
+	*/
+	Cursor string
+}
+
+type SessionPage struct {
+	Sessions []*Session
+	/*
+		The cursor of the next page, empty for the last page.
+	*/
+	Next string
+}
+
+/*
+Position of a page, the order keys of the last session of the previous page.
+*/
+type queryCursor struct {
+	Order SessionOrder `json:"o"`
+	Time  int64        `json:"t,omitempty"`
+	Key   string       `json:"k,omitempty"`
+	SID   string       `json:"s"`
+}
+
+/*
+Order keys of a session.
+*/
+type queryKey struct {
+	time    int64
+	key     string
+	sid     string
+	session *Session
+}
+
+/*
+Compiled SessionQuery.
+*/
+type sessionMatcher struct {
+	query   SessionQuery
+	network *net.IPNet
+	after   *queryKey
+	limit   int
+}
+
+/*
+Returns the page of the sessions of the realm matching the query.
+Stores implementing QueryableStore are queried natively, other stores are scanned by Range.
+Returns the InvalidSessionQuery error if the cursor or the remote address are malformed.
+*/
+func QuerySessions(store SessionStore, realm string, query SessionQuery) (*SessionPage, error) {
+	if queryable, ok := store.(QueryableStore); ok {
+		return queryable.Query(realm, query)
+	}
+	matcher, err := compileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	page := newPageCollector(matcher)
+	err = store.Range(func(session *Session) bool {
+		if session.ID.Realm == realm {
+			page.offer(session)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.page(), nil
+}
+
+func compileQuery(query SessionQuery) (*sessionMatcher, error) {
+	matcher := &sessionMatcher{query: query, limit: query.Limit}
+	if matcher.limit <= 0 {
+		matcher.limit = defaultQueryLimit
+	}
+	switch query.Order {
+	case "":
+		matcher.query.Order = OrderByCreated
+	case OrderByCreated, OrderByRefreshed, OrderByPrincipal:
+	default:
+		return nil, errors.New(InvalidSessionQuery)
+	}
+	if strings.Contains(query.RemoteAddress, "/") {
+		_, network, err := net.ParseCIDR(query.RemoteAddress)
+		if err != nil {
+			return nil, errors.New(InvalidSessionQuery)
+		}
+		matcher.network = network
+	}
+	if query.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		cursor := queryCursor{}
+		if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.Order != matcher.query.Order {
+			return nil, errors.New(InvalidSessionQuery)
+		}
+		matcher.after = &queryKey{time: cursor.Time, key: cursor.Key, sid: cursor.SID}
+	}
+	return matcher, nil
+}
+
+func (m *sessionMatcher) matches(session *Session) bool {
+	query := &m.query
+	principalId := session.Principal.ID()
+	if (query.PrincipalID != "" && principalId != query.PrincipalID) ||
+		!strings.HasPrefix(principalId, query.PrincipalPrefix) ||
+		!m.matchesAddress(session.ID.RemoteAddress) ||
+		!inRange(session.startTime, query.CreatedAfter, query.CreatedBefore) {
+		return false
+	}
+	if !query.RefreshedAfter.IsZero() || !query.RefreshedBefore.IsZero() {
+		if !inRange(session.lastRefresh(), query.RefreshedAfter, query.RefreshedBefore) {
+			return false
+		}
+	}
+	for key, expected := range query.Attributes {
+		if value, ok := session.Attribute(key); !ok || value != expected {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Returns FALSE if the loaded record does not match the address or the attributes of the query,
+so the principal of the record need not be resolved.
+*/
+func (m *sessionMatcher) matchesRecord(record *sessionRecord) bool {
+	if !m.matchesAddress(record.RemoteAddress) {
+		return false
+	}
+	for key, expected := range m.query.Attributes {
+		if value, ok := record.Attributes[key]; !ok || value != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *sessionMatcher) matchesAddress(address string) bool {
+	if m.query.RemoteAddress == "" || address == m.query.RemoteAddress {
+		return true
+	}
+	host := NormalizeAddress(address)
+	if m.network == nil {
+		return host == NormalizeAddress(m.query.RemoteAddress)
+	}
+	ip := parseIP(host)
+	return ip != nil && m.network.Contains(ip)
+}
+
+func inRange(t time.Time, after time.Time, before time.Time) bool {
+	return (after.IsZero() || t.After(after)) && (before.IsZero() || t.Before(before))
+}
+
+func (m *sessionMatcher) key(session *Session) queryKey {
+	key := queryKey{sid: session.ID.SID, session: session}
+	switch m.query.Order {
+	case OrderByCreated:
+		key.time = session.startTime.UnixNano()
+	case OrderByRefreshed:
+		key.time = session.lastRefresh().UnixNano()
+	case OrderByPrincipal:
+		key.key = session.Principal.ID()
+	}
+	return key
+}
+
+/*
+Returns TRUE if the key goes after the cursor of the query.
+*/
+func (m *sessionMatcher) afterCursor(key *queryKey) bool {
+	return m.after == nil || m.before(m.after, key)
+}
+
+/*
+Returns the cursor of the page ending with the key.
+*/
+func (m *sessionMatcher) cursor(last queryKey) string {
+	data, _ := json.Marshal(queryCursor{Order: m.query.Order, Time: last.time, Key: last.key, SID: last.sid})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+/*
+Returns TRUE if the key a goes before the key b in the order of the query.
+*/
+func (m *sessionMatcher) before(a *queryKey, b *queryKey) bool {
+	order := 0
+	switch {
+	case a.time != b.time:
+		order = compareOrder(a.time < b.time)
+	case a.key != b.key:
+		order = compareOrder(a.key < b.key)
+	case a.sid != b.sid:
+		order = compareOrder(a.sid < b.sid)
+	}
+	if m.query.Descending {
+		return order > 0
+	}
+	return order < 0
+}
+
+func compareOrder(less bool) int {
+	if less {
+		return -1
+	}
+	return 1
+}
+
+/*
+Collects the first sessions of the page in a bounded heap, so a query needs memory for the page only.
+*/
+type pageCollector struct {
+	matcher *sessionMatcher
+	keys    []queryKey
+}
+
+func newPageCollector(matcher *sessionMatcher) *pageCollector {
+	return &pageCollector{matcher: matcher}
+}
+
+/*
+Adds the session to the page if it matches the query and goes after the cursor.
+*/
+func (pc *pageCollector) offer(session *Session) {
+	if !pc.matcher.matches(session) {
+		return
+	}
+	key := pc.matcher.key(session)
+	if !pc.matcher.afterCursor(&key) {
+		return
+	}
+	// One session more than the limit tells whether there is a next page.
+	if len(pc.keys) <= pc.matcher.limit {
+		heap.Push(pc, key)
+	} else if pc.matcher.before(&key, &pc.keys[0]) {
+		pc.keys[0] = key
+		heap.Fix(pc, 0)
+	}
+}
+
+func (pc *pageCollector) page() *SessionPage {
+	sort.Slice(pc.keys, func(i, j int) bool {
+		return pc.matcher.before(&pc.keys[i], &pc.keys[j])
+	})
+	page := &SessionPage{Sessions: make([]*Session, 0, len(pc.keys))}
+	keys := pc.keys
+	if len(keys) > pc.matcher.limit {
+		keys = keys[:pc.matcher.limit]
+		page.Next = pc.matcher.cursor(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		page.Sessions = append(page.Sessions, key.session)
+	}
+	return page
+}
+
+/*
+heap.Interface keeping the last key of the page on the top.
+*/
+func (pc *pageCollector) Len() int {
+	return len(pc.keys)
+}
+
+func (pc *pageCollector) Less(i, j int) bool {
+	return pc.matcher.before(&pc.keys[j], &pc.keys[i])
+}
+
+func (pc *pageCollector) Swap(i, j int) {
+	pc.keys[i], pc.keys[j] = pc.keys[j], pc.keys[i]
+}
+
+func (pc *pageCollector) Push(x interface{}) {
+	pc.keys = append(pc.keys, x.(queryKey))
+}
+
+func (pc *pageCollector) Pop() interface{} {
+	last := pc.keys[len(pc.keys)-1]
+	pc.keys = pc.keys[:len(pc.keys)-1]
+	return last
+}
@@ -0,0 +1,127 @@
+package porter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/*
+Hides the native query of the store.
+*/
+type rangeOnlyStore struct {
+	SessionStore
+}
+
+/*
+Returns the SIDs of all pages of the query.
+*/
+func queryAll(store SessionStore, query SessionQuery, t *testing.T) []string {
+	sids := []string{}
+	for pages := 0; ; pages++ {
+		page, err := QuerySessions(store, DefaultRealm, query)
+		check(err, t)
+		if len(page.Sessions) > query.Limit || (page.Next != "" && len(page.Sessions) != query.Limit) || pages > 100 {
+			t.Fatalf("Unexpected page of %d sessions", len(page.Sessions))
+		}
+		for _, session := range page.Sessions {
+			sids = append(sids, session.ID.SID)
+		}
+		if page.Next == "" {
+			return sids
+		}
+		query.Cursor = page.Next
+	}
+}
+
+func TestQuerySessions(t *testing.T) {
+	store := NewMemoryStore(4)
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		Logger:              testingLogger,
+		ExpirationTime:      10 * time.Second,
+		Timeout:             5 * time.Second,
+		MultiLogin:          AllowNew,
+		Store:               store,
+	})
+	other, err := security.AddRealm("other", &Configuration{
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     AllowNew,
+		Store:          store,
+	})
+	check(err, t)
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	var middle time.Time
+	for i := 0; i < 90; i++ {
+		principal := pp{ap{false, true, true}, fmt.Sprintf("user%d", i%30), policy}
+		session, err := security.defaultRealm.login(background(), nil, principal, fmt.Sprintf("10.0.%d.%d:4000", i%2, i))
+		check(err, t)
+		if i%3 == 0 {
+			session.SetAttribute("role", "admin")
+		}
+		if i == 45 {
+			middle = session.startTime
+		}
+		_, err = other.login(background(), nil, principal, "10.0.0.1:4000")
+		check(err, t)
+	}
+
+	queries := map[string]struct {
+		query    SessionQuery
+		expected int
+	}{
+		"all":        {SessionQuery{Limit: 7}, 90},
+		"principal":  {SessionQuery{PrincipalID: "user1", Limit: 2}, 3},
+		"prefix":     {SessionQuery{PrincipalPrefix: "user2", Order: OrderByPrincipal, Limit: 4}, 33},
+		"cidr":       {SessionQuery{RemoteAddress: "10.0.1.0/24", Order: OrderByRefreshed, Limit: 10}, 45},
+		"host":       {SessionQuery{RemoteAddress: "10.0.0.2", Limit: 10}, 1},
+		"address":    {SessionQuery{RemoteAddress: "10.0.0.2:4000", Limit: 10}, 1},
+		"attributes": {SessionQuery{Attributes: map[string]string{"role": "admin"}, Descending: true, Limit: 8}, 30},
+		"created":    {SessionQuery{CreatedAfter: middle, Order: OrderByPrincipal, Descending: true, Limit: 9}, 44},
+		"refreshed":  {SessionQuery{RefreshedBefore: middle, Limit: 100}, 45},
+	}
+	for name, test := range queries {
+		native := queryAll(store, test.query, t)
+		scanned := queryAll(rangeOnlyStore{store}, test.query, t)
+		if len(native) != test.expected || len(scanned) != test.expected {
+			t.Errorf("Query %s returned %d and %d sessions, expected %d", name, len(native), len(scanned), test.expected)
+			continue
+		}
+		unique := map[string]bool{}
+		for i := range native {
+			if native[i] != scanned[i] {
+				t.Errorf("Query %s returned different orders", name)
+				break
+			}
+			unique[native[i]] = true
+		}
+		if len(unique) != test.expected {
+			t.Errorf("Query %s returned duplicates", name)
+		}
+	}
+
+	page, err := security.QuerySessions(SessionQuery{Order: OrderByPrincipal, Limit: 4})
+	check(err, t)
+	if page.Sessions[0].Principal.ID() != "user0" || page.Sessions[3].Principal.ID() != "user1" {
+		t.Error("Sessions are not ordered by the principal")
+	}
+	page, err = security.QuerySessions(SessionQuery{Descending: true, Limit: 1})
+	check(err, t)
+	if page.Sessions[0].ID.RemoteAddress != "10.0.1.89:4000" {
+		t.Error("Sessions are not ordered by the start time")
+	}
+
+	for _, query := range []SessionQuery{
+		{Order: "unknown"},
+		{RemoteAddress: "10.0.0.0/99"},
+		{Cursor: "unknown"},
+		{Cursor: page.Next, Order: OrderByPrincipal},
+	} {
+		if _, err := security.QuerySessions(query); err == nil || err.Error() != InvalidSessionQuery {
+			t.Errorf("Invalid query %+v is accepted", query)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package porter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Token bucket limit: Burst requests at once, refilled by Rate requests per second.
+A zero Rate disables the limit.
+*/
+type RateLimit struct {
+	Rate float64
+	/*
+		The capacity of the bucket. Defaults to Rate, at least 1.
+	*/
+	Burst int
+}
+
+/*
+Returns the limit of n requests per interval with the burst of n.
+*/
+func PerInterval(n int, interval time.Duration) RateLimit {
+	return RateLimit{Rate: float64(n) / interval.Seconds(), Burst: n}
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, l.Rate)
+}
+
+/*
+The token bucket of a key.
+*/
+type RateLimitBucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+/*
+The backend of the token buckets. See: NewMemoryRateLimiter
+
+Instances sharing the store may share a limiter backed by the store to apply the limits across instances.
+*/
+type RateLimiter interface {
+	/*
+		Takes a token from every bucket if all of them have one, otherwise takes none,
+		so a rejected request does not drain the other buckets.
+		Returns zero if the tokens are taken, otherwise the index of an exhausted bucket and the time until its next token.
+	*/
+	Take(buckets []RateLimitBucket) (int, time.Duration, error)
+}
+
+/*
+The rate limits of logins and authentications.
+
+Logins are limited globally and by the remote address before LoginFilter checks the credentials,
+and by the principal ID after it. The address is known before LoginFilter runs if the context is an *http.Request,
+see: Configuration.AddressResolver, otherwise the address returned by LoginFilter is limited after it.
+Failed logins are counted too, by the principal ID if LoginFilter returns a LoginFailedError.
+Authentications are limited by the remote address and globally before the session is looked up,
+and by the principal ID of the found session before it is refreshed.
+*/
+type RateLimits struct {
+	LoginPerAddress          RateLimit
+	LoginPerPrincipal        RateLimit
+	LoginGlobal              RateLimit
+	AuthenticatePerAddress   RateLimit
+	AuthenticatePerPrincipal RateLimit
+	AuthenticateGlobal       RateLimit
+	/*
+		The backend of the buckets. Defaults to an in-memory limiter per realm.
+	*/
+	Limiter RateLimiter
+}
+
+/*
+The error of a rate limited login or authentication.
+*/
+type RateLimitedError struct {
+	/*
+		The key of the exhausted limit: "address", "principal" or "global".
+	*/
+	Scope string
+	/*
+		The time until the request may be retried, for the Retry-After header for example.
+	*/
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return RateLimited
+}
+
+type rateLimitKey struct {
+	scope string
+	value string
+	limit RateLimit
+}
+
+/*
+Takes a token of each limit, the realm name and the operation prefixing the keys.
+Returns the RateLimitedError of an exhausted limit. Failures of the limiter allow the request.
+*/
+func (r *Realm) limit(operation string, keys ...rateLimitKey) error {
+	buckets := make([]RateLimitBucket, 0, len(keys))
+	scopes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key.limit.Rate > 0 {
+			buckets = append(buckets, RateLimitBucket{r.name + "\x00" + operation + "\x00" + key.scope + "\x00" + key.value, key.limit})
+			scopes = append(scopes, key.scope)
+		}
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+	exhausted, retryAfter, err := r.limiter.Take(buckets)
+	if err != nil {
+		r.pool.configuration.logger().Warn("Rate limiter failed", "operation", operation, "error", err)
+		return nil
+	}
+	if retryAfter > 0 && exhausted >= 0 && exhausted < len(scopes) {
+		return &RateLimitedError{Scope: scopes[exhausted], RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+/*
+Takes the global bucket of logins and the bucket of the address if it is known before LoginFilter runs.
+*/
+func (r *Realm) limitLogin(address string) error {
+	limits := r.configuration.RateLimits
+	if limits == nil {
+		return nil
+	}
+	keys := []rateLimitKey{{"global", "", limits.LoginGlobal}}
+	if address != "" {
+		keys = append(keys, rateLimitKey{"address", address, limits.LoginPerAddress})
+	}
+	return r.limit("login", keys...)
+}
+
+/*
+Takes the bucket of the principal ID returned by LoginFilter,
+and the bucket of the address returned by it if the address was not known before.
+*/
+func (r *Realm) limitLoginFiltered(address string, principalId string) error {
+	limits := r.configuration.RateLimits
+	if limits == nil {
+		return nil
+	}
+	keys := []rateLimitKey{}
+	if address != "" {
+		keys = append(keys, rateLimitKey{"address", address, limits.LoginPerAddress})
+	}
+	if principalId != "" {
+		keys = append(keys, rateLimitKey{"principal", principalId, limits.LoginPerPrincipal})
+	}
+	return r.limit("login", keys...)
+}
+
+func (r *Realm) limitAuthentication(address string) error {
+	limits := r.configuration.RateLimits
+	if limits == nil {
+		return nil
+	}
+	return r.limit("authenticate", rateLimitKey{"global", "", limits.AuthenticateGlobal},
+		rateLimitKey{"address", address, limits.AuthenticatePerAddress})
+}
+
+func (r *Realm) limitPrincipal(session *Session) error {
+	limits := r.configuration.RateLimits
+	if limits == nil {
+		return nil
+	}
+	return r.limit("authenticate", rateLimitKey{"principal", session.Principal.ID(), limits.AuthenticatePerPrincipal})
+}
+
+/*
+The in-memory RateLimiter. Full buckets are dropped.
+*/
+type MemoryRateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+/*
+The interval of dropping the full buckets.
+*/
+const rateLimiterSweepInterval = time.Minute
+
+func (l *MemoryRateLimiter) Take(buckets []RateLimitBucket) (int, time.Duration, error) {
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		for k, bucket := range l.buckets {
+			if now.After(bucket.full) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	refilled := make([]*tokenBucket, len(buckets))
+	for i, key := range buckets {
+		capacity := key.Limit.burst()
+		bucket, ok := l.buckets[key.Key]
+		if !ok {
+			bucket = &tokenBucket{tokens: capacity, updated: now}
+			l.buckets[key.Key] = bucket
+		}
+		bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*key.Limit.Rate)
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			return i, time.Duration((1 - bucket.tokens) / key.Limit.Rate * float64(time.Second)), nil
+		}
+		refilled[i] = bucket
+	}
+	for i, bucket := range refilled {
+		bucket.tokens--
+		bucket.full = now.Add(time.Duration((buckets[i].Limit.burst() - bucket.tokens) / buckets[i].Limit.Rate * float64(time.Second)))
+	}
+	return 0, 0, nil
+}
@@ -0,0 +1,200 @@
+package porter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	limit := RateLimit{Rate: 20, Burst: 2}
+	key := []RateLimitBucket{{"key", limit}}
+	for i := 0; i < 2; i++ {
+		if _, retryAfter, err := limiter.Take(key); err != nil || retryAfter != 0 {
+			t.Fatalf("Token %d is not taken", i)
+		}
+	}
+	_, retryAfter, err := limiter.Take(key)
+	check(err, t)
+	if retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Errorf("Unexpected retry after %s", retryAfter)
+	}
+	if _, retryAfter, _ = limiter.Take([]RateLimitBucket{{"other", limit}}); retryAfter != 0 {
+		t.Error("Buckets are shared by keys")
+	}
+	exhausted, retryAfter, _ := limiter.Take([]RateLimitBucket{{"other", limit}, {"key", limit}})
+	if exhausted != 1 || retryAfter <= 0 {
+		t.Errorf("Unexpected exhausted bucket %d", exhausted)
+	}
+	if _, retryAfter, _ = limiter.Take([]RateLimitBucket{{"other", limit}}); retryAfter != 0 {
+		t.Error("Bucket is drained by a rejected request")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, retryAfter, _ = limiter.Take(key); retryAfter != 0 {
+		t.Error("Bucket is not refilled")
+	}
+
+	if limit := PerInterval(10, time.Minute); limit.Burst != 10 || limit.Rate*60 < 9.99 || limit.Rate*60 > 10.01 {
+		t.Errorf("Unexpected limit %+v", limit)
+	}
+	if (RateLimit{Rate: 0.5}).burst() != 1 || (RateLimit{Rate: 5}).burst() != 5 {
+		t.Error("Unexpected default burst")
+	}
+}
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Take(buckets []RateLimitBucket) (int, time.Duration, error) {
+	return 0, 0, errors.New(StoreClosed)
+}
+
+func newRateLimitedSecurity(events *[]Event, limits *RateLimits) *Security {
+	return CreateNew(testConfiguration(events, func(configuration *Configuration) {
+		configuration.LoginFilter = func(context interface{}) (AuthenticationPrincipal, string, error) {
+			login := context.(deviceLogin)
+			if login.principal == nil {
+				return nil, login.remote, errors.New(CannotLoginPrincipal)
+			}
+			if login.userAgent == "wrong password" {
+				return nil, login.remote, &LoginFailedError{PrincipalID: login.principal.ID(), Err: errors.New(CannotLoginPrincipal)}
+			}
+			return login.principal, login.remote, nil
+		}
+		configuration.RateLimits = limits
+	}))
+}
+
+func TestLoginRateLimits(t *testing.T) {
+	events := []Event{}
+	security := newRateLimitedSecurity(&events, &RateLimits{
+		LoginPerAddress:   PerInterval(2, time.Minute),
+		LoginPerPrincipal: PerInterval(3, time.Minute),
+	})
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	principal := pp{ap{false, true, true}, "user1", policy}
+	_, err := security.Login(deviceLogin{nil, "198.51.100.1", ""})
+	if err == nil || err.Error() != CannotLoginPrincipal {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, err = security.Login(deviceLogin{principal, "198.51.100.1", ""})
+	check(err, t)
+	_, err = security.Login(deviceLogin{principal, "198.51.100.1", ""})
+	limited := &RateLimitedError{}
+	if !errors.As(err, &limited) || err.Error() != RateLimited || limited.Scope != "address" ||
+		limited.RetryAfter <= 0 || limited.RetryAfter > 30*time.Second {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if event := events[len(events)-1]; event.Kind != EventLoginFailed || event.Reason != ReasonRateLimited || event.RemoteAddress != "198.51.100.1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	_, err = security.Login(deviceLogin{principal, "198.51.100.2", ""})
+	check(err, t)
+	_, err = security.Login(deviceLogin{principal, "198.51.100.3", ""})
+	check(err, t)
+	if _, err = security.Login(deviceLogin{principal, "198.51.100.4", ""}); !errors.As(err, &limited) || limited.Scope != "principal" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = security.Login(deviceLogin{pp{ap{false, true, true}, "user2", policy}, "198.51.100.4", ""})
+	check(err, t)
+
+	target := pp{ap{false, true, true}, "user3", policy}
+	for i, address := range []string{"198.51.100.5", "198.51.100.6", "198.51.100.7"} {
+		_, err = security.Login(deviceLogin{target, address, "wrong password"})
+		if err == nil || err.Error() != CannotLoginPrincipal {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if event := events[len(events)-1]; event.PrincipalID != "user3" || event.Reason != ReasonFilter {
+			t.Errorf("Unexpected event %d %+v", i, event)
+		}
+	}
+	if _, err = security.Login(deviceLogin{target, "198.51.100.8", ""}); !errors.As(err, &limited) || limited.Scope != "principal" {
+		t.Errorf("Failed logins are not charged to the principal: %v", err)
+	}
+	if _, err = security.Login(deviceLogin{pp{ap{false, true, true}, "user4", policy}, "198.51.100.8", ""}); err != nil {
+		t.Errorf("Address is limited by the principal: %v", err)
+	}
+}
+
+func TestLoginRateLimitsBeforeFilter(t *testing.T) {
+	events := []Event{}
+	filtered := 0
+	security := CreateNew(testConfiguration(&events, func(configuration *Configuration) {
+		configuration.LoginFilter = func(context interface{}) (AuthenticationPrincipal, string, error) {
+			filtered++
+			return nil, "", &LoginFailedError{PrincipalID: "user1", Err: errors.New(CannotLoginPrincipal)}
+		}
+		configuration.RateLimits = &RateLimits{LoginPerAddress: PerInterval(2, time.Minute)}
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/login", nil)
+	request.RemoteAddr = "198.51.100.1:4000"
+	for i := 0; i < 2; i++ {
+		if _, err := security.Login(request); err == nil || err.Error() != CannotLoginPrincipal {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	limited := &RateLimitedError{}
+	if _, err := security.Login(request); !errors.As(err, &limited) || limited.Scope != "address" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if filtered != 2 {
+		t.Errorf("Credentials are checked %d times", filtered)
+	}
+	if event := events[len(events)-1]; event.Reason != ReasonRateLimited || event.RemoteAddress != "198.51.100.1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestAuthenticateRateLimits(t *testing.T) {
+	events := []Event{}
+	security := newRateLimitedSecurity(&events, &RateLimits{
+		AuthenticatePerAddress:   PerInterval(3, time.Minute),
+		AuthenticatePerPrincipal: PerInterval(2, time.Minute),
+		AuthenticateGlobal:       PerInterval(7, time.Minute),
+	})
+	session, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+	check(err, t)
+	guessed := from(session.ID, "203.0.113.1")
+	guessed.SSID = "guess"
+	for i := 0; i < 3; i++ {
+		if _, err = security.Authenticate(guessed); err == nil || err.Error() != SessionNotFound {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	limited := &RateLimitedError{}
+	if _, err = security.Authenticate(guessed); !errors.As(err, &limited) || limited.Scope != "address" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = security.Authenticate(session.ID)
+		check(err, t)
+	}
+	refreshed := session.lastRefresh()
+	time.Sleep(time.Millisecond)
+	for _, address := range []string{"198.51.100.2", "198.51.100.3"} {
+		if _, err = security.Authenticate(from(session.ID, address)); !errors.As(err, &limited) || limited.Scope != "principal" {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if !session.lastRefresh().Equal(refreshed) {
+		t.Error("Rate limited session is refreshed")
+	}
+	if _, err = security.Authenticate(from(session.ID, "198.51.100.4")); !errors.As(err, &limited) || limited.Scope != "global" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestRateLimiterFailure(t *testing.T) {
+	events := []Event{}
+	security := newRateLimitedSecurity(&events, &RateLimits{LoginGlobal: PerInterval(1, time.Minute), Limiter: failingRateLimiter{}})
+	for i := 0; i < 3; i++ {
+		_, err := security.Login(deviceLogin{ap{false, true, true}, "198.51.100.1", ""})
+		check(err, t)
+	}
+}
@@ -0,0 +1,331 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+/*
+The name of the realm created by CreateNew from the root configuration.
+*/
+const DefaultRealm = ""
+
+/*
+Isolated group of sessions with its own SessionPool and configuration.
+
+Sessions started in a realm carry its name in SessionIdentifier.Realm.
+Identifiers of one realm are never accepted by another one,
+so principal IDs may safely collide between realms.
+*/
+type Realm struct {
+	name          string
+	pool          *SessionPool
+	configuration *Configuration
+	limiter       RateLimiter
+}
+
+func newRealm(name string, configuration *Configuration) *Realm {
+	sessionConfiguration := configuration.getSessionConfiguration()
+	sessionConfiguration.Realm = name
+	realm := &Realm{
+		name:          name,
+		pool:          newSessionPool(sessionConfiguration),
+		configuration: configuration,
+	}
+	if configuration.RateLimits != nil {
+		realm.limiter = configuration.RateLimits.Limiter
+		if realm.limiter == nil {
+			realm.limiter = NewMemoryRateLimiter()
+		}
+	}
+	return realm
+}
+
+/*
+Returns the realm name.
+*/
+func (r *Realm) Name() string {
+	return r.name
+}
+
+/*
+Creates a new session in this realm for the found Authentication Principal.
+Executes SuccessLoginHandler on successful session creation.
+*/
+func (r *Realm) Login(context interface{}) (*Session, error) {
+	return r.LoginWithContext(background(), context)
+}
+
+/*
+Login traced as a child of the span of ctx. See: Configuration.Tracer
+*/
+func (r *Realm) LoginWithContext(ctx context.Context, context interface{}) (*Session, error) {
+	if r.configuration.LoginFilter == nil {
+		return nil, errors.New(LoginFilterNotImplemented)
+	}
+	ctx, span := r.pool.startSpan(ctx, SpanLogin)
+	address := r.resolveAddress(context, "")
+	if limited := r.limitLogin(address); limited != nil {
+		return nil, r.loginLimited(span, "", address, limited)
+	}
+	_, filterSpan := r.pool.startSpan(ctx, SpanLoginFilter)
+	principal, remote, err := r.configuration.LoginFilter(context)
+	endSpan(filterSpan, err)
+	remote = r.resolveAddress(context, remote)
+	principalId := ""
+	failed := &LoginFailedError{}
+	switch {
+	case err == nil:
+		principalId = principal.ID()
+	case errors.As(err, &failed):
+		principalId = failed.PrincipalID
+	}
+	unlimited := ""
+	if address == "" {
+		unlimited = NormalizeAddress(remote)
+	}
+	if limited := r.limitLoginFiltered(unlimited, principalId); limited != nil {
+		return nil, r.loginLimited(span, principalId, remote, limited)
+	}
+	if err != nil {
+		r.pool.loginFailed(principalId, remote, ReasonFilter, err)
+		span.SetAttribute(AttributeReason, ReasonFilter)
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttribute(AttributePrincipalID, principal.ID())
+	session, err := r.login(ctx, context, principal, NormalizeAddress(remote))
+	if err != nil {
+		span.SetAttribute(AttributeReason, failureReason(err))
+	}
+	endSpan(span, err)
+	return session, err
+}
+
+func (r *Realm) loginLimited(span Span, principalId string, remote string, err error) error {
+	r.pool.loginFailed(principalId, remote, ReasonRateLimited, err)
+	span.SetAttribute(AttributeReason, ReasonRateLimited)
+	endSpan(span, err)
+	return err
+}
+
+/*
+Finds an existing session of this realm for the current context.
+Uses the AuthenticationFilter delegate to retrieve the session ID.
+*/
+func (r *Realm) Authenticate(context interface{}) (*Session, error) {
+	return r.AuthenticateWithContext(background(), context)
+}
+
+/*
+Authenticate traced as a child of the span of ctx. See: Configuration.Tracer
+*/
+func (r *Realm) AuthenticateWithContext(ctx context.Context, context interface{}) (*Session, error) {
+	if r.configuration.AuthenticationFilter == nil {
+		return nil, errors.New(AuthenticationFilterNotImplemented)
+	}
+	return r.authenticate(ctx, context, r.configuration.AuthenticationFilter(context))
+}
+
+/*
+Authenticates the identifier, retrieving the user agent of the context for Configuration.BindUserAgent.
+Applies the rate limits of authentications before the session is refreshed, see: Configuration.RateLimits
+*/
+func (r *Realm) authenticate(ctx context.Context, context interface{}, identifier SessionIdentifier) (*Session, error) {
+	userAgent := ""
+	if r.configuration.BindUserAgent && r.configuration.UserAgentFilter != nil {
+		userAgent = r.configuration.UserAgentFilter(context)
+	}
+	identifier.RemoteAddress = r.resolveAddress(context, identifier.RemoteAddress)
+	if err := r.limitAuthentication(NormalizeAddress(identifier.RemoteAddress)); err != nil {
+		return nil, err
+	}
+	return r.pool.authenticate(ctx, identifier, userAgent, r.limitPrincipal)
+}
+
+/*
+Resolves the address of the client through Configuration.AddressResolver when the context is an *http.Request,
+so logins and authentications behind trusted proxies see the same address.
+An empty address is resolved from the connection of the request.
+*/
+func (r *Realm) resolveAddress(context interface{}, address string) string {
+	request, ok := context.(*http.Request)
+	if !ok {
+		return address
+	}
+	if address == "" {
+		return r.configuration.AddressResolver.Resolve(request)
+	}
+	if r.configuration.AddressResolver == nil {
+		return address
+	}
+	return r.configuration.AddressResolver.ResolveAddress(address, request.Header)
+}
+
+/*
+Sets the attribute of the session and writes the attributes to the store.
+*/
+func (r *Realm) SetAttribute(session *Session, key string, value string) error {
+	session.SetAttribute(key, value)
+	return r.pool.saveAttributes(session)
+}
+
+/*
+Stops the specified session.
+*/
+func (r *Realm) EndSession(session *Session) {
+	r.pool.removeSession(session)
+}
+
+/*
+Stops the current session for the current context.
+Uses the AuthenticationFilter delegate to retrieve the session ID.
+*/
+func (r *Realm) EndCurrentSession(context interface{}) error {
+	if r.configuration.AuthenticationFilter == nil {
+		return errors.New(AuthenticationFilterNotImplemented)
+	}
+	return r.pool.removeSessionById(r.configuration.AuthenticationFilter(context))
+}
+
+/*
+Gets all sessions of this realm for the specified Authentication Principal.
+*/
+func (r *Realm) GetAllSessions(principal AuthenticationPrincipal) []*Session {
+	return r.pool.getAllSessions(principal)
+}
+
+/*
+Gets all sessions of this realm for the current Authentication Principal.
+Uses the AuthenticationFilter delegate to retrieve the session ID.
+*/
+func (r *Realm) GetAllSessionsForCurrent(context interface{}) ([]*Session, error) {
+	if r.configuration.AuthenticationFilter == nil {
+		return nil, errors.New(AuthenticationFilterNotImplemented)
+	}
+	return r.getAllSessionsFor(r.configuration.AuthenticationFilter(context))
+}
+
+/*
+Returns a page of the sessions of this realm matching the query. Expired sessions not yet removed are included.
+Pass SessionPage.Next as SessionQuery.Cursor to get the next page.
+*/
+func (r *Realm) QuerySessions(query SessionQuery) (*SessionPage, error) {
+	return r.pool.querySessions(query)
+}
+
+/*
+Removes the session of this realm by the SID. Returns the SessionNotFound error if there is no such session.
+*/
+func (r *Realm) RevokeSession(sid string) error {
+	return r.pool.revokeSession(sid)
+}
+
+/*
+Removes all sessions of the principal in this realm. Returns the number of removed sessions.
+*/
+func (r *Realm) RevokePrincipal(principalId string) (int, error) {
+	return r.pool.revokePrincipal(principalId, ReasonRevoked)
+}
+
+/*
+Atomically writes all sessions of this realm to the snapshot file.
+*/
+func (r *Realm) SaveSnapshot(path string) error {
+	return r.pool.saveSnapshot(path)
+}
+
+/*
+Loads the sessions of this realm from the snapshot file written by SaveSnapshot.
+Uses the resolver to restore the Authentication Principals, expired sessions are dropped.
+Restored sessions take the principal lock and the policies like logins, without ending the sessions already started,
+and are reported as EventSessionRestored.
+Returns the number of loaded sessions. A missing file is treated as an empty snapshot.
+*/
+func (r *Realm) RestoreSnapshot(path string, resolver PrincipalResolver) (int, error) {
+	return r.pool.restoreSnapshot(path, resolver)
+}
+
+func (r *Realm) getAllSessionsFor(identifier SessionIdentifier) ([]*Session, error) {
+	session, err := r.pool.getSession(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return r.pool.getAllSessions(session.Principal), nil
+}
+
+func (r *Realm) login(ctx context.Context, context interface{}, principal AuthenticationPrincipal, remote string) (*Session, error) {
+	if !principal.CanLogin() {
+		err := errors.New(CannotLoginPrincipal)
+		r.pool.loginFailed(principal.ID(), remote, failureReason(err), err)
+		return nil, err
+	}
+	if err := r.pool.configuration.checkNetwork(principal, remote); err != nil {
+		r.pool.loginFailed(principal.ID(), remote, failureReason(err), err)
+		return nil, err
+	}
+	var attributes map[string]string
+	if r.configuration.UserAgentFilter != nil {
+		attributes = deviceAttributes(r.configuration.UserAgentFilter(context))
+	}
+	session, err := r.pool.newSession(ctx, principal, remote, attributes)
+	if err == nil && r.pool.inspect(Observation{Kind: ObservationLogin, Session: session, RemoteAddress: remote}) == ActionRevoke {
+		session, err = nil, errors.New(SessionRevoked)
+	}
+	if err != nil {
+		r.pool.loginFailed(principal.ID(), remote, failureReason(err), err)
+		return nil, err
+	}
+	_, span := r.pool.startSpan(ctx, SpanSuccessLoginHandler)
+	r.configuration.SuccessLoginHandler(context, session)
+	span.End()
+	return session, nil
+}
+
+/*
+Copies the configuration of a realm, inheriting unset delegates and the logger from the root configuration.
+*/
+func inheritConfiguration(root *Configuration, configuration *Configuration) *Configuration {
+	if configuration == nil {
+		configuration = root
+	}
+	inherited := *configuration
+	if inherited.SuccessLoginHandler == nil {
+		inherited.SuccessLoginHandler = root.SuccessLoginHandler
+	}
+	if inherited.LoginFilter == nil {
+		inherited.LoginFilter = root.LoginFilter
+	}
+	if inherited.AuthenticationFilter == nil {
+		inherited.AuthenticationFilter = root.AuthenticationFilter
+	}
+	if inherited.Logger == nil {
+		inherited.Logger = root.Logger
+	}
+	if inherited.Listeners == nil {
+		inherited.Listeners = root.Listeners
+	}
+	if inherited.Tracer == nil {
+		inherited.Tracer = root.Tracer
+	}
+	if inherited.AnomalyDetectors == nil {
+		inherited.AnomalyDetectors = root.AnomalyDetectors
+	}
+	if inherited.UserAgentFilter == nil {
+		inherited.UserAgentFilter = root.UserAgentFilter
+	}
+	if inherited.AddressResolver == nil {
+		inherited.AddressResolver = root.AddressResolver
+	}
+	if inherited.DeviceKey == nil {
+		inherited.DeviceKey = root.DeviceKey
+	}
+	if inherited.NetworkPolicy == nil {
+		inherited.NetworkPolicy = root.NetworkPolicy
+	}
+	if inherited.RateLimits == nil {
+		inherited.RateLimits = root.RateLimits
+	}
+	return &inherited
+}
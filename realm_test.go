@@ -0,0 +1,89 @@
+package porter
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSecurity(filter AuthenticationFilter) *Security {
+	return CreateNew(&Configuration{
+		SuccessLoginHandler:  func(context interface{}, session *Session) {},
+		AuthenticationFilter: filter,
+		Logger:               testingLogger,
+		ExpirationTime:       10 * time.Second,
+		Timeout:              5 * time.Second,
+		MultiLogin:           FailNew,
+	})
+}
+
+func TestSecurity_RealmIsolation(t *testing.T) {
+	security := newTestSecurity(func(context interface{}) SessionIdentifier {
+		return context.(SessionIdentifier)
+	})
+	admin, err := security.AddRealm("admin", &Configuration{
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     FailNew,
+	})
+	check(err, t)
+
+	principal := ap{true, true, true}
+
+	session, err := security.defaultRealm.login(background(), nil, principal, "remote1")
+	check(err, t)
+	adminSession, err := admin.login(background(), nil, principal, "remote1")
+	check(err, t)
+
+	if adminSession.ID.Realm != "admin" || session.ID.Realm != DefaultRealm {
+		t.Error("Sessions do not carry their realm")
+	}
+
+	found, err := security.Authenticate(adminSession.ID)
+	check(err, t)
+	if found != adminSession {
+		t.Error("Session found in the wrong realm")
+	}
+
+	foreign := adminSession.ID
+	foreign.Realm = DefaultRealm
+	if _, err := security.Authenticate(foreign); err == nil || err.Error() != SessionNotFound {
+		t.Error("Identifier accepted in another realm")
+	}
+	if _, err := admin.Authenticate(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Identifier accepted in another realm")
+	}
+
+	unknown := session.ID
+	unknown.Realm = "unknown"
+	if _, err := security.Authenticate(unknown); err == nil || err.Error() != SessionNotFound {
+		t.Error("Identifier of an unknown realm accepted")
+	}
+
+	security.EndSession(adminSession)
+	if len(admin.GetAllSessions(principal)) != 0 || len(security.GetAllSessions(principal)) != 1 {
+		t.Error("Session removed from the wrong realm")
+	}
+}
+
+func TestSecurity_AddRealm(t *testing.T) {
+	security := newTestSecurity(nil)
+
+	realm, err := security.AddRealm("kiosk", nil)
+	check(err, t)
+	if realm.configuration.Timeout != security.configuration.Timeout || realm.configuration.SuccessLoginHandler == nil {
+		t.Error("Configuration is not inherited")
+	}
+
+	if _, err := security.AddRealm("kiosk", nil); err == nil || err.Error() != RealmAlreadyExists {
+		t.Error("Realm registered twice")
+	}
+
+	found, err := security.Realm("kiosk")
+	check(err, t)
+	if found != realm || found.Name() != "kiosk" {
+		t.Error("Wrong realm found")
+	}
+	if _, err := security.Realm("missing"); err == nil || err.Error() != RealmNotFound {
+		t.Error("Missing realm found")
+	}
+}
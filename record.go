@@ -0,0 +1,71 @@
+package porter
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Serializable form of a session. The principal is kept by ID.
+*/
+type sessionRecord struct {
+	SID            string            `json:"sid"`
+	SSID           string            `json:"ssid"`
+	RemoteAddress  string            `json:"remote_address"`
+	Realm          string            `json:"realm"`
+	PrincipalID    string            `json:"principal_id"`
+	StartTime      time.Time         `json:"start_time"`
+	ExpirationTime time.Time         `json:"expiration_time"`
+	RefreshTime    time.Time         `json:"refresh_time"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+}
+
+func newSessionRecord(session *Session) *sessionRecord {
+	return &sessionRecord{
+		SID:            session.ID.SID,
+		SSID:           session.ID.SSID,
+		RemoteAddress:  session.ID.RemoteAddress,
+		Realm:          session.ID.Realm,
+		PrincipalID:    session.Principal.ID(),
+		StartTime:      session.startTime,
+		ExpirationTime: session.expirationTime,
+		RefreshTime:    session.lastRefresh(),
+		Attributes:     session.Attributes(),
+	}
+}
+
+func (r *sessionRecord) identifier() SessionIdentifier {
+	return SessionIdentifier{
+		SID:           r.SID,
+		SSID:          r.SSID,
+		RemoteAddress: r.RemoteAddress,
+		Realm:         r.Realm,
+	}
+}
+
+/*
+Restores the session, resolving the principal by ID.
+Returns the SessionNotFound error if the resolver finds no principal.
+*/
+func (r *sessionRecord) session(resolver PrincipalResolver) (*Session, error) {
+	principal, err := resolver(r.PrincipalID)
+	if err != nil {
+		return nil, err
+	}
+	if principal == nil {
+		return nil, errors.New(SessionNotFound)
+	}
+	attributes := r.Attributes
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+	return &Session{
+		ID:                r.identifier(),
+		Principal:         principal,
+		startTime:         r.StartTime,
+		expirationTime:    r.ExpirationTime,
+		refreshTime:       r.RefreshTime,
+		storedRefreshTime: r.RefreshTime,
+		attributes:        attributes,
+	}, nil
+}
@@ -0,0 +1,444 @@
+package porter
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+/*
+The number of keys requested by one SCAN and MGET of RedisStore.Range.
+*/
+const redisScanCount = 100
+
+type RedisStoreOptions struct {
+	/*
+		The address of the server, "localhost:6379" by default.
+	*/
+	Address  string
+	Password string
+	Database int
+	/*
+		The prefix of all keys, "porter" by default.
+	*/
+	Prefix string
+	/*
+		The session timeout the key TTLs are computed with. See: Configuration.Timeout
+	*/
+	Timeout time.Duration
+	/*
+		Times out the sessions of principals saving sessions too. See: Configuration.ForceExpire
+	*/
+	ForceExpire bool
+	/*
+		The maximum number of idle connections. Defaults to 8.
+	*/
+	PoolSize int
+	/*
+		The timeout of dialing and of every command. Defaults to 5 seconds.
+	*/
+	IOTimeout time.Duration
+}
+
+/*
+SessionStore keeping sessions in Redis or any server speaking RESP.
+
+Every session is a JSON value with a TTL mirroring the session expiration:
+the rest of the total lifetime or of the timeout, whichever is shorter,
+so the server expires sessions by itself. Sessions of principals saving sessions
+(see: AuthenticationPrincipal.SaveSession) and SessionPolicyProvider timeouts are honored.
+A set per principal indexes the SIDs of the principal, members of expired sessions are removed lazily.
+The TTL of the set is the longest total lifetime of its sessions.
+*/
+type RedisStore struct {
+	options  RedisStoreOptions
+	resolver PrincipalResolver
+	conns    chan *respConn
+}
+
+/*
+Creates the store. Connections are dialed on demand.
+Uses the resolver to restore the Authentication Principals of the loaded sessions.
+Returns the ResolverRequired error if the resolver is nil.
+*/
+func NewRedisStore(resolver PrincipalResolver, options RedisStoreOptions) (*RedisStore, error) {
+	if resolver == nil {
+		return nil, errors.New(ResolverRequired)
+	}
+	if options.Address == "" {
+		options.Address = "localhost:6379"
+	}
+	if options.Prefix == "" {
+		options.Prefix = "porter"
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 8
+	}
+	if options.IOTimeout <= 0 {
+		options.IOTimeout = 5 * time.Second
+	}
+	return &RedisStore{
+		options:  options,
+		resolver: resolver,
+		conns:    make(chan *respConn, options.PoolSize),
+	}, nil
+}
+
+func (rs *RedisStore) sessionKey(realm string, sid string) string {
+	return rs.options.Prefix + ":" + realm + ":s:" + sid
+}
+
+func (rs *RedisStore) principalKey(realm string, principalId string) string {
+	return rs.options.Prefix + ":" + realm + ":p:" + principalId
+}
+
+func (rs *RedisStore) conn() (*respConn, error) {
+	select {
+	case conn := <-rs.conns:
+		return conn, nil
+	default:
+	}
+	conn, err := dialRESP(rs.options.Address, rs.options.IOTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if rs.options.Password != "" {
+		if _, err = conn.do("AUTH", rs.options.Password); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if rs.options.Database != 0 {
+		if _, err = conn.do("SELECT", strconv.Itoa(rs.options.Database)); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+/*
+Returns the connection to the pool unless it failed on the network level.
+*/
+func (rs *RedisStore) release(conn *respConn, err error) {
+	if _, ok := err.(respError); err != nil && !ok {
+		conn.close()
+		return
+	}
+	select {
+	case rs.conns <- conn:
+	default:
+		conn.close()
+	}
+}
+
+func (rs *RedisStore) pipeline(commands [][]string) ([]interface{}, error) {
+	conn, err := rs.conn()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.pipeline(commands)
+	rs.release(conn, err)
+	return replies, err
+}
+
+func (rs *RedisStore) do(args ...string) (interface{}, error) {
+	conn, err := rs.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	rs.release(conn, err)
+	return reply, err
+}
+
+/*
+Closes the idle connections.
+*/
+func (rs *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-rs.conns:
+			conn.close()
+		default:
+			return nil
+		}
+	}
+}
+
+/*
+Returns the TTL of the session key: the rest of the total lifetime or of the timeout, whichever is shorter.
+*/
+func (rs *RedisStore) ttl(session *Session, refreshTime time.Time, now time.Time) time.Duration {
+	ttl := session.expirationTime.Sub(now)
+	if !session.Principal.SaveSession() || rs.options.ForceExpire {
+		timeout := rs.options.Timeout
+		if provider, ok := session.Principal.(SessionPolicyProvider); ok {
+			timeout = provider.SessionPolicy(SessionPolicy{Timeout: timeout}).Timeout
+		}
+		if idle := refreshTime.Add(timeout).Sub(now); timeout > 0 && idle < ttl {
+			ttl = idle
+		}
+	}
+	return ttl
+}
+
+func milliseconds(duration time.Duration) string {
+	ms := int64(duration / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+/*
+Returns the command writing the session value, nil if the session is already expired.
+*/
+func (rs *RedisStore) setCommand(session *Session, refreshTime time.Time, now time.Time, conditions ...string) ([]string, error) {
+	ttl := rs.ttl(session, refreshTime, now)
+	if ttl <= 0 {
+		return nil, nil
+	}
+	record := newSessionRecord(session)
+	record.RefreshTime = refreshTime
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	command := []string{"SET", rs.sessionKey(session.ID.Realm, session.ID.SID), string(value), "PX", milliseconds(ttl)}
+	return append(command, conditions...), nil
+}
+
+/*
+Extends the TTL of KEYS[1] to ARGV[1] milliseconds, never shortening it.
+A key without a TTL is created by SADD just before, so its TTL is set.
+*/
+const redisExtendScript = `local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -1 or (ttl >= 0 and ttl < tonumber(ARGV[1])) then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 0`
+
+func (rs *RedisStore) Save(session *Session) error {
+	now := time.Now()
+	refreshTime := session.lastRefresh()
+	set, err := rs.setCommand(session, refreshTime, now)
+	if err != nil || set == nil {
+		return err
+	}
+	index := rs.principalKey(session.ID.Realm, session.Principal.ID())
+	replies, err := rs.pipeline([][]string{
+		set,
+		{"SADD", index, session.ID.SID},
+		{"EVAL", redisExtendScript, "1", index, milliseconds(session.expirationTime.Sub(now))},
+	})
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if replyErr, ok := reply.(respError); ok {
+			return replyErr
+		}
+	}
+	session.stored(refreshTime)
+	return nil
+}
+
+func decodeRedisRecord(value interface{}) (*sessionRecord, error) {
+	data, ok := value.(string)
+	if !ok {
+		return nil, errors.New(RESPProtocolError)
+	}
+	record := &sessionRecord{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (rs *RedisStore) decode(value interface{}) (*Session, error) {
+	record, err := decodeRedisRecord(value)
+	if err != nil {
+		return nil, err
+	}
+	return record.session(rs.resolver)
+}
+
+func (rs *RedisStore) Get(identifier SessionIdentifier) (*Session, error) {
+	reply, err := rs.do("GET", rs.sessionKey(identifier.Realm, identifier.SID))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New(SessionNotFound)
+	}
+	return rs.decode(reply)
+}
+
+/*
+Rewrites the sessions with the new refresh times and TTLs in one pipeline.
+Removed sessions are not restored and stay not stored.
+*/
+func (rs *RedisStore) Touch(sessions []*Session) error {
+	now := time.Now()
+	commands := make([][]string, 0, len(sessions))
+	written := make([]*Session, 0, len(sessions))
+	refreshTimes := make([]time.Time, 0, len(sessions))
+	for _, session := range sessions {
+		refreshTime := session.lastRefresh()
+		set, err := rs.setCommand(session, refreshTime, now, "XX")
+		if err != nil {
+			return err
+		}
+		if set != nil {
+			commands = append(commands, set)
+			written = append(written, session)
+			refreshTimes = append(refreshTimes, refreshTime)
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	replies, err := rs.pipeline(commands)
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies {
+		if replyErr, ok := reply.(respError); ok {
+			return replyErr
+		}
+		if reply == "OK" {
+			written[i].stored(refreshTimes[i])
+		}
+	}
+	return nil
+}
+
+/*
+Rewrites the session with its attributes, see: RedisStore.Touch
+*/
+func (rs *RedisStore) SaveAttributes(session *Session) error {
+	return rs.Touch([]*Session{session})
+}
+
+func (rs *RedisStore) Remove(session *Session) (bool, error) {
+	replies, err := rs.pipeline([][]string{
+		{"DEL", rs.sessionKey(session.ID.Realm, session.ID.SID)},
+		{"SREM", rs.principalKey(session.ID.Realm, session.Principal.ID()), session.ID.SID},
+	})
+	if err != nil {
+		return false, err
+	}
+	if replyErr, ok := replies[0].(respError); ok {
+		return false, replyErr
+	}
+	return replies[0] == int64(1), nil
+}
+
+/*
+Loads the values of the session keys. Missing keys are returned as nil values.
+*/
+func (rs *RedisStore) load(keys []string) ([]interface{}, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	reply, err := rs.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(keys) {
+		return nil, errors.New(RESPProtocolError)
+	}
+	return values, nil
+}
+
+func (rs *RedisStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	index := rs.principalKey(realm, principalId)
+	reply, err := rs.do("SMEMBERS", index)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	sids := make([]string, 0, len(members))
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		if sid, ok := member.(string); ok {
+			sids = append(sids, sid)
+			keys = append(keys, rs.sessionKey(realm, sid))
+		}
+	}
+	values, err := rs.load(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*Session{}
+	stale := []string{"SREM", index}
+	for i, value := range values {
+		if value == nil {
+			stale = append(stale, sids[i])
+			continue
+		}
+		session, err := rs.decode(value)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if len(stale) > 2 {
+		if _, err = rs.do(stale...); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+/*
+Scans all session keys of the prefix. Sessions of not resolved principals are skipped.
+*/
+func (rs *RedisStore) Range(fn func(session *Session) bool) error {
+	cursor := "0"
+	for {
+		reply, err := rs.do("SCAN", cursor, "MATCH", rs.options.Prefix+":*:s:*", "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return errors.New(RESPProtocolError)
+		}
+		cursor, _ = page[0].(string)
+		found, _ := page[1].([]interface{})
+		keys := make([]string, 0, len(found))
+		for _, key := range found {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		values, err := rs.load(keys)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			record, err := decodeRedisRecord(value)
+			if err != nil {
+				return err
+			}
+			session, err := record.session(rs.resolver)
+			if err != nil {
+				continue
+			}
+			if !fn(session) {
+				return nil
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package porter
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Tiny in-process stand-in of a RESP server with the commands used by RedisStore.
+*/
+type fakeRESPServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	values   map[string]string
+	sets     map[string]map[string]bool
+	expires  map[string]time.Time
+	batches  []int
+}
+
+func startFakeRESPServer(t *testing.T) *fakeRESPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	check(err, t)
+	server := &fakeRESPServer{
+		listener: listener,
+		values:   map[string]string{},
+		sets:     map[string]map[string]bool{},
+		expires:  map[string]time.Time{},
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+func (s *fakeRESPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRESPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		batch := 0
+		for {
+			request, err := readRESP(reader)
+			if err != nil {
+				return
+			}
+			values, _ := request.([]interface{})
+			args := make([]string, len(values))
+			for i, value := range values {
+				args[i], _ = value.(string)
+			}
+			writer.WriteString(s.execute(args))
+			batch++
+			if reader.Buffered() == 0 {
+				break
+			}
+		}
+		s.lock.Lock()
+		s.batches = append(s.batches, batch)
+		s.lock.Unlock()
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func respBulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func respInt(value int) string {
+	return ":" + strconv.Itoa(value) + "\r\n"
+}
+
+func respArray(values []string) string {
+	reply := "*" + strconv.Itoa(len(values)) + "\r\n"
+	for _, value := range values {
+		reply += value
+	}
+	return reply
+}
+
+func (s *fakeRESPServer) expire(key string) {
+	if deadline, ok := s.expires[key]; ok && !time.Now().Before(deadline) {
+		delete(s.values, key)
+		delete(s.sets, key)
+		delete(s.expires, key)
+	}
+}
+
+func (s *fakeRESPServer) exists(key string) bool {
+	s.expire(key)
+	_, value := s.values[key]
+	_, set := s.sets[key]
+	return value || set
+}
+
+func (s *fakeRESPServer) execute(args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		s.expire(args[1])
+		if value, ok := s.values[args[1]]; ok {
+			return respBulk(value)
+		}
+		return "$-1\r\n"
+	case "SET":
+		exists := s.exists(args[1])
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return "$-1\r\n"
+				}
+			case "XX":
+				if !exists {
+					return "$-1\r\n"
+				}
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		s.values[args[1]] = args[2]
+		delete(s.expires, args[1])
+		if ttl > 0 {
+			s.expires[args[1]] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.exists(key) {
+				deleted++
+			}
+			delete(s.values, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+		return respInt(deleted)
+	case "SADD":
+		s.expire(args[1])
+		set, ok := s.sets[args[1]]
+		if !ok {
+			set = map[string]bool{}
+			s.sets[args[1]] = set
+		}
+		for _, member := range args[2:] {
+			set[member] = true
+		}
+		return respInt(len(args) - 2)
+	case "SREM":
+		s.expire(args[1])
+		removed := 0
+		for _, member := range args[2:] {
+			if s.sets[args[1]][member] {
+				delete(s.sets[args[1]], member)
+				removed++
+			}
+		}
+		return respInt(removed)
+	case "SMEMBERS":
+		s.expire(args[1])
+		members := []string{}
+		for member := range s.sets[args[1]] {
+			members = append(members, respBulk(member))
+		}
+		return respArray(members)
+	case "PEXPIRE":
+		if !s.exists(args[1]) {
+			return respInt(0)
+		}
+		ms, _ := strconv.Atoi(args[2])
+		s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return respInt(1)
+	case "EVAL":
+		// The only script of RedisStore extends the TTL of the key.
+		ms, _ := strconv.Atoi(args[4])
+		deadline, ok := s.expires[args[3]]
+		if !s.exists(args[3]) || ok && !deadline.Before(time.Now().Add(time.Duration(ms)*time.Millisecond)) {
+			return respInt(0)
+		}
+		s.expires[args[3]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return respInt(1)
+	case "PTTL":
+		if !s.exists(args[1]) {
+			return respInt(-2)
+		}
+		deadline, ok := s.expires[args[1]]
+		if !ok {
+			return respInt(-1)
+		}
+		return respInt(int(time.Until(deadline) / time.Millisecond))
+	case "MGET":
+		values := []string{}
+		for _, key := range args[1:] {
+			s.expire(key)
+			if value, ok := s.values[key]; ok {
+				values = append(values, respBulk(value))
+			} else {
+				values = append(values, "$-1\r\n")
+			}
+		}
+		return respArray(values)
+	case "SCAN":
+		keys := []string{}
+		for key := range s.values {
+			if matched, _ := path.Match(args[3], key); matched && s.exists(key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		found := []string{}
+		for _, key := range keys {
+			found = append(found, respBulk(key))
+		}
+		return respArray([]string{respBulk("0"), respArray(found)})
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (s *fakeRESPServer) pttl(key string) int {
+	reply := s.execute([]string{"PTTL", key})
+	ttl, _ := strconv.Atoi(strings.TrimSpace(reply[1:]))
+	return ttl
+}
+
+func newRedisStorePool(t *testing.T, timeout time.Duration) (*SessionPool, *RedisStore, *fakeRESPServer) {
+	server := startFakeRESPServer(t)
+	store, err := NewRedisStore(fileStoreResolver, RedisStoreOptions{
+		Address:  server.listener.Addr().String(),
+		Timeout:  timeout,
+		Password: "secret",
+	})
+	check(err, t)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            timeout,
+		MultiLogin:         AllowNew,
+		Store:              store,
+	}), store, server
+}
+
+func TestRedisStore_Sessions(t *testing.T) {
+	pool, store, server := newRedisStorePool(t, 5*time.Second)
+	if _, err := NewRedisStore(nil, RedisStoreOptions{}); err == nil || err.Error() != ResolverRequired {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	first, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	second, err := pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	first.SetAttribute("locale", "en")
+
+	found, err := pool.getSession(second.ID)
+	check(err, t)
+	if found == second || found.ID != second.ID {
+		t.Error("Session is not loaded from the server")
+	}
+	if ttl := server.pttl(store.sessionKey(DefaultRealm, first.ID.SID)); ttl <= 0 || ttl > 5000 {
+		t.Errorf("TTL %d does not mirror the timeout", ttl)
+	}
+	if len(pool.getAllSessions(fileStorePrincipal)) != 2 {
+		t.Error("Sessions of the principal are not indexed")
+	}
+
+	pool.removeSession(first)
+	if _, err = store.Get(first.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Removed session found")
+	}
+	count := 0
+	check(store.Range(func(session *Session) bool {
+		count++
+		return true
+	}), t)
+	if count != 1 {
+		t.Errorf("Range found %d sessions, expected 1", count)
+	}
+}
+
+func TestRedisStore_TTL(t *testing.T) {
+	pool, store, server := newRedisStorePool(t, 100*time.Millisecond)
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err = pool.getSession(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Session is not expired by the server")
+	}
+	if len(pool.getAllSessions(fileStorePrincipal)) != 0 {
+		t.Error("Expired session is indexed")
+	}
+	server.lock.Lock()
+	members := len(server.sets[store.principalKey(DefaultRealm, fileStorePrincipal.ID())])
+	server.lock.Unlock()
+	if members != 0 {
+		t.Error("Stale index members are not removed")
+	}
+}
+
+func TestRedisStore_PipelinedTouch(t *testing.T) {
+	_, store, server := newRedisStorePool(t, 5*time.Second)
+
+	sessions := []*Session{}
+	for i := 0; i < 5; i++ {
+		session := &Session{
+			ID:             SessionIdentifier{SID: NewToken(), SSID: NewToken(), RemoteAddress: "remote1"},
+			Principal:      fileStorePrincipal,
+			startTime:      time.Now(),
+			refreshTime:    time.Now(),
+			expirationTime: time.Now().Add(time.Minute),
+		}
+		check(store.Save(session), t)
+		sessions = append(sessions, session)
+	}
+	removed := sessions[4]
+	_, err := store.Remove(removed)
+	check(err, t)
+
+	server.lock.Lock()
+	server.batches = nil
+	server.lock.Unlock()
+
+	for _, session := range sessions {
+		session.Refresh()
+	}
+	check(store.Touch(sessions), t)
+
+	server.lock.Lock()
+	batches := server.batches
+	server.lock.Unlock()
+	if len(batches) != 1 || batches[0] != 5 {
+		t.Errorf("Refresh is not pipelined: %v", batches)
+	}
+	if _, err = store.Get(removed.ID); err == nil {
+		t.Error("Removed session restored by refresh")
+	}
+	if removed.unstored() == 0 || sessions[0].unstored() != 0 {
+		t.Error("Removed session is marked stored")
+	}
+	stored, err := store.Get(sessions[0].ID)
+	check(err, t)
+	if !stored.lastRefresh().Equal(sessions[0].lastRefresh()) {
+		t.Error("Refresh time is not written")
+	}
+}
+
+func TestRedisStore_SavedSessionTTL(t *testing.T) {
+	server := startFakeRESPServer(t)
+	options := RedisStoreOptions{Address: server.listener.Addr().String(), Timeout: time.Second}
+	saved := func(expiration time.Duration) *Session {
+		return &Session{
+			ID:             SessionIdentifier{SID: NewToken(), SSID: NewToken(), RemoteAddress: "remote1"},
+			Principal:      ap{true, true, true},
+			startTime:      time.Now(),
+			refreshTime:    time.Now(),
+			expirationTime: time.Now().Add(expiration),
+		}
+	}
+
+	store, err := NewRedisStore(fileStoreResolver, options)
+	check(err, t)
+	defer store.Close()
+	long := saved(time.Minute)
+	check(store.Save(long), t)
+	if ttl := server.pttl(store.sessionKey("", long.ID.SID)); ttl <= 50000 {
+		t.Errorf("Saved session times out in %d", ttl)
+	}
+	check(store.Save(saved(10*time.Second)), t)
+	if ttl := server.pttl(store.principalKey("", long.Principal.ID())); ttl <= 50000 {
+		t.Errorf("Index TTL %d is shortened below its sessions", ttl)
+	}
+
+	options.ForceExpire = true
+	forced, err := NewRedisStore(fileStoreResolver, options)
+	check(err, t)
+	defer forced.Close()
+	session := saved(time.Minute)
+	check(forced.Save(session), t)
+	if ttl := server.pttl(forced.sessionKey("", session.ID.SID)); ttl <= 0 || ttl > 1000 {
+		t.Errorf("Forced expiration is ignored, TTL %d", ttl)
+	}
+}
@@ -0,0 +1,181 @@
+package porter
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Coalesces the refresh time writes to a session store.
+
+The refresh time is written only when it has advanced by the threshold since the last write,
+the fraction RefreshThreshold of the timeout of the session policy.
+With an interval the dirty sessions are written in batches in the background.
+The latest local refresh times are applied to the sessions loaded from the store,
+so Expired is computed from the local value.
+*/
+type refresher struct {
+	store         SessionStore
+	configuration *sessionConfiguration
+	interval      time.Duration
+	retention     time.Duration
+	logger        Logger
+
+	lock     sync.Mutex
+	local    map[string]time.Time
+	dirty    map[string]*Session
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+/*
+Returns nil if the refresh writes should not be coalesced.
+*/
+func newRefresher(store SessionStore, configuration *sessionConfiguration) *refresher {
+	if configuration.RefreshThreshold <= 0 && configuration.RefreshInterval <= 0 {
+		return nil
+	}
+	retention := configuration.Timeout
+	if configuration.ExpirationDuration > retention {
+		retention = configuration.ExpirationDuration
+	}
+	r := &refresher{
+		store:         store,
+		configuration: configuration,
+		interval:      configuration.RefreshInterval,
+		retention:     retention,
+		logger:        configuration.logger(),
+		local:         map[string]time.Time{},
+		dirty:         map[string]*Session{},
+	}
+	if r.interval > 0 {
+		r.stop = make(chan struct{})
+		r.done = make(chan struct{})
+		go r.run()
+	}
+	return r
+}
+
+/*
+Applies the local refresh time to the session loaded from the store.
+*/
+func (r *refresher) restore(session *Session) {
+	r.lock.Lock()
+	refreshTime, ok := r.local[session.ID.SID]
+	r.lock.Unlock()
+	if ok {
+		session.restoreRefresh(refreshTime)
+	}
+}
+
+/*
+Returns the advance of the refresh time due to be written, by the timeout of the policy of the session.
+*/
+func (r *refresher) threshold(session *Session) time.Duration {
+	return time.Duration(r.configuration.RefreshThreshold * float64(r.configuration.policyFor(session.Principal).Timeout))
+}
+
+/*
+Records the refresh of the session and writes it if the threshold is reached.
+*/
+func (r *refresher) refreshed(session *Session) error {
+	refreshTime := session.lastRefresh()
+	due := session.unstored() >= r.threshold(session)
+
+	r.lock.Lock()
+	r.local[session.ID.SID] = refreshTime
+	if due && r.interval > 0 {
+		r.dirty[session.ID.SID] = session
+	}
+	r.lock.Unlock()
+
+	if due && r.interval <= 0 {
+		return r.write([]*Session{session})
+	}
+	return nil
+}
+
+func (r *refresher) forget(sid string) {
+	r.lock.Lock()
+	delete(r.local, sid)
+	delete(r.dirty, sid)
+	r.lock.Unlock()
+}
+
+func (r *refresher) write(sessions []*Session) error {
+	refreshTimes := make([]time.Time, len(sessions))
+	for i, session := range sessions {
+		refreshTimes[i] = session.lastRefresh()
+	}
+	if err := r.store.Touch(sessions); err != nil {
+		return err
+	}
+	for i, session := range sessions {
+		session.stored(refreshTimes[i])
+	}
+	return nil
+}
+
+/*
+Writes all dirty sessions and drops the local refresh times older than the retention.
+*/
+func (r *refresher) flush() error {
+	r.lock.Lock()
+	sessions := make([]*Session, 0, len(r.dirty))
+	for _, session := range r.dirty {
+		sessions = append(sessions, session)
+	}
+	r.dirty = map[string]*Session{}
+	outdated := time.Now().Add(-r.retention)
+	for sid, refreshTime := range r.local {
+		if refreshTime.Before(outdated) {
+			delete(r.local, sid)
+		}
+	}
+	r.lock.Unlock()
+
+	if len(sessions) == 0 {
+		return nil
+	}
+	err := r.write(sessions)
+	if err != nil {
+		r.lock.Lock()
+		for _, session := range sessions {
+			if _, ok := r.dirty[session.ID.SID]; !ok {
+				r.dirty[session.ID.SID] = session
+			}
+		}
+		r.lock.Unlock()
+	}
+	return err
+}
+
+func (r *refresher) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				r.logger.Error("Refresh of sessions failed", "error", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+/*
+Stops the background writing and writes the remaining dirty sessions. Safe to call more than once.
+*/
+func (r *refresher) close() error {
+	if r.stop != nil {
+		r.stopOnce.Do(func() {
+			close(r.stop)
+		})
+		<-r.done
+	}
+	return r.flush()
+}
@@ -0,0 +1,164 @@
+package porter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Imitates a remote store: returns copies of the sessions and counts the refresh writes.
+*/
+type copyingStore struct {
+	*MemoryStore
+	lock    sync.Mutex
+	touches int
+	touched int
+}
+
+func newCopyingStore() *copyingStore {
+	return &copyingStore{MemoryStore: NewMemoryStore(1)}
+}
+
+func copySession(session *Session) *Session {
+	refreshTime := session.lastRefresh()
+	return &Session{
+		ID:                session.ID,
+		Principal:         session.Principal,
+		startTime:         session.startTime,
+		expirationTime:    session.expirationTime,
+		refreshTime:       refreshTime,
+		storedRefreshTime: refreshTime,
+		attributes:        session.Attributes(),
+	}
+}
+
+func (cs *copyingStore) Save(session *Session) error {
+	return cs.MemoryStore.Save(copySession(session))
+}
+
+func (cs *copyingStore) Get(identifier SessionIdentifier) (*Session, error) {
+	session, err := cs.MemoryStore.Get(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return copySession(session), nil
+}
+
+func (cs *copyingStore) Touch(sessions []*Session) error {
+	cs.lock.Lock()
+	cs.touches++
+	cs.touched += len(sessions)
+	cs.lock.Unlock()
+	for _, session := range sessions {
+		stored, err := cs.MemoryStore.Get(session.ID)
+		if err != nil {
+			continue
+		}
+		stored.Refresh()
+	}
+	return nil
+}
+
+func (cs *copyingStore) SaveAttributes(session *Session) error {
+	if stored, err := cs.MemoryStore.Get(session.ID); err == nil {
+		stored.restoreAttributes(session.Attributes())
+	}
+	return nil
+}
+
+func (cs *copyingStore) counts() (int, int) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.touches, cs.touched
+}
+
+func TestSessionPool_RefreshThreshold(t *testing.T) {
+	store := newCopyingStore()
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            200 * time.Millisecond,
+		MultiLogin:         AllowNew,
+		Store:              store,
+		RefreshThreshold:   0.9,
+	})
+
+	session, err := pool.startSession(ap{false, true, true}, "remote1")
+	check(err, t)
+
+	time.Sleep(120 * time.Millisecond)
+	_, err = pool.getSession(session.ID)
+	check(err, t)
+	if touches, _ := store.counts(); touches != 0 {
+		t.Error("Refresh written before the threshold")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	_, err = pool.getSession(session.ID)
+	if err != nil {
+		t.Fatal("Expired computed from the stored value: ", err)
+	}
+	if touches, _ := store.counts(); touches != 1 {
+		t.Error("Refresh not written after the threshold")
+	}
+}
+
+func TestSessionPool_RefreshInterval(t *testing.T) {
+	store := newCopyingStore()
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+		RefreshInterval:    time.Hour,
+	})
+
+	principal := ap{false, true, true}
+	first, err := pool.startSession(principal, "remote1")
+	check(err, t)
+	second, err := pool.startSession(principal, "remote2")
+	check(err, t)
+
+	for i := 0; i < 3; i++ {
+		_, err = pool.getSession(first.ID)
+		check(err, t)
+		_, err = pool.getSession(second.ID)
+		check(err, t)
+	}
+	if touches, _ := store.counts(); touches != 0 {
+		t.Error("Refresh written before the interval")
+	}
+
+	check(pool.close(), t)
+	if touches, touched := store.counts(); touches != 1 || touched != 2 {
+		t.Errorf("Refreshes are not batched: %d writes of %d sessions", touches, touched)
+	}
+	check(pool.refresher.close(), t)
+}
+
+func TestSessionPool_RefreshThresholdPolicy(t *testing.T) {
+	store := newCopyingStore()
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            10 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+		RefreshThreshold:   0.5,
+	})
+	principal := pp{ap{false, true, true}, "user1", func(defaults SessionPolicy) SessionPolicy {
+		defaults.Timeout = 200 * time.Millisecond
+		return defaults
+	}}
+
+	session, err := pool.startSession(principal, "remote1")
+	check(err, t)
+	time.Sleep(120 * time.Millisecond)
+	_, err = pool.getSession(session.ID)
+	check(err, t)
+	if touches, _ := store.counts(); touches != 1 {
+		t.Error("Refresh is not written by the threshold of the policy timeout")
+	}
+}
@@ -0,0 +1,168 @@
+package porter
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+Error reply of a RESP server.
+*/
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+/*
+Connection speaking the subset of RESP2 used by RedisStore.
+
+Replies are decoded into string, int64, nil, []interface{} and respError values.
+*/
+type respConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+func dialRESP(address string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}, nil
+}
+
+/*
+Buffers the command as an array of bulk strings.
+*/
+func (c *respConn) write(args ...string) error {
+	c.writer.WriteByte('*')
+	c.writer.WriteString(strconv.Itoa(len(args)))
+	c.writer.WriteString("\r\n")
+	for _, arg := range args {
+		c.writer.WriteByte('$')
+		c.writer.WriteString(strconv.Itoa(len(arg)))
+		c.writer.WriteString("\r\n")
+		c.writer.WriteString(arg)
+		if _, err := c.writer.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Sends the buffered commands and reads one reply per command.
+Error replies are returned as values, the error is returned only on connection failures.
+*/
+func (c *respConn) pipeline(commands [][]string) ([]interface{}, error) {
+	if c.timeout > 0 {
+		if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	for _, command := range commands {
+		if err := c.write(command...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRESP(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+/*
+Sends the command and returns its reply, error replies are returned as errors.
+*/
+func (c *respConn) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := replies[0].(respError); ok {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+func (c *respConn) close() error {
+	return c.conn.Close()
+}
+
+func readRESPLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New(RESPProtocolError)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New(RESPProtocolError)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New(RESPProtocolError)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		buffer := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, buffer); err != nil {
+			return nil, err
+		}
+		return string(buffer[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New(RESPProtocolError)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			if values[i], err = readRESP(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.New(RESPProtocolError)
+}
@@ -0,0 +1,439 @@
+package porter
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+The maximum size of a revocation datagram.
+*/
+const revocationDatagramSize = 64 * 1024
+
+/*
+Removal of a session published by the pool removing it.
+*/
+type Revocation struct {
+	Realm       string `json:"realm"`
+	SID         string `json:"sid"`
+	PrincipalID string `json:"principal_id"`
+	/*
+		The pool the session is removed by, pools ignore their own revocations.
+	*/
+	Origin string `json:"origin"`
+	/*
+		The reason of the removal reported to the watchers of the session, see: SessionEventsHandler.
+		Empty is reported as ReasonRevoked.
+	*/
+	Reason string `json:"reason,omitempty"`
+}
+
+/*
+Delivers session removals between the instances sharing a session store,
+so the instances may drop the local copies of removed sessions immediately.
+Implementations must be safe for concurrent use.
+*/
+type RevocationBus interface {
+	/*
+		Delivers the revocation to all subscribers, including the subscribers of this instance.
+	*/
+	Publish(revocation Revocation) error
+	/*
+		Calls the function for every published revocation until the returned function is called.
+	*/
+	Subscribe(fn func(revocation Revocation)) func()
+}
+
+/*
+SessionStore keeping local copies of the sessions of a shared store.
+The pool invalidates the copies of the sessions removed by other instances.
+*/
+type InvalidatingStore interface {
+	Invalidate(realm string, sid string)
+}
+
+type revocationSubscribers struct {
+	lock        sync.RWMutex
+	next        int
+	subscribers map[int]func(revocation Revocation)
+}
+
+func (s *revocationSubscribers) subscribe(fn func(revocation Revocation)) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = map[int]func(revocation Revocation){}
+	}
+	id := s.next
+	s.next++
+	s.subscribers[id] = fn
+	return func() {
+		s.lock.Lock()
+		delete(s.subscribers, id)
+		s.lock.Unlock()
+	}
+}
+
+func (s *revocationSubscribers) deliver(revocation Revocation) {
+	s.lock.RLock()
+	subscribers := make([]func(revocation Revocation), 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	s.lock.RUnlock()
+	for _, fn := range subscribers {
+		fn(revocation)
+	}
+}
+
+/*
+RevocationBus delivering revocations between the pools of one process.
+*/
+type LocalRevocationBus struct {
+	subscribers revocationSubscribers
+}
+
+func NewLocalRevocationBus() *LocalRevocationBus {
+	return &LocalRevocationBus{}
+}
+
+func (b *LocalRevocationBus) Publish(revocation Revocation) error {
+	b.subscribers.deliver(revocation)
+	return nil
+}
+
+func (b *LocalRevocationBus) Subscribe(fn func(revocation Revocation)) func() {
+	return b.subscribers.subscribe(fn)
+}
+
+type PeerRevocationBusOptions struct {
+	/*
+		"udp" or "tcp". Defaults to "udp".
+	*/
+	Network string
+	/*
+		The address the bus listens on for the revocations of the peers.
+		Port zero selects a free port, see: PeerRevocationBus.Address
+	*/
+	Address string
+	/*
+		The addresses of the buses of the other instances.
+	*/
+	Peers []string
+	/*
+		The timeout of dialing and writing to a peer. Defaults to 2 seconds.
+	*/
+	IOTimeout time.Duration
+	/*
+		The secret shared by all buses signing the revocations with HMAC-SHA256.
+		Revocations of a wrong signature are dropped.
+	*/
+	Key []byte
+	/*
+		The number of revocations waiting to be sent to the peers. Defaults to 1024.
+	*/
+	QueueSize int
+}
+
+/*
+A revocation signed by the key of the buses.
+*/
+type signedRevocation struct {
+	Revocation json.RawMessage `json:"revocation"`
+	MAC        []byte          `json:"mac"`
+}
+
+/*
+RevocationBus sending revocations to the buses of the other instances as JSON,
+one datagram per revocation over UDP or one line per revocation over TCP.
+Delivery is best effort: revocations published while a peer is unreachable are lost for the peer.
+
+Revocations are sent by a background goroutine from a bounded queue,
+so an unreachable peer delays the revocations but never the publishing pool.
+A revocation published while the queue is full is delivered locally only.
+Every revocation is signed by PeerRevocationBusOptions.Key, so the listener cannot be used to end sessions
+or to report their end to the event streams. A replayed revocation names a session already removed.
+*/
+type PeerRevocationBus struct {
+	options     PeerRevocationBusOptions
+	subscribers revocationSubscribers
+	packets     net.PacketConn
+	listener    net.Listener
+	address     string
+
+	lock  sync.Mutex
+	peers []string
+	conns map[string]net.Conn
+	queue chan []byte
+	stop  chan struct{}
+
+	acceptedLock sync.Mutex
+	accepted     map[net.Conn]bool
+	closed       bool
+	done         sync.WaitGroup
+}
+
+/*
+Starts listening for the revocations of the peers. Returns the KeyRequired error if the key is not set.
+*/
+func NewPeerRevocationBus(options PeerRevocationBusOptions) (*PeerRevocationBus, error) {
+	if len(options.Key) == 0 {
+		return nil, errors.New(KeyRequired)
+	}
+	if options.Network == "" {
+		options.Network = "udp"
+	}
+	if options.IOTimeout <= 0 {
+		options.IOTimeout = 2 * time.Second
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = 1024
+	}
+	bus := &PeerRevocationBus{
+		options:  options,
+		conns:    map[string]net.Conn{},
+		queue:    make(chan []byte, options.QueueSize),
+		stop:     make(chan struct{}),
+		accepted: map[net.Conn]bool{},
+	}
+	bus.SetPeers(options.Peers)
+	if options.Network == "tcp" {
+		listener, err := net.Listen("tcp", options.Address)
+		if err != nil {
+			return nil, err
+		}
+		bus.listener = listener
+		bus.address = listener.Addr().String()
+		bus.done.Add(1)
+		go bus.accept()
+	} else {
+		packets, err := net.ListenPacket(options.Network, options.Address)
+		if err != nil {
+			return nil, err
+		}
+		bus.packets = packets
+		bus.address = packets.LocalAddr().String()
+		bus.done.Add(1)
+		go bus.receive()
+	}
+	bus.done.Add(1)
+	go bus.run()
+	return bus, nil
+}
+
+/*
+Returns the address the bus listens on.
+*/
+func (b *PeerRevocationBus) Address() string {
+	return b.address
+}
+
+/*
+Replaces the addresses of the buses of the other instances.
+*/
+func (b *PeerRevocationBus) SetPeers(peers []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.peers = append([]string{}, peers...)
+	for address, conn := range b.conns {
+		conn.Close()
+		delete(b.conns, address)
+	}
+}
+
+func (b *PeerRevocationBus) Subscribe(fn func(revocation Revocation)) func() {
+	return b.subscribers.subscribe(fn)
+}
+
+func (b *PeerRevocationBus) mac(data []byte) []byte {
+	hash := hmac.New(sha256.New, b.options.Key)
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+/*
+Returns the revocation of the signed message, FALSE if the signature is wrong.
+*/
+func (b *PeerRevocationBus) verify(signed *signedRevocation) (Revocation, bool) {
+	revocation := Revocation{}
+	if !hmac.Equal(signed.MAC, b.mac(signed.Revocation)) {
+		return revocation, false
+	}
+	return revocation, json.Unmarshal(signed.Revocation, &revocation) == nil
+}
+
+/*
+Delivers the revocation to the local subscribers and queues it for the peers.
+Returns the RevocationQueueFull error if the queue is full.
+*/
+func (b *PeerRevocationBus) Publish(revocation Revocation) error {
+	b.subscribers.deliver(revocation)
+	data, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(&signedRevocation{Revocation: data, MAC: b.mac(data)})
+	if err != nil {
+		return err
+	}
+	select {
+	case b.queue <- data:
+		return nil
+	default:
+		return errors.New(RevocationQueueFull)
+	}
+}
+
+/*
+Sends the queued revocations to all peers until the bus is closed.
+*/
+func (b *PeerRevocationBus) run() {
+	defer b.done.Done()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case data := <-b.queue:
+			b.sendAll(data)
+		}
+	}
+}
+
+func (b *PeerRevocationBus) sendAll(data []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, address := range b.peers {
+		if address == b.address {
+			continue
+		}
+		_ = b.send(address, data)
+	}
+}
+
+func (b *PeerRevocationBus) send(address string, data []byte) error {
+	if b.packets != nil {
+		peer, err := net.ResolveUDPAddr(b.options.Network, address)
+		if err != nil {
+			return err
+		}
+		_, err = b.packets.WriteTo(data, peer)
+		return err
+	}
+	line := append(append([]byte{}, data...), '\n')
+	for attempt := 0; ; attempt++ {
+		conn, reused := b.conns[address]
+		if !reused {
+			var err error
+			if conn, err = net.DialTimeout("tcp", address, b.options.IOTimeout); err != nil {
+				return err
+			}
+			b.conns[address] = conn
+		}
+		err := conn.SetWriteDeadline(time.Now().Add(b.options.IOTimeout))
+		if err == nil {
+			_, err = conn.Write(line)
+		}
+		if err == nil {
+			return nil
+		}
+		conn.Close()
+		delete(b.conns, address)
+		if !reused || attempt > 0 {
+			return err
+		}
+	}
+}
+
+func (b *PeerRevocationBus) receive() {
+	defer b.done.Done()
+	buffer := make([]byte, revocationDatagramSize)
+	for {
+		n, _, err := b.packets.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		signed := &signedRevocation{}
+		if json.Unmarshal(buffer[:n], signed) != nil {
+			continue
+		}
+		if revocation, ok := b.verify(signed); ok {
+			b.subscribers.deliver(revocation)
+		}
+	}
+}
+
+func (b *PeerRevocationBus) accept() {
+	defer b.done.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.acceptedLock.Lock()
+		if b.closed {
+			b.acceptedLock.Unlock()
+			conn.Close()
+			return
+		}
+		b.accepted[conn] = true
+		b.done.Add(1)
+		b.acceptedLock.Unlock()
+		go b.read(conn)
+	}
+}
+
+func (b *PeerRevocationBus) read(conn net.Conn) {
+	defer func() {
+		b.acceptedLock.Lock()
+		delete(b.accepted, conn)
+		b.acceptedLock.Unlock()
+		conn.Close()
+		b.done.Done()
+	}()
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		signed := &signedRevocation{}
+		if err := decoder.Decode(signed); err != nil {
+			return
+		}
+		revocation, ok := b.verify(signed)
+		if !ok {
+			return
+		}
+		b.subscribers.deliver(revocation)
+	}
+}
+
+/*
+Stops listening and closes the connections.
+*/
+func (b *PeerRevocationBus) Close() error {
+	var err error
+	b.acceptedLock.Lock()
+	if b.closed {
+		b.acceptedLock.Unlock()
+		return nil
+	}
+	b.closed = true
+	if b.listener != nil {
+		err = b.listener.Close()
+	}
+	if b.packets != nil {
+		err = b.packets.Close()
+	}
+	for conn := range b.accepted {
+		conn.Close()
+	}
+	b.acceptedLock.Unlock()
+
+	close(b.stop)
+	b.SetPeers(nil)
+	b.done.Wait()
+	return err
+}
@@ -0,0 +1,227 @@
+package porter
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var revocationKey = []byte("revocation key")
+
+/*
+Shared store with a local copy per instance.
+*/
+type invalidatingStore struct {
+	*copyingStore
+	lock        sync.Mutex
+	invalidated []string
+}
+
+func (is *invalidatingStore) Invalidate(realm string, sid string) {
+	is.lock.Lock()
+	is.invalidated = append(is.invalidated, realm+"/"+sid)
+	is.lock.Unlock()
+}
+
+func (is *invalidatingStore) invalidations() []string {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	return append([]string{}, is.invalidated...)
+}
+
+func newRevocationPool(realm string, store SessionStore, bus RevocationBus) *SessionPool {
+	return newSessionPool(&sessionConfiguration{
+		Realm:              realm,
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+		RefreshInterval:    time.Hour,
+		RevocationBus:      bus,
+	})
+}
+
+func TestSessionPool_RevocationBus(t *testing.T) {
+	bus := NewLocalRevocationBus()
+	shared := newCopyingStore()
+	first := &invalidatingStore{copyingStore: shared}
+	second := &invalidatingStore{copyingStore: shared}
+	other := &invalidatingStore{copyingStore: shared}
+	firstPool := newRevocationPool(DefaultRealm, first, bus)
+	secondPool := newRevocationPool(DefaultRealm, second, bus)
+	otherPool := newRevocationPool("other", other, bus)
+	defer firstPool.close()
+	defer secondPool.close()
+
+	session, err := firstPool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	time.Sleep(time.Millisecond)
+	_, err = secondPool.getSession(session.ID)
+	check(err, t)
+	if len(secondPool.refresher.dirty) != 1 {
+		t.Fatal("Refresh is not pending")
+	}
+
+	ended, stop := secondPool.watchers.watch(session.ID.SID)
+	defer stop()
+	firstPool.removeSession(session)
+	select {
+	case reason := <-ended:
+		if reason != ReasonLogout {
+			t.Errorf("Unexpected reason %s", reason)
+		}
+	default:
+		t.Error("Watcher is not notified")
+	}
+	if invalidated := second.invalidations(); len(invalidated) != 1 || invalidated[0] != "/"+session.ID.SID {
+		t.Errorf("Local copy is not invalidated: %v", invalidated)
+	}
+	if len(first.invalidations()) != 0 {
+		t.Error("Own revocation is not ignored")
+	}
+	if len(other.invalidations()) != 0 {
+		t.Error("Revocation of another realm is not ignored")
+	}
+	secondPool.refresher.lock.Lock()
+	_, dirty := secondPool.refresher.dirty[session.ID.SID]
+	secondPool.refresher.lock.Unlock()
+	if dirty {
+		t.Error("Pending refresh of the revoked session is not dropped")
+	}
+
+	otherPool.close()
+	session, err = firstPool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	firstPool.removeSession(session)
+	if len(other.invalidations()) != 0 {
+		t.Error("Closed pool is still subscribed")
+	}
+}
+
+func testPeerRevocationBus(t *testing.T, network string) {
+	first, err := NewPeerRevocationBus(PeerRevocationBusOptions{Network: network, Address: "127.0.0.1:0", Key: revocationKey})
+	check(err, t)
+	defer first.Close()
+	second, err := NewPeerRevocationBus(PeerRevocationBusOptions{Network: network, Address: "127.0.0.1:0", Key: revocationKey})
+	check(err, t)
+	defer second.Close()
+	first.SetPeers([]string{first.Address(), second.Address()})
+
+	local := make(chan Revocation, 4)
+	remote := make(chan Revocation, 4)
+	first.Subscribe(func(revocation Revocation) {
+		local <- revocation
+	})
+	unsubscribe := second.Subscribe(func(revocation Revocation) {
+		remote <- revocation
+	})
+
+	published := Revocation{Realm: "realm", SID: NewToken(), PrincipalID: "id", Origin: "first", Reason: ReasonTimeout}
+	check(first.Publish(published), t)
+	for name, received := range map[string]chan Revocation{"local": local, "remote": remote} {
+		select {
+		case revocation := <-received:
+			if revocation != published {
+				t.Errorf("Unexpected %s revocation %v", name, revocation)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Revocation is not delivered to the %s subscriber", name)
+		}
+	}
+
+	conn, err := net.Dial(network, second.Address())
+	check(err, t)
+	_, err = conn.Write([]byte(`{"realm":"realm","sid":"forged","principal_id":"id","origin":"attacker"}` + "\n"))
+	check(err, t)
+	_, err = conn.Write([]byte(`{"revocation":{"realm":"realm","sid":"forged","principal_id":"id","origin":"attacker"},"mac":""}` + "\n"))
+	conn.Close()
+	select {
+	case revocation := <-remote:
+		t.Errorf("Unsigned revocation delivered %v", revocation)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unsubscribe()
+	check(first.Publish(published), t)
+	<-local
+	select {
+	case <-remote:
+		t.Error("Revocation delivered after unsubscribing")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeerRevocationBus_UDP(t *testing.T) {
+	testPeerRevocationBus(t, "udp")
+}
+
+func TestPeerRevocationBus_TCP(t *testing.T) {
+	testPeerRevocationBus(t, "tcp")
+}
+
+func TestPeerRevocationBus_Queue(t *testing.T) {
+	if _, err := NewPeerRevocationBus(PeerRevocationBusOptions{Address: "127.0.0.1:0"}); err == nil || err.Error() != KeyRequired {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	bus, err := NewPeerRevocationBus(PeerRevocationBusOptions{Address: "127.0.0.1:0", Key: revocationKey, QueueSize: 1})
+	check(err, t)
+	defer bus.Close()
+	bus.SetPeers([]string{"127.0.0.1:9"})
+
+	bus.lock.Lock()
+	full := false
+	for i := 0; i < 3 && !full; i++ {
+		err = bus.Publish(Revocation{Realm: "realm", SID: NewToken(), PrincipalID: "id"})
+		full = err != nil && err.Error() == RevocationQueueFull
+	}
+	bus.lock.Unlock()
+	if !full {
+		t.Error("Queue is not bounded")
+	}
+}
+
+/*
+Bus blocking the publishing until released.
+*/
+type blockingRevocationBus struct {
+	LocalRevocationBus
+	release chan struct{}
+}
+
+func (b *blockingRevocationBus) Publish(revocation Revocation) error {
+	<-b.release
+	return b.LocalRevocationBus.Publish(revocation)
+}
+
+func TestSessionPool_PublishUnlocked(t *testing.T) {
+	bus := &blockingRevocationBus{release: make(chan struct{})}
+	pool := newRevocationPool(DefaultRealm, NewMemoryStore(0), bus)
+	defer pool.close()
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+
+	ended := make(chan struct{})
+	go func() {
+		pool.removeSession(session)
+		close(ended)
+	}()
+	waitFor(t, func() bool {
+		_, err := pool.store.Get(session.ID)
+		return err != nil
+	})
+	started := make(chan error, 1)
+	go func() {
+		_, err := pool.startSession(fileStorePrincipal, "remote1")
+		started <- err
+	}()
+	select {
+	case err = <-started:
+		check(err, t)
+	case <-time.After(time.Second):
+		t.Error("Principal lock is held while the removal is published")
+	}
+	close(bus.release)
+	<-ended
+}
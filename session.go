@@ -2,6 +2,7 @@ package porter
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -15,35 +16,161 @@ type Session struct {
 	expirationTime time.Time
 	refreshTime    time.Time
 	Principal      AuthenticationPrincipal
+	/*
+		The refresh time written to the session store.
+	*/
+	storedRefreshTime time.Time
+	attributes        map[string]string
+	/*
+		The revision of the session in the store, used for optimistic concurrency.
+	*/
+	revision int64
+	lock     sync.RWMutex
 }
 
 type SessionIdentifier struct {
 	SID           string
 	SSID          string
 	RemoteAddress string
+	/*
+		The name of the realm the session belongs to.
+	*/
+	Realm string
 }
 
 /*
 	Return "true" if session expired.
 */
 func (s *Session) Expired(configuration *sessionConfiguration) bool {
+	return s.expiredBy(configuration) != ""
+}
+
+/*
+	Returns the reason of the expiration, empty if the session is not expired.
+*/
+func (s *Session) expiredBy(configuration *sessionConfiguration) string {
 	if s.closed {
-		return true
+		return ReasonLogout
 	}
 
-	if (!s.Principal.SaveSession() || configuration.ForceExpire) && s.refreshTime.Add(configuration.Timeout).Before(time.Now()) {
-		configuration.Logger.Printf("Session for user %s [%s] expired by timeout.\n", s.Principal.ID(), s.ID.RemoteAddress)
-		return true
+	timeout := configuration.policyFor(s.Principal).Timeout
+	if (!s.Principal.SaveSession() || configuration.ForceExpire) && s.lastRefresh().Add(timeout).Before(time.Now()) {
+		return ReasonTimeout
 	}
 	if s.expirationTime.Before(time.Now()) {
-		configuration.Logger.Printf("Session for user %s [%s] expired.", s.Principal.ID(), s.ID.RemoteAddress)
-		return true
+		return ReasonAbsolute
 	}
-	return false
+	return ""
 }
 
 func (s *Session) Refresh() {
+	s.lock.Lock()
 	s.refreshTime = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *Session) lastRefresh() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.refreshTime
+}
+
+/*
+	Applies the refresh time known locally if it is newer than the loaded one.
+*/
+func (s *Session) restoreRefresh(refreshTime time.Time) {
+	s.lock.Lock()
+	if refreshTime.After(s.refreshTime) {
+		s.refreshTime = refreshTime
+	}
+	s.lock.Unlock()
+}
+
+/*
+	Marks the refresh time as written to the session store.
+*/
+func (s *Session) stored(refreshTime time.Time) {
+	s.lock.Lock()
+	if refreshTime.After(s.storedRefreshTime) {
+		s.storedRefreshTime = refreshTime
+	}
+	s.lock.Unlock()
+}
+
+/*
+	Returns how long the refresh time has not been written to the session store.
+*/
+func (s *Session) unstored() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.refreshTime.Sub(s.storedRefreshTime)
+}
+
+func (s *Session) currentRevision() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.revision
+}
+
+func (s *Session) setRevision(revision int64) {
+	s.lock.Lock()
+	s.revision = revision
+	s.lock.Unlock()
+}
+
+/*
+	Sets the attribute of the session.
+	Attributes are kept by the session store together with the session,
+	the change of a saved session is persisted by Realm.SetAttribute.
+*/
+func (s *Session) SetAttribute(key string, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.attributes == nil {
+		s.attributes = map[string]string{}
+	}
+	s.attributes[key] = value
+}
+
+func (s *Session) removeAttribute(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.attributes, key)
+}
+
+/*
+	Replaces all attributes of the session with the stored ones.
+*/
+func (s *Session) restoreAttributes(attributes map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+	s.attributes = attributes
+}
+
+/*
+	Returns the attribute of the session.
+*/
+func (s *Session) Attribute(key string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok := s.attributes[key]
+	return value, ok
+}
+
+/*
+	Returns a copy of all attributes of the session.
+*/
+func (s *Session) Attributes() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	attributes := make(map[string]string, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	return attributes
 }
 
 func (s *Session) String() string {
@@ -7,7 +7,7 @@ import (
 	"time"
 )
 
-var testingLogger = log.New(os.Stdout, "", log.LstdFlags)
+var testingLogger = NewLogLogger(log.New(os.Stdout, "", log.LstdFlags))
 
 var blank = SessionIdentifier{
 	SID:           "",
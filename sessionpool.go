@@ -1,47 +1,238 @@
 package porter
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
+/*
+	Applies the session policies to the sessions kept in a SessionStore.
+	Session creation is serialized per principal by lock stripes selected by the principal ID hash.
+*/
 type SessionPool struct {
-	bySessionID   map[SessionIdentifier]*Session
-	byPrincipalId map[string]map[SessionIdentifier]*Session
-	lock          sync.RWMutex
+	store         SessionStore
+	refresher     *refresher
+	sweeper       *sweeper
+	locks         []sync.Mutex
 	configuration *sessionConfiguration
+	origin        string
+	unsubscribe   func()
+	watchers      sessionWatchers
 }
 
 func newSessionPool(configuration *sessionConfiguration) *SessionPool {
-	return &SessionPool{
-		byPrincipalId: map[string]map[SessionIdentifier]*Session{},
-		bySessionID:   map[SessionIdentifier]*Session{},
+	store := configuration.Store
+	if store == nil {
+		store = NewMemoryStore(configuration.Shards)
+	}
+	sp := &SessionPool{
+		store:         store,
+		refresher:     newRefresher(store, configuration),
+		locks:         make([]sync.Mutex, shardCount(configuration.Shards)),
 		configuration: configuration,
+		origin:        NewToken(),
+	}
+	if len(configuration.DeviceKey) == 0 {
+		configuration.DeviceKey = generateRandom(32)
+	}
+	if configuration.RevocationBus != nil {
+		sp.unsubscribe = configuration.RevocationBus.Subscribe(sp.revoked)
+	}
+	sp.sweeper = newSweeper(sp, configuration.SweepInterval)
+	return sp
+}
+
+/*
+	Drops the local state of a session removed by another instance.
+*/
+func (sp *SessionPool) revoked(revocation Revocation) {
+	if revocation.Origin == sp.origin || revocation.Realm != sp.configuration.Realm {
+		return
+	}
+	if sp.refresher != nil {
+		sp.refresher.forget(revocation.SID)
+	}
+	if store, ok := sp.store.(InvalidatingStore); ok {
+		store.Invalidate(revocation.Realm, revocation.SID)
+	}
+	reason := revocation.Reason
+	if reason == "" {
+		reason = ReasonRevoked
+	}
+	sp.watchers.ended(revocation.SID, reason)
+}
+
+/*
+	The removed session and the reason of the removal.
+*/
+type removal struct {
+	session *Session
+	reason  string
+}
+
+func removalsOf(sessions []*Session, reason string) []removal {
+	removals := make([]removal, len(sessions))
+	for i, session := range sessions {
+		removals[i] = removal{session, reason}
+	}
+	return removals
+}
+
+/*
+	Publishes the removals of the sessions to the other instances.
+	Called after the principal lock is released, so a slow bus does not block the logins of the principal.
+*/
+func (sp *SessionPool) publishRemovals(removals ...removal) {
+	if sp.configuration.RevocationBus == nil {
+		return
+	}
+	for _, removal := range removals {
+		session := removal.session
+		err := sp.configuration.RevocationBus.Publish(Revocation{
+			Realm:       session.ID.Realm,
+			SID:         session.ID.SID,
+			PrincipalID: session.Principal.ID(),
+			Origin:      sp.origin,
+			Reason:      removal.reason,
+		})
+		if err != nil {
+			sp.configuration.logger().Warn("Revocation not published", sessionFields(session, "error", err)...)
+		}
+	}
+}
+
+func (sp *SessionPool) principalLock(principalId string) *sync.Mutex {
+	return &sp.locks[shardHash(principalId)%uint32(len(sp.locks))]
+}
+
+/*
+	Finds the session by the SID and SSID of the identifier. The remote address is checked by checkBinding.
+*/
+func (sp *SessionPool) findSession(ctx context.Context, sessionId SessionIdentifier) (*Session, error) {
+	if sessionId.Realm != sp.configuration.Realm {
+		return nil, errors.New(SessionNotFound)
+	}
+	_, span := sp.startSpan(ctx, SpanStoreGet)
+	session, err := sp.store.Get(sessionId)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
 	}
+	if session.ID.SSID != sessionId.SSID {
+		err = errors.New(SessionNotFound)
+		sp.inspect(Observation{Kind: ObservationAuthenticationFailed, Session: session, RemoteAddress: NormalizeAddress(sessionId.RemoteAddress), Err: err})
+		return nil, err
+	}
+	if sp.refresher != nil {
+		sp.refresher.restore(session)
+	}
+	return session, nil
 }
 
 func (sp *SessionPool) startSession(principal AuthenticationPrincipal, remoteAddress string) (*Session, error) {
-	return sp.newSession(principal, remoteAddress)
+	return sp.newSession(context.Background(), principal, remoteAddress, nil)
 }
 
 func (sp *SessionPool) getSession(sessionId SessionIdentifier) (*Session, error) {
-	sp.lock.RLock()
-	session, ok := sp.bySessionID[sessionId]
-	sp.lock.RUnlock()
+	return sp.getSessionContext(context.Background(), sessionId, "", nil)
+}
 
-	if !ok {
-		return nil, errors.New(SessionNotFound)
+/*
+	Finds and refreshes the session within the Authenticate span.
+	The user agent is checked with Configuration.BindUserAgent, empty skips the check.
+	The found session is admitted by the function, if any, before it is refreshed.
+*/
+func (sp *SessionPool) authenticate(ctx context.Context, sessionId SessionIdentifier, userAgent string, admit func(session *Session) error) (*Session, error) {
+	ctx, span := sp.startSpan(ctx, SpanAuthenticate)
+	session, err := sp.getSessionContext(ctx, sessionId, userAgent, admit)
+	if err != nil {
+		reason := err.Error()
+		switch reason {
+		case SessionNotFound, SessionExpired, SessionBindingViolation, SessionRevoked, StepUpRequired, AddressNotAllowed, RateLimited:
+		default:
+			reason = ReasonStore
+		}
+		span.SetAttribute(AttributeReason, reason)
+	} else {
+		span.SetAttribute(AttributePrincipalID, session.Principal.ID())
 	}
+	endSpan(span, err)
+	return session, err
+}
 
-	if session.Expired(sp.configuration) {
-		sp.removeSession(session)
-		return nil, errors.New(SessionExpired)
+func (sp *SessionPool) getSessionContext(ctx context.Context, sessionId SessionIdentifier, userAgent string, admit func(session *Session) error) (*Session, error) {
+	session, err := sp.lookupSession(ctx, sessionId, userAgent)
+	if err != nil {
+		return nil, err
 	}
+	if admit != nil {
+		if err = admit(session); err != nil {
+			return nil, err
+		}
+	}
+	if sp.inspect(Observation{Kind: ObservationAuthentication, Session: session, RemoteAddress: NormalizeAddress(sessionId.RemoteAddress)}) == ActionRevoke {
+		return nil, errors.New(SessionRevoked)
+	}
+	sp.recordAddress(session, sessionId.RemoteAddress)
 	session.Refresh()
+	sp.refresh(ctx, session)
+	return session, stepUpRequired(session)
+}
+
+/*
+	Finds the session and checks its binding, network and expiration without refreshing it.
+*/
+func (sp *SessionPool) lookupSession(ctx context.Context, sessionId SessionIdentifier, userAgent string) (*Session, error) {
+	session, err := sp.findSession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if err = sp.checkBinding(session, sessionId, userAgent); err != nil {
+		return nil, err
+	}
+	if err = sp.checkSessionNetwork(session, sessionId.RemoteAddress); err != nil {
+		return nil, err
+	}
+
+	if reason := session.expiredBy(sp.configuration); reason != "" {
+		sp.configuration.logger().Info("Session expired", sessionFields(session, "reason", reason)...)
+		sp.endSession(ctx, session, reason)
+		return nil, errors.New(SessionExpired)
+	}
 	return session, nil
 }
 
+/*
+	Writes the refresh time to the store, coalescing writes if configured.
+*/
+func (sp *SessionPool) refresh(ctx context.Context, session *Session) {
+	_, span := sp.startSpan(ctx, SpanStoreTouch)
+	var err error
+	if sp.refresher != nil {
+		err = sp.refresher.refreshed(session)
+	} else {
+		err = sp.store.Touch([]*Session{session})
+	}
+	endSpan(span, err)
+	if err != nil {
+		sp.configuration.logger().Warn("Refresh failed", sessionFields(session, "error", err)...)
+	}
+}
+
+/*
+	Writes the attributes of the session to the store.
+*/
+func (sp *SessionPool) saveAttributes(session *Session) error {
+	err := sp.store.SaveAttributes(session)
+	if err != nil {
+		sp.configuration.logger().Warn("Saving attributes failed", sessionFields(session, "error", err)...)
+	}
+	return err
+}
+
 func (sp *SessionPool) stopSession(sessionId SessionIdentifier) error {
 	return sp.removeSessionById(sessionId)
 }
@@ -50,96 +241,227 @@ func (sp *SessionPool) stopSession(sessionId SessionIdentifier) error {
 	Remove session from sessions pool.
 */
 func (sp *SessionPool) removeSessionById(sessionId SessionIdentifier) error {
-	sp.lock.RLock()
-	session, ok := sp.bySessionID[sessionId]
-	sp.lock.RUnlock()
-	if ok {
-		sp.removeSession(session)
-		return nil
-	} else {
-		sp.configuration.Logger.Printf("Session for ID: %s-%s-%s not found.", sessionId.SID, sessionId.SSID, sessionId.RemoteAddress)
-		return errors.New(SessionNotFound)
+	session, err := sp.findSession(context.Background(), sessionId)
+	if err != nil {
+		sp.configuration.logger().Debug("Session not found", "remote_addr", sessionId.RemoteAddress, "session_fp", SessionFingerprint(sessionId))
+		return err
+	}
+	if err = sp.checkBinding(session, sessionId, ""); err != nil {
+		return err
 	}
+	sp.removeSession(session)
+	return nil
 }
 
 /*
 	Find and remove session from.
 */
 func (sp *SessionPool) removeSession(session *Session) {
-	sp.lock.Lock()
-	defer sp.lock.Unlock()
-	sp.removeSessionUnsafe(session)
+	sp.endSession(context.Background(), session, ReasonLogout)
+}
+
+/*
+	Removes the session for the reason reported to the event listeners.
+*/
+func (sp *SessionPool) endSession(ctx context.Context, session *Session, reason string) {
+	lock := sp.principalLock(session.Principal.ID())
+	lock.Lock()
+	sp.removeSessionUnsafe(ctx, session, reason)
+	lock.Unlock()
+	sp.publishRemovals(removal{session, reason})
 }
 
-func (sp *SessionPool) newSession(principal AuthenticationPrincipal, address string) (*Session, error) {
-	session := sp.prepareNew(principal, address)
-	sp.lock.Lock()
-	defer sp.lock.Unlock()
+/*
+	Removes the session of the realm by the SID.
+*/
+func (sp *SessionPool) revokeSession(sid string) error {
+	session, err := sp.store.Get(SessionIdentifier{SID: sid, Realm: sp.configuration.Realm})
+	if err != nil {
+		return err
+	}
+	sp.endSession(context.Background(), session, ReasonRevoked)
+	return nil
+}
+
+/*
+	Removes all sessions of the principal. Returns the number of removed sessions.
+*/
+func (sp *SessionPool) revokePrincipal(principalId string, reason string) (int, error) {
+	lock := sp.principalLock(principalId)
+	lock.Lock()
+	sessions, err := sp.store.ByPrincipal(sp.configuration.Realm, principalId)
+	if err != nil {
+		lock.Unlock()
+		return 0, err
+	}
+	sp.removeAllUnsafe(context.Background(), sessions, reason)
+	lock.Unlock()
+	sp.publishRemovals(removalsOf(sessions, reason)...)
+	return len(sessions), nil
+}
 
-	sessions := sp.getSessions(principal)
+/*
+	Calls the function for every session of the realm until it returns FALSE.
+*/
+func (sp *SessionPool) rangeSessions(fn func(session *Session) bool) error {
+	return sp.store.Range(func(session *Session) bool {
+		if session.ID.Realm != sp.configuration.Realm {
+			return true
+		}
+		return fn(session)
+	})
+}
 
+/*
+	Starts the session of the principal with the attributes.
+*/
+func (sp *SessionPool) newSession(ctx context.Context, principal AuthenticationPrincipal, address string, attributes map[string]string) (*Session, error) {
+	ctx, span := sp.startSpan(ctx, SpanNewSession)
+	span.SetAttribute(AttributePrincipalID, principal.ID())
+	session, err := sp.createSession(ctx, span, principal, address, attributes)
+	endSpan(span, err)
+	return session, err
+}
+
+func (sp *SessionPool) createSession(ctx context.Context, span Span, principal AuthenticationPrincipal, address string, attributes map[string]string) (*Session, error) {
+	policy := sp.configuration.policyFor(principal)
+	span.SetAttribute(AttributeMultiLogin, policy.MultiLogin.String())
+	session := sp.prepareNew(principal, address, policy)
+	session.attributes = attributes
+	lock := sp.principalLock(principal.ID())
+	removed := []removal{}
+	defer func() {
+		sp.publishRemovals(removed...)
+	}()
+	_, lockSpan := sp.startSpan(ctx, SpanPrincipalLock)
+	lock.Lock()
+	lockSpan.End()
+	defer lock.Unlock()
+
+	_, storeSpan := sp.startSpan(ctx, SpanStoreByPrincipal)
+	sessions, err := sp.store.ByPrincipal(sp.configuration.Realm, principal.ID())
+	endSpan(storeSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	reject := func() (*Session, error) {
+		span.SetAttribute(AttributeMultiLoginDecision, "reject")
+		span.SetAttribute(AttributeReason, ReasonAlreadyStarted)
+		sp.configuration.logger().Info("Login rejected", "principal_id", principal.ID(), "remote_addr", address, "reason", ReasonAlreadyStarted)
+		return nil, errors.New(SessionAlreadyStarted)
+	}
+	decision := "none"
+	evicted := 0
 	if len(sessions) > 0 {
-		switch sp.configuration.MultiLogin {
+		decision = "allow"
+		switch policy.MultiLogin {
 		case ExpireCurrent:
 			{
-				sp.removeAllUnsafe(sessions)
+				decision = "expire_current"
+				evicted += len(sessions)
+				sp.removeAllUnsafe(ctx, sessions, ReasonMultiLogin)
+				removed = append(removed, removalsOf(sessions, ReasonMultiLogin)...)
+				sessions = nil
 			}
 		case FailNew:
 			{
-				sp.configuration.Logger.Printf("Session already started for this principal [%s].", principal.ID())
-				return nil, errors.New(SessionAlreadyStarted)
+				return reject()
 			}
 		case AllowNew:
 			{
 				if !principal.AllowMultiLogin() {
-					sp.configuration.Logger.Printf("Session already started for this principal [%s].", principal.ID())
-					return nil, errors.New(SessionAlreadyStarted)
+					return reject()
 				}
 			}
 		case AllowNewFromSameAddress:
 			{
 				if !principal.AllowMultiLogin() {
-					sp.configuration.Logger.Printf("Session already started for this principal [%s].", principal.ID())
-					return nil, errors.New(SessionAlreadyStarted)
+					return reject()
 				} else {
 					forRemoving := []*Session{}
+					remaining := []*Session{}
 					for _, s := range sessions {
-						if s.ID.RemoteAddress != address {
+						if !sameAddress(s.ID.RemoteAddress, address) {
 							forRemoving = append(forRemoving, s)
+						} else {
+							remaining = append(remaining, s)
 						}
 					}
-					sp.removeAllUnsafe(forRemoving)
+					if len(forRemoving) > 0 {
+						decision = "expire_other_addresses"
+					}
+					evicted += len(forRemoving)
+					sp.removeAllUnsafe(ctx, forRemoving, ReasonMultiLogin)
+					removed = append(removed, removalsOf(forRemoving, ReasonMultiLogin)...)
+					sessions = remaining
 				}
 			}
 		}
 	}
 
-	_ms, ok := sp.byPrincipalId[principal.ID()]
-	if !ok {
-		newMap := map[SessionIdentifier]*Session{}
-		newMap[session.ID] = session
-		sp.byPrincipalId[principal.ID()] = newMap
-	} else {
-		_ms[session.ID] = session
+	if policy.MaxSessions > 0 && len(sessions) >= policy.MaxSessions {
+		evictions := leastRecentlyRefreshed(sessions, len(sessions)-policy.MaxSessions+1)
+		evicted += len(evictions)
+		sp.removeAllUnsafe(ctx, evictions, ReasonMaxSessions)
+		removed = append(removed, removalsOf(evictions, ReasonMaxSessions)...)
 	}
-	sp.bySessionID[session.ID] = session
+	span.SetAttribute(AttributeMultiLoginDecision, decision)
+	span.SetAttribute(AttributeEvicted, evicted)
 
+	_, storeSpan = sp.startSpan(ctx, SpanStoreSave)
+	err = sp.store.Save(session)
+	endSpan(storeSpan, err)
+	if err != nil {
+		span.SetAttribute(AttributeReason, ReasonStore)
+		return nil, err
+	}
+	sp.configuration.logger().Info("Session started", sessionFields(session)...)
+	sp.emit(Event{Kind: EventLogin, Session: session})
 	return session, nil
 }
 
-func (sp *SessionPool) prepareNew(principal AuthenticationPrincipal, address string) *Session {
+func (sp *SessionPool) prepareNew(principal AuthenticationPrincipal, address string, policy SessionPolicy) *Session {
 	return &Session{
 		ID: SessionIdentifier{
 			SID:           NewToken(),
 			SSID:          NewToken(),
 			RemoteAddress: address,
+			Realm:         sp.configuration.Realm,
 		},
-		Principal:      principal,
-		startTime:      time.Now(),
-		refreshTime:    time.Now(),
-		expirationTime: time.Now().Add(sp.configuration.ExpirationDuration),
-		closed:         false,
+		Principal:         principal,
+		startTime:         time.Now(),
+		refreshTime:       time.Now(),
+		storedRefreshTime: time.Now(),
+		expirationTime:    time.Now().Add(policy.ExpirationTime),
+		closed:            false,
+	}
+}
+
+/*
+	Returns up to count sessions with the oldest refresh time.
+	The refresh times are read once under the session locks, since Refresh may update them concurrently.
+*/
+func leastRecentlyRefreshed(sessions []*Session, count int) []*Session {
+	type refreshed struct {
+		session *Session
+		time    time.Time
+	}
+	sorted := make([]refreshed, len(sessions))
+	for i, session := range sessions {
+		sorted[i] = refreshed{session, session.lastRefresh()}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].time.Before(sorted[j].time)
+	})
+	if count > len(sorted) {
+		count = len(sorted)
+	}
+	result := make([]*Session, count)
+	for i := range result {
+		result[i] = sorted[i].session
 	}
+	return result
 }
 
 func (sp *SessionPool) removeAll(sessions []*Session) {
@@ -148,34 +470,62 @@ func (sp *SessionPool) removeAll(sessions []*Session) {
 	}
 }
 
-func (sp *SessionPool) removeAllUnsafe(sessions []*Session) {
+func (sp *SessionPool) removeAllUnsafe(ctx context.Context, sessions []*Session, reason string) {
 	for _, session := range sessions {
-		sp.removeSessionUnsafe(session)
+		sp.removeSessionUnsafe(ctx, session, reason)
 	}
 }
 
-func (sp *SessionPool) removeSessionUnsafe(session *Session) {
-	delete(sp.bySessionID, session.ID)
-	sessions, ok := sp.byPrincipalId[session.Principal.ID()]
-	if ok {
-		delete(sessions, session.ID)
-		sp.configuration.Logger.Printf("Session removed: %s", session)
+/*
+	Removes the session while the principal lock is held. The caller publishes the removal after releasing the lock.
+*/
+func (sp *SessionPool) removeSessionUnsafe(ctx context.Context, session *Session, reason string) {
+	if sp.refresher != nil {
+		sp.refresher.forget(session.ID.SID)
+	}
+	_, span := sp.startSpan(ctx, SpanStoreRemove)
+	span.SetAttribute(AttributeReason, reason)
+	removed, err := sp.store.Remove(session)
+	endSpan(span, err)
+	if err != nil {
+		sp.configuration.logger().Error("Removal failed", sessionFields(session, "reason", reason, "error", err)...)
+		return
+	}
+	if removed {
+		sp.configuration.logger().Info("Session removed", sessionFields(session, "reason", reason)...)
+		sp.emit(Event{Kind: EventSessionEnded, Session: session, Reason: reason})
+		sp.watchers.ended(session.ID.SID, reason)
 	}
 }
 
 func (sp *SessionPool) getAllSessions(principal AuthenticationPrincipal) []*Session {
-	sp.lock.RLock()
-	defer sp.lock.RUnlock()
+	sessions, err := sp.store.ByPrincipal(sp.configuration.Realm, principal.ID())
+	if err != nil {
+		sp.configuration.logger().Error("Sessions not loaded", "principal_id", principal.ID(), "error", err)
+		return []*Session{}
+	}
+	return sessions
+}
 
-	return sp.getSessions(principal)
+/*
+	Returns the page of the sessions of the realm matching the query.
+*/
+func (sp *SessionPool) querySessions(query SessionQuery) (*SessionPage, error) {
+	return QuerySessions(sp.store, sp.configuration.Realm, query)
 }
 
-func (sp *SessionPool) getSessions(principal AuthenticationPrincipal) []*Session {
-	sessions := []*Session{}
-	for _, session := range sp.bySessionID {
-		if session.Principal.ID() == principal.ID() {
-			sessions = append(sessions, session)
-		}
+/*
+	Unsubscribes from the revocation bus, stops the sweeper and writes the coalesced refresh times to the store.
+*/
+func (sp *SessionPool) close() error {
+	if sp.unsubscribe != nil {
+		sp.unsubscribe()
 	}
-	return sessions
+	if sp.sweeper != nil {
+		sp.sweeper.close()
+	}
+	if sp.refresher != nil {
+		return sp.refresher.close()
+	}
+	return nil
 }
@@ -0,0 +1,211 @@
+package porter
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+The number of sessions in the pools used by the benchmarks.
+*/
+const benchmarkSessions = 1000000
+
+const benchmarkSessionsPerPrincipal = 4
+
+var benchmarkConfiguration = &sessionConfiguration{
+	ExpirationDuration: time.Hour,
+	Timeout:            time.Hour,
+	MultiLogin:         AllowNew,
+	ForceExpire:        false,
+}
+
+type benchmarkPrincipal string
+
+func (b benchmarkPrincipal) ID() string {
+	return string(b)
+}
+
+func (b benchmarkPrincipal) CanLogin() bool {
+	return true
+}
+
+func (b benchmarkPrincipal) AllowMultiLogin() bool {
+	return true
+}
+
+func (b benchmarkPrincipal) SaveSession() bool {
+	return false
+}
+
+/*
+The single lock implementation the sharded pool is compared against.
+*/
+type legacySessionPool struct {
+	bySessionID   map[SessionIdentifier]*Session
+	byPrincipalId map[string]map[SessionIdentifier]*Session
+	lock          sync.RWMutex
+	configuration *sessionConfiguration
+}
+
+func newLegacySessionPool(configuration *sessionConfiguration) *legacySessionPool {
+	return &legacySessionPool{
+		bySessionID:   map[SessionIdentifier]*Session{},
+		byPrincipalId: map[string]map[SessionIdentifier]*Session{},
+		configuration: configuration,
+	}
+}
+
+func (sp *legacySessionPool) getSession(sessionId SessionIdentifier) (*Session, error) {
+	sp.lock.RLock()
+	session, ok := sp.bySessionID[sessionId]
+	sp.lock.RUnlock()
+
+	if !ok {
+		return nil, errors.New(SessionNotFound)
+	}
+	if session.Expired(sp.configuration) {
+		return nil, errors.New(SessionExpired)
+	}
+	session.Refresh()
+	return session, nil
+}
+
+func (sp *legacySessionPool) startSession(principal AuthenticationPrincipal, address string) (*Session, error) {
+	session := sp.prepareNew(principal, address)
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	sessions := []*Session{}
+	for _, s := range sp.bySessionID {
+		if s.Principal.ID() == principal.ID() {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) > 0 && !principal.AllowMultiLogin() {
+		return nil, errors.New(SessionAlreadyStarted)
+	}
+	sp.put(session)
+	return session, nil
+}
+
+func (sp *legacySessionPool) add(principal AuthenticationPrincipal) *Session {
+	session := sp.prepareNew(principal, "remote")
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.put(session)
+	return session
+}
+
+func (sp *legacySessionPool) prepareNew(principal AuthenticationPrincipal, address string) *Session {
+	return &Session{
+		ID: SessionIdentifier{
+			SID:           NewToken(),
+			SSID:          NewToken(),
+			RemoteAddress: address,
+		},
+		Principal:      principal,
+		startTime:      time.Now(),
+		refreshTime:    time.Now(),
+		expirationTime: time.Now().Add(sp.configuration.ExpirationDuration),
+	}
+}
+
+func (sp *legacySessionPool) put(session *Session) {
+	_ms, ok := sp.byPrincipalId[session.Principal.ID()]
+	if !ok {
+		_ms = map[SessionIdentifier]*Session{}
+		sp.byPrincipalId[session.Principal.ID()] = _ms
+	}
+	_ms[session.ID] = session
+	sp.bySessionID[session.ID] = session
+}
+
+type benchmarkPool interface {
+	startSession(principal AuthenticationPrincipal, address string) (*Session, error)
+	getSession(sessionId SessionIdentifier) (*Session, error)
+}
+
+type benchmarkFixture struct {
+	once sync.Once
+	pool benchmarkPool
+	ids  []SessionIdentifier
+	/*
+		Creates the pool and a function adding a session without the multi login checks.
+	*/
+	build func() (benchmarkPool, func(principal AuthenticationPrincipal) *Session)
+}
+
+func (f *benchmarkFixture) get(b *testing.B) (benchmarkPool, []SessionIdentifier) {
+	f.once.Do(func() {
+		pool, add := f.build()
+		f.pool = pool
+		f.ids = make([]SessionIdentifier, 0, benchmarkSessions)
+		for i := 0; i < benchmarkSessions; i++ {
+			principal := benchmarkPrincipal("principal-" + strconv.Itoa(i/benchmarkSessionsPerPrincipal))
+			f.ids = append(f.ids, add(principal).ID)
+		}
+	})
+	return f.pool, f.ids
+}
+
+var shardedFixture = &benchmarkFixture{build: func() (benchmarkPool, func(principal AuthenticationPrincipal) *Session) {
+	pool := newSessionPool(benchmarkConfiguration)
+	return pool, func(principal AuthenticationPrincipal) *Session {
+		session, _ := pool.startSession(principal, "remote")
+		return session
+	}
+}}
+
+var legacyFixture = &benchmarkFixture{build: func() (benchmarkPool, func(principal AuthenticationPrincipal) *Session) {
+	pool := newLegacySessionPool(benchmarkConfiguration)
+	return pool, pool.add
+}}
+
+func benchmarkAuthenticate(b *testing.B, fixture *benchmarkFixture) {
+	pool, ids := fixture.get(b)
+	var counter uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&counter, 7919) % uint64(len(ids))
+			if _, err := pool.getSession(ids[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchmarkLogin(b *testing.B, fixture *benchmarkFixture) {
+	pool, _ := fixture.get(b)
+	var counter uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&counter, 1)
+			principal := benchmarkPrincipal("login-" + strconv.FormatUint(i, 10))
+			if _, err := pool.startSession(principal, "remote"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSessionPool_Authenticate(b *testing.B) {
+	benchmarkAuthenticate(b, shardedFixture)
+}
+
+func BenchmarkLegacySessionPool_Authenticate(b *testing.B) {
+	benchmarkAuthenticate(b, legacyFixture)
+}
+
+func BenchmarkSessionPool_Login(b *testing.B) {
+	benchmarkLogin(b, shardedFixture)
+}
+
+func BenchmarkLegacySessionPool_Login(b *testing.B) {
+	benchmarkLogin(b, legacyFixture)
+}
@@ -2,6 +2,7 @@ package porter
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
@@ -168,6 +169,123 @@ func TestSessionPool_MultiCloseNotAllowed(t *testing.T) {
 	}
 }
 
+type pp struct {
+	ap
+	id     string
+	policy func(defaults SessionPolicy) SessionPolicy
+}
+
+func (p pp) ID() string {
+	return p.id
+}
+
+func (p pp) SessionPolicy(defaults SessionPolicy) SessionPolicy {
+	return p.policy(defaults)
+}
+
+func TestSessionPool_PrincipalPolicy(t *testing.T) {
+
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         FailNew,
+		ForceExpire:        false,
+	})
+
+	admin := pp{ap{false, true, true}, "admin", func(defaults SessionPolicy) SessionPolicy {
+		defaults.Timeout = 50 * time.Millisecond
+		defaults.MultiLogin = AllowNew
+		defaults.MaxSessions = 2
+		return defaults
+	}}
+	kiosk := pp{ap{false, true, true}, "kiosk", func(defaults SessionPolicy) SessionPolicy {
+		defaults.ExpirationTime = 24 * time.Hour
+		return defaults
+	}}
+
+	first, err := pool.startSession(admin, "remote1")
+	check(err, t)
+	_, err = pool.startSession(admin, "remote2")
+	check(err, t)
+	_, err = pool.startSession(admin, "remote3")
+	check(err, t)
+
+	if len(pool.getAllSessions(admin)) != 2 {
+		t.Error("Session limit is not applied")
+	}
+	if _, err = pool.getSession(first.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("The oldest session is not closed")
+	}
+
+	kioskSession, err := pool.startSession(kiosk, "remote1")
+	check(err, t)
+	if kioskSession.expirationTime.Before(time.Now().Add(time.Hour)) {
+		t.Error("Expiration time is not overridden")
+	}
+	if _, err = pool.startSession(kiosk, "remote2"); err == nil || err.Error() != SessionAlreadyStarted {
+		t.Error("Multi login policy is not inherited")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if len(pool.getAllSessions(admin)) == 0 {
+		t.Fatal("Sessions closed")
+	}
+	for _, session := range pool.getAllSessions(admin) {
+		if _, err = pool.getSession(session.ID); err == nil || err.Error() != SessionExpired {
+			t.Error("Timeout is not overridden")
+		}
+	}
+	_, err = pool.getSession(kioskSession.ID)
+	check(err, t)
+}
+
+func TestSessionPool_Concurrent(t *testing.T) {
+
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		ForceExpire:        false,
+		Shards:             4,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			principal := pp{ap{true, true, true}, fmt.Sprint("principal", i%2), func(defaults SessionPolicy) SessionPolicy {
+				return defaults
+			}}
+			for j := 0; j < 50; j++ {
+				session, err := pool.startSession(principal, "remote1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = pool.getSession(session.ID); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					pool.removeSession(session)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 2; i++ {
+		principal := pp{id: fmt.Sprint("principal", i)}
+		if len(pool.getAllSessions(principal)) != 4*25 {
+			t.Error("Per principal index is inconsistent")
+		}
+	}
+}
+
 func check(err error, t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
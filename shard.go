@@ -0,0 +1,97 @@
+package porter
+
+import (
+	"sync"
+)
+
+/*
+The number of shards used when Configuration.Shards is not set.
+*/
+const defaultShards = 64
+
+/*
+Part of the sessions selected by the SID hash.
+*/
+type sessionShard struct {
+	lock     sync.RWMutex
+	sessions map[string]*Session
+}
+
+/*
+Key of the per principal index. Principal IDs are unique only inside a realm.
+*/
+type principalKey struct {
+	realm string
+	id    string
+}
+
+/*
+Part of the per principal index selected by the principal ID hash.
+*/
+type principalShard struct {
+	lock     sync.RWMutex
+	sessions map[principalKey]map[string]*Session
+}
+
+func newSessionShards(count int) []*sessionShard {
+	shards := make([]*sessionShard, count)
+	for i := range shards {
+		shards[i] = &sessionShard{sessions: map[string]*Session{}}
+	}
+	return shards
+}
+
+func newPrincipalShards(count int) []*principalShard {
+	shards := make([]*principalShard, count)
+	for i := range shards {
+		shards[i] = &principalShard{sessions: map[principalKey]map[string]*Session{}}
+	}
+	return shards
+}
+
+func shardCount(configured int) int {
+	if configured <= 0 {
+		return defaultShards
+	}
+	return configured
+}
+
+/*
+FNV-1a hash of the key.
+*/
+func shardHash(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+func (ps *principalShard) add(key principalKey, session *Session) {
+	sessions, ok := ps.sessions[key]
+	if !ok {
+		sessions = map[string]*Session{}
+		ps.sessions[key] = sessions
+	}
+	sessions[session.ID.SID] = session
+}
+
+func (ps *principalShard) remove(key principalKey, sid string) {
+	sessions, ok := ps.sessions[key]
+	if !ok {
+		return
+	}
+	delete(sessions, sid)
+	if len(sessions) == 0 {
+		delete(ps.sessions, key)
+	}
+}
+
+func (ps *principalShard) list(key principalKey) []*Session {
+	sessions := make([]*Session, 0, len(ps.sessions[key]))
+	for _, session := range ps.sessions[key] {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
@@ -0,0 +1,229 @@
+package porter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotVersion = 1
+
+/*
+The first line of a snapshot file. Every next line is a session record.
+*/
+type snapshotHeader struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+/*
+Atomically writes the session records to the file.
+
+The records are written to a temporary file in the same directory,
+which is synced and renamed over the target.
+*/
+func writeSnapshotFile(path string, records func(emit func(record *sessionRecord) error) error) error {
+	// os.CreateTemp needs Go 1.16, the module supports Go 1.15.
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	err = encoder.Encode(snapshotHeader{Version: snapshotVersion, Created: time.Now()})
+	if err == nil {
+		err = records(func(record *sessionRecord) error {
+			return encoder.Encode(record)
+		})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(path))
+}
+
+/*
+Reads the session records of the snapshot file.
+*/
+func readSnapshotFile(path string, fn func(record *sessionRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readSnapshot(bufio.NewReader(file), fn)
+}
+
+func readSnapshot(reader io.Reader, fn func(record *sessionRecord) error) error {
+	decoder := json.NewDecoder(reader)
+	header := snapshotHeader{}
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+	if header.Version != snapshotVersion {
+		return errors.New(UnsupportedSnapshot)
+	}
+	for {
+		record := &sessionRecord{}
+		err := decoder.Decode(record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Makes the rename of a file in the directory durable.
+*/
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	if err = directory.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+/*
+Writes all sessions of the realm to the snapshot file. The CSRF secrets are left out, restored sessions issue new ones.
+*/
+func (sp *SessionPool) saveSnapshot(path string) error {
+	return writeSnapshotFile(path, func(emit func(record *sessionRecord) error) error {
+		var err error
+		rangeErr := sp.store.Range(func(session *Session) bool {
+			if session.ID.Realm != sp.configuration.Realm {
+				return true
+			}
+			record := newSessionRecord(session)
+			for key := range record.Attributes {
+				if csrfAttribute(key) {
+					delete(record.Attributes, key)
+				}
+			}
+			err = emit(record)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return rangeErr
+	})
+}
+
+/*
+Loads the sessions of the realm from the snapshot file.
+Expired sessions, sessions of not resolved principals and sessions not allowed by the policies are dropped.
+A missing file is treated as an empty snapshot. Returns the ResolverRequired error if the resolver is nil.
+*/
+func (sp *SessionPool) restoreSnapshot(path string, resolver PrincipalResolver) (int, error) {
+	loaded := 0
+	err := readSnapshotFile(path, func(record *sessionRecord) error {
+		if record.Realm != sp.configuration.Realm {
+			return nil
+		}
+		if resolver == nil {
+			return errors.New(ResolverRequired)
+		}
+		session, err := record.session(resolver)
+		if err != nil {
+			sp.configuration.logger().Warn("Session not restored", "principal_id", record.PrincipalID, "error", err)
+			return nil
+		}
+		if session.Expired(sp.configuration) {
+			return nil
+		}
+		restored, err := sp.restoreSession(session)
+		if restored {
+			loaded++
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return loaded, err
+}
+
+/*
+Saves the restored session under the principal lock. Returns FALSE if the session is already stored
+or the policies do not allow it next to the sessions of the principal, which are never ended by a restore.
+*/
+func (sp *SessionPool) restoreSession(session *Session) (bool, error) {
+	lock := sp.principalLock(session.Principal.ID())
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := sp.store.Get(session.ID); err == nil {
+		return false, nil
+	}
+	sessions, err := sp.store.ByPrincipal(sp.configuration.Realm, session.Principal.ID())
+	if err != nil {
+		return false, err
+	}
+	if !sp.allowedNextTo(session, sessions) {
+		sp.configuration.logger().Info("Session not restored", sessionFields(session, "reason", ReasonAlreadyStarted)...)
+		return false, nil
+	}
+	if err = sp.store.Save(session); err != nil {
+		return false, err
+	}
+	sp.configuration.logger().Info("Session restored", sessionFields(session)...)
+	sp.emit(Event{Kind: EventSessionRestored, Session: session})
+	return true, nil
+}
+
+/*
+Returns TRUE if the multi-login policy and the maximum sessions of the principal allow the session next to the sessions.
+*/
+func (sp *SessionPool) allowedNextTo(session *Session, sessions []*Session) bool {
+	if len(sessions) == 0 {
+		return true
+	}
+	policy := sp.configuration.policyFor(session.Principal)
+	if policy.MaxSessions > 0 && len(sessions) >= policy.MaxSessions {
+		return false
+	}
+	switch policy.MultiLogin {
+	case AllowNew:
+		return session.Principal.AllowMultiLogin()
+	case AllowNewFromSameAddress:
+		if !session.Principal.AllowMultiLogin() {
+			return false
+		}
+		for _, other := range sessions {
+			if !sameAddress(other.ID.RemoteAddress, session.ID.RemoteAddress) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package porter
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionPool_Snapshot(t *testing.T) {
+	configuration := &sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		ForceExpire:        false,
+	}
+	pool := newSessionPool(configuration)
+
+	principal := ap{false, true, true}
+	session, err := pool.startSession(principal, "remote1")
+	check(err, t)
+	session.SetAttribute("locale", "en")
+	session.SetAttribute(SessionAttributeCSRF, "1.secret")
+	expired, err := pool.startSession(principal, "remote2")
+	check(err, t)
+	expired.expirationTime = time.Now().Add(-time.Second)
+	deleted, err := pool.startSession(ap{false, true, false}, "remote3")
+	check(err, t)
+
+	path := filepath.Join(t.TempDir(), "sessions.snapshot")
+	check(pool.saveSnapshot(path), t)
+
+	restored := newSessionPool(configuration)
+	loaded, err := restored.restoreSnapshot(path, func(id string) (AuthenticationPrincipal, error) {
+		if id == deleted.Principal.ID() {
+			return nil, errors.New("principal deleted")
+		}
+		return principal, nil
+	})
+	check(err, t)
+	if loaded != 1 {
+		t.Fatalf("Loaded %d sessions, expected 1", loaded)
+	}
+
+	found, err := restored.getSession(session.ID)
+	check(err, t)
+	if value, _ := found.Attribute("locale"); value != "en" {
+		t.Error("Attributes are not restored")
+	}
+	if _, ok := found.Attribute(SessionAttributeCSRF); ok {
+		t.Error("CSRF secret is restored")
+	}
+	if !found.startTime.Equal(session.startTime) || !found.expirationTime.Equal(session.expirationTime) {
+		t.Error("Timestamps are not restored")
+	}
+	if _, err = restored.getSession(expired.ID); err == nil {
+		t.Error("Expired session restored")
+	}
+}
+
+func TestSessionPool_SnapshotMissing(t *testing.T) {
+	pool := newSessionPool(&sessionConfiguration{Logger: testingLogger})
+	loaded, err := pool.restoreSnapshot(filepath.Join(t.TempDir(), "missing"), nil)
+	if err != nil || loaded != 0 {
+		t.Error("Missing snapshot is not treated as empty")
+	}
+}
+
+func TestSessionPool_SnapshotPolicies(t *testing.T) {
+	events := []Event{}
+	configuration := &sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		MaxSessions:        2,
+		Listeners: []EventListener{EventListenerFunc(func(event Event) {
+			events = append(events, event)
+		})},
+	}
+	pool := newSessionPool(configuration)
+	principal := ap{false, true, true}
+	for _, address := range []string{"remote1", "remote2"} {
+		_, err := pool.startSession(principal, address)
+		check(err, t)
+	}
+	path := filepath.Join(t.TempDir(), "sessions.snapshot")
+	check(pool.saveSnapshot(path), t)
+
+	if _, err := newSessionPool(configuration).restoreSnapshot(path, nil); err == nil || err.Error() != ResolverRequired {
+		t.Errorf("Unexpected error %v", err)
+	}
+	resolver := func(id string) (AuthenticationPrincipal, error) {
+		return principal, nil
+	}
+
+	restored := newSessionPool(configuration)
+	started, err := restored.startSession(principal, "remote3")
+	check(err, t)
+	events = nil
+	loaded, err := restored.restoreSnapshot(path, resolver)
+	check(err, t)
+	if loaded != 1 || len(restored.getAllSessions(principal)) != 2 {
+		t.Errorf("Restored %d sessions over the maximum", loaded)
+	}
+	if _, err = restored.getSession(started.ID); err != nil {
+		t.Error("Started session is ended by the restore")
+	}
+	if len(events) != 1 || events[0].Kind != EventSessionRestored || events[0].PrincipalID != principal.ID() {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if loaded, err = restored.restoreSnapshot(path, resolver); err != nil || loaded != 0 {
+		t.Errorf("Stored sessions are restored again: %d", loaded)
+	}
+}
@@ -0,0 +1,524 @@
+package porter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The number of attempts to write a refresh time concurrently modified by another instance.
+*/
+const sqlTouchAttempts = 3
+
+/*
+The number of rows deleted in one transaction if the batch size is not set.
+*/
+const sqlDefaultBatch = 1000
+
+/*
+Returns the placeholder of the n-th statement parameter, starting from 1.
+*/
+type SQLPlaceholder func(n int) string
+
+/*
+Placeholders of PostgreSQL: $1, $2...
+*/
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+/*
+Placeholders of MySQL and SQLite: ?, ?...
+*/
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+type SQLStoreOptions struct {
+	/*
+		The table of the sessions. Defaults to "porter_sessions".
+	*/
+	Table string
+	/*
+		Defaults to DollarPlaceholder.
+	*/
+	Placeholder SQLPlaceholder
+}
+
+/*
+SessionStore keeping sessions in a database/sql database.
+
+The table is created by Migrate, see SQLStoreSchema for the schema.
+Times are stored as Unix nanoseconds, flags as integers and attributes as JSON, so the schema fits most databases.
+Refresh times are written with optimistic concurrency on the version column,
+an older refresh time never overwrites a newer one written by another instance.
+*/
+type SQLStore struct {
+	db          *sql.DB
+	resolver    PrincipalResolver
+	table       string
+	placeholder SQLPlaceholder
+}
+
+/*
+Creates the store on the database.
+Uses the resolver to restore the Authentication Principals of the loaded sessions.
+Returns the ResolverRequired error if the resolver is nil.
+*/
+func NewSQLStore(db *sql.DB, resolver PrincipalResolver, options SQLStoreOptions) (*SQLStore, error) {
+	if resolver == nil {
+		return nil, errors.New(ResolverRequired)
+	}
+	if options.Table == "" {
+		options.Table = "porter_sessions"
+	}
+	if options.Placeholder == nil {
+		options.Placeholder = DollarPlaceholder
+	}
+	return &SQLStore{
+		db:          db,
+		resolver:    resolver,
+		table:       options.Table,
+		placeholder: options.Placeholder,
+	}, nil
+}
+
+/*
+Returns the statements creating the table of the sessions and its indexes:
+
+	CREATE TABLE IF NOT EXISTS porter_sessions (
+		realm           VARCHAR(255) NOT NULL,
+		sid             VARCHAR(255) NOT NULL,
+		ssid            VARCHAR(255) NOT NULL,
+		remote_address  VARCHAR(255) NOT NULL,
+		principal_id    VARCHAR(255) NOT NULL,
+		start_time      BIGINT NOT NULL,
+		expiration_time BIGINT NOT NULL,
+		refresh_time    BIGINT NOT NULL,
+		attributes      TEXT NOT NULL,
+		version         BIGINT NOT NULL,
+		save_session    INTEGER NOT NULL,
+		PRIMARY KEY (realm, sid)
+	)
+	CREATE INDEX IF NOT EXISTS porter_sessions_principal ON porter_sessions (realm, principal_id)
+	CREATE INDEX IF NOT EXISTS porter_sessions_start ON porter_sessions (realm, start_time)
+	CREATE INDEX IF NOT EXISTS porter_sessions_expiration ON porter_sessions (expiration_time)
+
+Queries page by comparing the principal IDs and the SIDs in the database,
+so the columns should use a binary collation, as the cursors compare them byte by byte.
+*/
+func SQLStoreSchema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"realm VARCHAR(255) NOT NULL, " +
+			"sid VARCHAR(255) NOT NULL, " +
+			"ssid VARCHAR(255) NOT NULL, " +
+			"remote_address VARCHAR(255) NOT NULL, " +
+			"principal_id VARCHAR(255) NOT NULL, " +
+			"start_time BIGINT NOT NULL, " +
+			"expiration_time BIGINT NOT NULL, " +
+			"refresh_time BIGINT NOT NULL, " +
+			"attributes TEXT NOT NULL, " +
+			"version BIGINT NOT NULL, " +
+			"save_session INTEGER NOT NULL, " +
+			"PRIMARY KEY (realm, sid))",
+		"CREATE INDEX IF NOT EXISTS " + table + "_principal ON " + table + " (realm, principal_id)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_start ON " + table + " (realm, start_time)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expiration ON " + table + " (expiration_time)",
+	}
+}
+
+/*
+Creates the table of the sessions and its indexes if they do not exist.
+*/
+func (s *SQLStore) Migrate() error {
+	for _, statement := range SQLStoreSchema(s.table) {
+		if _, err := s.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Replaces every ? of the query with the placeholder of the dialect.
+*/
+func (s *SQLStore) query(query string) string {
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			builder.WriteString(s.placeholder(n))
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+const sqlSessionColumns = "realm, sid, ssid, remote_address, principal_id, start_time, expiration_time, refresh_time, attributes, version"
+
+func (s *SQLStore) Save(session *Session) error {
+	attributes, err := json.Marshal(session.Attributes())
+	if err != nil {
+		return err
+	}
+	refreshTime := session.lastRefresh()
+	saveSession := int64(0)
+	if session.Principal.SaveSession() {
+		saveSession = 1
+	}
+	_, err = s.db.Exec(s.query("INSERT INTO "+s.table+" ("+sqlSessionColumns+", save_session) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		session.ID.Realm, session.ID.SID, session.ID.SSID, session.ID.RemoteAddress, session.Principal.ID(),
+		session.startTime.UnixNano(), session.expirationTime.UnixNano(), refreshTime.UnixNano(), string(attributes), int64(1), saveSession)
+	if err != nil {
+		return err
+	}
+	session.setRevision(1)
+	session.stored(refreshTime)
+	return nil
+}
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+/*
+Scans the row selected with sqlSessionColumns.
+*/
+func scanSQLRecord(row sqlScanner) (*sessionRecord, int64, error) {
+	record := &sessionRecord{}
+	var start, expiration, refresh, version int64
+	var attributes string
+	err := row.Scan(&record.Realm, &record.SID, &record.SSID, &record.RemoteAddress, &record.PrincipalID,
+		&start, &expiration, &refresh, &attributes, &version)
+	if err != nil {
+		return nil, 0, err
+	}
+	record.StartTime = time.Unix(0, start)
+	record.ExpirationTime = time.Unix(0, expiration)
+	record.RefreshTime = time.Unix(0, refresh)
+	if err = json.Unmarshal([]byte(attributes), &record.Attributes); err != nil {
+		return nil, 0, err
+	}
+	return record, version, nil
+}
+
+func (s *SQLStore) scan(row sqlScanner) (*Session, error) {
+	record, version, err := scanSQLRecord(row)
+	if err != nil {
+		return nil, err
+	}
+	session, err := record.session(s.resolver)
+	if err != nil {
+		return nil, err
+	}
+	session.revision = version
+	return session, nil
+}
+
+func (s *SQLStore) Get(identifier SessionIdentifier) (*Session, error) {
+	row := s.db.QueryRow(s.query("SELECT "+sqlSessionColumns+" FROM "+s.table+" WHERE realm = ? AND sid = ?"),
+		identifier.Realm, identifier.SID)
+	session, err := s.scan(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(SessionNotFound)
+	}
+	return session, err
+}
+
+/*
+Writes the refresh times in one transaction.
+*/
+func (s *SQLStore) Touch(sessions []*Session) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	refreshTimes := make([]time.Time, len(sessions))
+	for i, session := range sessions {
+		refreshTimes[i] = session.lastRefresh()
+		if err = s.touch(tx, session, refreshTimes[i].UnixNano()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for i, session := range sessions {
+		session.stored(refreshTimes[i])
+	}
+	return nil
+}
+
+func (s *SQLStore) touch(tx *sql.Tx, session *Session, refreshTime int64) error {
+	for attempt := 0; attempt < sqlTouchAttempts; attempt++ {
+		revision := session.currentRevision()
+		result, err := tx.Exec(s.query("UPDATE "+s.table+" SET refresh_time = ?, version = ? WHERE realm = ? AND sid = ? AND version = ?"),
+			refreshTime, revision+1, session.ID.Realm, session.ID.SID, revision)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 1 {
+			session.setRevision(revision + 1)
+			return nil
+		}
+
+		var storedRefresh, storedRevision int64
+		err = tx.QueryRow(s.query("SELECT refresh_time, version FROM "+s.table+" WHERE realm = ? AND sid = ?"),
+			session.ID.Realm, session.ID.SID).Scan(&storedRefresh, &storedRevision)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session.setRevision(storedRevision)
+		if storedRefresh >= refreshTime {
+			return nil
+		}
+	}
+	return errors.New(ConcurrentModification)
+}
+
+func (s *SQLStore) SaveAttributes(session *Session) error {
+	attributes, err := json.Marshal(session.Attributes())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.query("UPDATE "+s.table+" SET attributes = ? WHERE realm = ? AND sid = ?"),
+		string(attributes), session.ID.Realm, session.ID.SID)
+	return err
+}
+
+func (s *SQLStore) Remove(session *Session) (bool, error) {
+	result, err := s.db.Exec(s.query("DELETE FROM "+s.table+" WHERE realm = ? AND sid = ?"), session.ID.Realm, session.ID.SID)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *SQLStore) ByPrincipal(realm string, principalId string) ([]*Session, error) {
+	rows, err := s.db.Query(s.query("SELECT "+sqlSessionColumns+" FROM "+s.table+" WHERE realm = ? AND principal_id = ?"),
+		realm, principalId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+/*
+Streams all sessions of the table. Sessions of not resolved principals are skipped.
+*/
+func (s *SQLStore) Range(fn func(session *Session) bool) error {
+	rows, err := s.db.Query("SELECT " + sqlSessionColumns + " FROM " + s.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, version, err := scanSQLRecord(rows)
+		if err != nil {
+			return err
+		}
+		session, err := record.session(s.resolver)
+		if err != nil {
+			continue
+		}
+		session.revision = version
+		if !fn(session) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+var sqlLikeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+/*
+Returns the page of the sessions of the realm matching the query.
+The database filters by the principal and the times, orders the sessions and skips the previous pages.
+The remote address and the attributes are matched on the loaded rows,
+and the rows are read only until the page is full, so the principals are resolved for the page only.
+*/
+func (s *SQLStore) Query(realm string, query SessionQuery) (*SessionPage, error) {
+	matcher, err := compileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	statement, args := s.selectPage(realm, matcher)
+	rows, err := s.db.Query(s.query(statement), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &SessionPage{Sessions: []*Session{}}
+	var last queryKey
+	for rows.Next() {
+		record, version, err := scanSQLRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !matcher.matchesRecord(record) {
+			continue
+		}
+		session, err := record.session(s.resolver)
+		if err != nil {
+			continue
+		}
+		session.revision = version
+		key := matcher.key(session)
+		if !matcher.matches(session) || !matcher.afterCursor(&key) {
+			continue
+		}
+		if len(page.Sessions) == matcher.limit {
+			page.Next = matcher.cursor(last)
+			return page, nil
+		}
+		page.Sessions = append(page.Sessions, session)
+		last = key
+	}
+	return page, rows.Err()
+}
+
+/*
+Returns the statement selecting the sessions of the page in the order of the query, one more than the limit if possible.
+*/
+func (s *SQLStore) selectPage(realm string, matcher *sessionMatcher) (string, []interface{}) {
+	query := &matcher.query
+	conditions := []string{"realm = ?"}
+	args := []interface{}{realm}
+	if query.PrincipalID != "" {
+		conditions = append(conditions, "principal_id = ?")
+		args = append(args, query.PrincipalID)
+	}
+	if query.PrincipalPrefix != "" {
+		conditions = append(conditions, "principal_id LIKE ? ESCAPE '!'")
+		args = append(args, sqlLikeEscaper.Replace(query.PrincipalPrefix)+"%")
+	}
+	for _, bound := range []struct {
+		condition string
+		time      time.Time
+	}{
+		{"start_time > ?", query.CreatedAfter},
+		{"start_time < ?", query.CreatedBefore},
+		{"refresh_time > ?", query.RefreshedAfter},
+		{"refresh_time < ?", query.RefreshedBefore},
+	} {
+		if !bound.time.IsZero() {
+			conditions = append(conditions, bound.condition)
+			args = append(args, bound.time.UnixNano())
+		}
+	}
+
+	column := "start_time"
+	switch query.Order {
+	case OrderByRefreshed:
+		column = "refresh_time"
+	case OrderByPrincipal:
+		column = "principal_id"
+	}
+	comparison, direction := ">", ""
+	if query.Descending {
+		comparison, direction = "<", " DESC"
+	}
+	if after := matcher.after; after != nil {
+		conditions = append(conditions, "("+column+" "+comparison+" ? OR ("+column+" = ? AND sid "+comparison+" ?))")
+		var value interface{} = after.time
+		if query.Order == OrderByPrincipal {
+			value = after.key
+		}
+		args = append(args, value, value, after.sid)
+	}
+
+	statement := "SELECT " + sqlSessionColumns + " FROM " + s.table + " WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY " + column + direction + ", sid" + direction
+	if query.RemoteAddress == "" && len(query.Attributes) == 0 {
+		statement += " LIMIT ?"
+		args = append(args, int64(matcher.limit+1))
+	}
+	return statement, args
+}
+
+/*
+Deletes sessions past their total lifetime and, if idleTimeout is not zero,
+sessions not refreshed during idleTimeout, in transactions of up to batch rows (1000 if not set).
+Sessions of the principals saving their sessions are not deleted by the idle timeout, see: AuthenticationPrincipal.SaveSession
+The idle timeout should not be shorter than the longest Timeout of the principals.
+Returns the number of deleted sessions.
+*/
+func (s *SQLStore) DeleteExpired(idleTimeout time.Duration, batch int) (int, error) {
+	if batch <= 0 {
+		batch = sqlDefaultBatch
+	}
+	now := time.Now()
+	idle := int64(0)
+	if idleTimeout > 0 {
+		idle = now.Add(-idleTimeout).UnixNano()
+	}
+	deleted := 0
+	for {
+		count, err := s.deleteExpiredBatch(now.UnixNano(), idle, batch)
+		deleted += count
+		if err != nil || count < batch {
+			return deleted, err
+		}
+	}
+}
+
+func (s *SQLStore) deleteExpiredBatch(now int64, idle int64, batch int) (int, error) {
+	rows, err := s.db.Query(s.query("SELECT realm, sid FROM "+s.table+" WHERE expiration_time < ? OR (refresh_time < ? AND save_session = 0) LIMIT ?"),
+		now, idle, batch)
+	if err != nil {
+		return 0, err
+	}
+	keys := [][2]string{}
+	for rows.Next() {
+		key := [2]string{}
+		if err = rows.Scan(&key[0], &key[1]); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if _, err = tx.Exec(s.query("DELETE FROM "+s.table+" WHERE realm = ? AND sid = ?"), key[0], key[1]); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(keys), tx.Commit()
+}
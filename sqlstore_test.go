@@ -0,0 +1,408 @@
+package porter
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+In-process database/sql driver understanding the statements of SQLStore.
+*/
+type fakeSQLDriver struct{}
+
+type fakeSQLDatabase struct {
+	lock       sync.Mutex
+	rows       map[string][]driver.Value
+	statements []string
+}
+
+var fakeSQLDatabases = struct {
+	sync.Mutex
+	byName map[string]*fakeSQLDatabase
+}{byName: map[string]*fakeSQLDatabase{}}
+
+func init() {
+	sql.Register("porterfake", fakeSQLDriver{})
+}
+
+func openFakeSQL(t *testing.T) (*sql.DB, *fakeSQLDatabase) {
+	database := &fakeSQLDatabase{rows: map[string][]driver.Value{}}
+	fakeSQLDatabases.Lock()
+	fakeSQLDatabases.byName[t.Name()] = database
+	fakeSQLDatabases.Unlock()
+	db, err := sql.Open("porterfake", t.Name())
+	check(err, t)
+	return db, database
+}
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	fakeSQLDatabases.Lock()
+	defer fakeSQLDatabases.Unlock()
+	return &fakeSQLConn{fakeSQLDatabases.byName[name]}, nil
+}
+
+type fakeSQLConn struct {
+	database *fakeSQLDatabase
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{c.database, query}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error {
+	return nil
+}
+
+func (fakeSQLTx) Rollback() error {
+	return nil
+}
+
+type fakeSQLStmt struct {
+	database *fakeSQLDatabase
+	query    string
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func fakeSQLKey(realm driver.Value, sid driver.Value) string {
+	return realm.(string) + "\x00" + sid.(string)
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	d := s.database
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.statements = append(d.statements, s.query)
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		key := fakeSQLKey(args[0], args[1])
+		if _, ok := d.rows[key]; ok {
+			return nil, errors.New("duplicate key")
+		}
+		d.rows[key] = args
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE") && strings.Contains(s.query, "SET attributes"):
+		row, ok := d.rows[fakeSQLKey(args[1], args[2])]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row[8] = args[0]
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		row, ok := d.rows[fakeSQLKey(args[2], args[3])]
+		if !ok || row[9].(int64) != args[4].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row[7] = args[0]
+		row[9] = args[1]
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		key := fakeSQLKey(args[0], args[1])
+		if _, ok := d.rows[key]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(d.rows, key)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unsupported statement: " + s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.database
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.statements = append(d.statements, s.query)
+
+	result := &fakeSQLRows{}
+	switch {
+	case strings.Contains(s.query, "ORDER BY"):
+		// The rows of the realm in the order of the query, SQLStore.Query filters them again.
+		column := map[string]int{"start_time": 5, "refresh_time": 7, "principal_id": 4}[strings.Trim(strings.Fields(s.query[strings.Index(s.query, "ORDER BY"):])[2], ",")]
+		descending := strings.Contains(s.query, " DESC")
+		for _, row := range d.rows {
+			if row[0] == args[0] {
+				result.values = append(result.values, append([]driver.Value{}, row[:10]...))
+			}
+		}
+		sort.Slice(result.values, func(i, j int) bool {
+			a, b := result.values[i], result.values[j]
+			less := a[1].(string) < b[1].(string)
+			switch x, y := a[column], b[column]; {
+			case x == y:
+			case column == 4:
+				less = x.(string) < y.(string)
+			default:
+				less = x.(int64) < y.(int64)
+			}
+			return less != descending
+		})
+	case strings.HasPrefix(s.query, "SELECT refresh_time, version"):
+		if row, ok := d.rows[fakeSQLKey(args[0], args[1])]; ok {
+			result.values = append(result.values, []driver.Value{row[7], row[9]})
+		}
+	case strings.Contains(s.query, "WHERE expiration_time <"):
+		for _, row := range d.rows {
+			if len(result.values) < int(args[2].(int64)) && (row[6].(int64) < args[0].(int64) || (row[7].(int64) < args[1].(int64) && row[10].(int64) == 0)) {
+				result.values = append(result.values, []driver.Value{row[0], row[1]})
+			}
+		}
+	case strings.Contains(s.query, "AND sid ="):
+		if row, ok := d.rows[fakeSQLKey(args[0], args[1])]; ok {
+			result.values = append(result.values, append([]driver.Value{}, row[:10]...))
+		}
+	case strings.Contains(s.query, "AND principal_id ="):
+		for _, row := range d.rows {
+			if row[0] == args[0] && row[4] == args[1] {
+				result.values = append(result.values, append([]driver.Value{}, row[:10]...))
+			}
+		}
+	case strings.HasPrefix(s.query, "SELECT"):
+		for _, row := range d.rows {
+			result.values = append(result.values, append([]driver.Value{}, row[:10]...))
+		}
+	default:
+		return nil, errors.New("unsupported query: " + s.query)
+	}
+	return result, nil
+}
+
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	if len(r.values) == 0 {
+		return make([]string, 10)
+	}
+	return make([]string, len(r.values[0]))
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newSQLStorePool(t *testing.T) (*SessionPool, *SQLStore, *fakeSQLDatabase) {
+	db, database := openFakeSQL(t)
+	store, err := NewSQLStore(db, fileStoreResolver, SQLStoreOptions{})
+	check(err, t)
+	check(store.Migrate(), t)
+	return newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNewFromSameAddress,
+		Store:              store,
+	}), store, database
+}
+
+func TestSQLStore_Sessions(t *testing.T) {
+	pool, store, database := newSQLStorePool(t)
+	if _, err := NewSQLStore(store.db, nil, SQLStoreOptions{}); err == nil || err.Error() != ResolverRequired {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+	_, err = pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+
+	found, err := pool.getSession(session.ID)
+	check(err, t)
+	if found == session || found.ID != session.ID || found.currentRevision() != 2 {
+		t.Error("Session is not loaded from the database")
+	}
+	found.SetAttribute("theme", "dark")
+	check(pool.saveAttributes(found), t)
+	if found, err = store.Get(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := found.Attribute("theme"); value != "dark" {
+		t.Error("Attributes are not written to the database")
+	}
+	if len(pool.getAllSessions(fileStorePrincipal)) != 2 {
+		t.Error("Sessions of the principal are not found")
+	}
+
+	_, err = pool.startSession(fileStorePrincipal, "remote2")
+	check(err, t)
+	if len(pool.getAllSessions(fileStorePrincipal)) != 1 {
+		t.Error("Sessions from other addresses are not removed")
+	}
+	if _, err = store.Get(session.ID); err == nil || err.Error() != SessionNotFound {
+		t.Error("Removed session found")
+	}
+
+	for _, statement := range database.statements {
+		if strings.Contains(statement, "?") {
+			t.Errorf("Placeholders are not replaced: %s", statement)
+		}
+	}
+}
+
+func TestSQLStore_OptimisticRefresh(t *testing.T) {
+	pool, store, _ := newSQLStorePool(t)
+
+	session, err := pool.startSession(fileStorePrincipal, "remote1")
+	check(err, t)
+
+	older, err := store.Get(session.ID)
+	check(err, t)
+	newer, err := store.Get(session.ID)
+	check(err, t)
+	older.Refresh()
+	time.Sleep(time.Millisecond)
+	newer.Refresh()
+
+	check(store.Touch([]*Session{newer}), t)
+	check(store.Touch([]*Session{older}), t)
+	stored, err := store.Get(session.ID)
+	check(err, t)
+	if !stored.lastRefresh().Equal(newer.lastRefresh()) {
+		t.Error("Older refresh time overwrote the newer one")
+	}
+
+	time.Sleep(time.Millisecond)
+	older.Refresh()
+	check(store.Touch([]*Session{older}), t)
+	stored, err = store.Get(session.ID)
+	check(err, t)
+	if !stored.lastRefresh().Equal(older.lastRefresh()) || stored.currentRevision() != 3 {
+		t.Error("Newer refresh time is not written after a conflict")
+	}
+}
+
+func TestSQLStore_DeleteExpired(t *testing.T) {
+	pool, store, _ := newSQLStorePool(t)
+
+	for i := 0; i < 5; i++ {
+		session, err := pool.startSession(fileStorePrincipal, "remote1")
+		check(err, t)
+		if i < 3 {
+			session.expirationTime = time.Now().Add(-time.Second)
+			_, err = store.Remove(session)
+			check(err, t)
+			check(store.Save(session), t)
+		}
+	}
+
+	deleted, err := store.DeleteExpired(0, 2)
+	check(err, t)
+	if deleted != 3 {
+		t.Errorf("Deleted %d sessions, expected 3", deleted)
+	}
+	count := 0
+	check(store.Range(func(session *Session) bool {
+		count++
+		return true
+	}), t)
+	if count != 2 {
+		t.Errorf("%d sessions left, expected 2", count)
+	}
+
+	saved, err := pool.startSession(ap{true, true, true}, "remote1")
+	check(err, t)
+	deleted, err = store.DeleteExpired(time.Nanosecond, 0)
+	check(err, t)
+	if deleted != 2 {
+		t.Error("Idle sessions are not deleted")
+	}
+	if _, err = store.Get(saved.ID); err != nil {
+		t.Error("Idle session of a principal saving its sessions is deleted")
+	}
+}
+
+func TestSQLStore_Query(t *testing.T) {
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	db, database := openFakeSQL(t)
+	store, err := NewSQLStore(db, func(id string) (AuthenticationPrincipal, error) {
+		return pp{ap{false, true, true}, id, policy}, nil
+	}, SQLStoreOptions{})
+	check(err, t)
+	check(store.Migrate(), t)
+	pool := newSessionPool(&sessionConfiguration{
+		Logger:             testingLogger,
+		ExpirationDuration: 10 * time.Second,
+		Timeout:            5 * time.Second,
+		MultiLogin:         AllowNew,
+		Store:              store,
+	})
+	for _, id := range []string{"alice", "al_ice", "bob", "alfred"} {
+		session, err := pool.startSession(pp{ap{false, true, true}, id, policy}, "10.0.0.1:1234")
+		check(err, t)
+		if id == "bob" {
+			session.SetAttribute("theme", "dark")
+			check(pool.saveAttributes(session), t)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	statements := len(database.statements)
+	page, err := QuerySessions(store, DefaultRealm, SessionQuery{PrincipalPrefix: "al", Limit: 2})
+	check(err, t)
+	if len(database.statements) != statements+1 || !strings.Contains(database.statements[statements], "ORDER BY start_time, sid LIMIT") {
+		t.Fatalf("Query is not native: %v", database.statements[statements:])
+	}
+	if len(page.Sessions) != 2 || page.Sessions[0].Principal.ID() != "alice" || page.Sessions[1].Principal.ID() != "al_ice" || page.Next == "" {
+		t.Fatalf("Unexpected first page %v", page.Sessions)
+	}
+	page, err = store.Query(DefaultRealm, SessionQuery{PrincipalPrefix: "al", Limit: 2, Cursor: page.Next})
+	check(err, t)
+	if len(page.Sessions) != 1 || page.Sessions[0].Principal.ID() != "alfred" || page.Next != "" {
+		t.Errorf("Unexpected second page %v", page.Sessions)
+	}
+
+	page, err = store.Query(DefaultRealm, SessionQuery{PrincipalPrefix: "al_", Order: OrderByPrincipal, Descending: true})
+	check(err, t)
+	if len(page.Sessions) != 1 || page.Sessions[0].Principal.ID() != "al_ice" {
+		t.Errorf("Prefix is not escaped %v", page.Sessions)
+	}
+	if args := strings.Count(database.statements[len(database.statements)-1], "$"); args != 3 {
+		t.Errorf("Unexpected parameters of %s", database.statements[len(database.statements)-1])
+	}
+
+	page, err = store.Query(DefaultRealm, SessionQuery{RemoteAddress: "10.0.0.0/8", Attributes: map[string]string{"theme": "dark"}})
+	check(err, t)
+	if len(page.Sessions) != 1 || page.Sessions[0].Principal.ID() != "bob" {
+		t.Errorf("Unexpected sessions %v", page.Sessions)
+	}
+	if statement := database.statements[len(database.statements)-1]; strings.Contains(statement, "LIMIT") {
+		t.Errorf("Page filtered after loading is limited: %s", statement)
+	}
+}
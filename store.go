@@ -0,0 +1,52 @@
+package porter
+
+/*
+Keeps the sessions of a SessionPool.
+
+The pool applies the session policies and the store only persists sessions,
+so a store can keep sessions in memory, in a file or in a remote database.
+Sessions of several realms may share one store. Implementations must be safe for concurrent use.
+*/
+type SessionStore interface {
+	/*
+		Saves a new session.
+	*/
+	Save(session *Session) error
+	/*
+		Finds a session by the realm and SID of the identifier.
+		Returns the SessionNotFound error if there is no such session.
+	*/
+	Get(identifier SessionIdentifier) (*Session, error)
+	/*
+		Persists the refresh time of the sessions.
+	*/
+	Touch(sessions []*Session) error
+	/*
+		Persists the attributes of the saved session, replacing the stored ones.
+		Does nothing if the session is not stored.
+	*/
+	SaveAttributes(session *Session) error
+	/*
+		Removes the session. Returns FALSE if the session is not stored.
+	*/
+	Remove(session *Session) (bool, error)
+	/*
+		Returns all sessions of the principal in the realm.
+	*/
+	ByPrincipal(realm string, principalId string) ([]*Session, error)
+	/*
+		Calls the function for every stored session until it returns FALSE.
+	*/
+	Range(fn func(session *Session) bool) error
+}
+
+/*
+SessionStore able to query sessions natively, for example by indexes of a database.
+Other stores are queried by scanning Range. See: QuerySessions
+*/
+type QueryableStore interface {
+	/*
+		Returns the page of the sessions of the realm matching the query.
+	*/
+	Query(realm string, query SessionQuery) (*SessionPage, error)
+}
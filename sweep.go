@@ -0,0 +1,88 @@
+package porter
+
+import (
+	"context"
+	"time"
+)
+
+/*
+Ends the expired sessions of the pool in the background, so their EventSessionEnded is emitted
+even if they are never looked up again. See: Configuration.SweepInterval
+*/
+type sweeper struct {
+	pool     *SessionPool
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+/*
+Returns nil if the expired sessions should not be swept.
+*/
+func newSweeper(pool *SessionPool, interval time.Duration) *sweeper {
+	if interval <= 0 {
+		return nil
+	}
+	s := &sweeper{
+		pool:     pool,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *sweeper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+/*
+Ends the expired sessions, the expiration is checked again under the principal lock.
+*/
+func (s *sweeper) sweep() {
+	sp := s.pool
+	expired := []*Session{}
+	err := sp.rangeSessions(func(session *Session) bool {
+		if sp.refresher != nil {
+			sp.refresher.restore(session)
+		}
+		if session.expiredBy(sp.configuration) != "" {
+			expired = append(expired, session)
+		}
+		return true
+	})
+	if err != nil {
+		sp.configuration.logger().Warn("Sweep failed", "error", err)
+	}
+	for _, session := range expired {
+		lock := sp.principalLock(session.Principal.ID())
+		lock.Lock()
+		if sp.refresher != nil {
+			sp.refresher.restore(session)
+		}
+		if reason := session.expiredBy(sp.configuration); reason != "" {
+			sp.configuration.logger().Info("Session expired", sessionFields(session, "reason", reason)...)
+			sp.removeSessionUnsafe(context.Background(), session, reason)
+			lock.Unlock()
+			sp.publishRemovals(removal{session, reason})
+			continue
+		}
+		lock.Unlock()
+	}
+}
+
+func (s *sweeper) close() {
+	close(s.stop)
+	<-s.done
+}
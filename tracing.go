@@ -0,0 +1,136 @@
+package porter
+
+import (
+	"context"
+)
+
+/*
+Starts the spans of logins and authentications.
+
+The interface is minimal so an OpenTelemetry tracer is adapted in a few lines:
+Start calls trace.Tracer.Start and SetAttribute maps the value to an attribute.KeyValue.
+*/
+type Tracer interface {
+	/*
+		Starts a span as a child of the span of the context, returns the context of the new span.
+	*/
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	/*
+		Sets the attribute, the value is a string, bool or int.
+	*/
+	SetAttribute(key string, value interface{})
+	/*
+		Records the error the span failed with.
+	*/
+	RecordError(err error)
+	End()
+}
+
+/*
+Names of the spans.
+*/
+const (
+	SpanLogin               = "porter.Login"
+	SpanAuthenticate        = "porter.Authenticate"
+	SpanLoginFilter         = "porter.LoginFilter"
+	SpanSuccessLoginHandler = "porter.SuccessLoginHandler"
+	SpanNewSession          = "porter.SessionPool.newSession"
+	/*
+		Waiting for the lock serializing the logins of the principal.
+	*/
+	SpanPrincipalLock    = "porter.SessionPool.lock"
+	SpanStoreGet         = "porter.SessionStore.Get"
+	SpanStoreSave        = "porter.SessionStore.Save"
+	SpanStoreTouch       = "porter.SessionStore.Touch"
+	SpanStoreRemove      = "porter.SessionStore.Remove"
+	SpanStoreByPrincipal = "porter.SessionStore.ByPrincipal"
+)
+
+/*
+Names of the span attributes.
+*/
+const (
+	AttributeRealm       = "porter.realm"
+	AttributePrincipalID = "porter.principal_id"
+	/*
+		"success" or "failure".
+	*/
+	AttributeOutcome = "porter.outcome"
+	/*
+		The reason of a failure or of a removal, see: Event.Reason
+	*/
+	AttributeReason = "porter.reason"
+	/*
+		The MultiLoginType applied to the login.
+	*/
+	AttributeMultiLogin = "porter.multi_login"
+	/*
+		What the multi login policy decided: "none" without other sessions, "allow", "reject",
+		"expire_current" or "expire_other_addresses".
+	*/
+	AttributeMultiLoginDecision = "porter.multi_login.decision"
+	/*
+		The number of sessions closed by the login.
+	*/
+	AttributeEvicted = "porter.evicted"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+/*
+Returns the context of the calls made without a context.
+*/
+func background() context.Context {
+	return context.Background()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+func (t MultiLoginType) String() string {
+	switch t {
+	case FailNew:
+		return "FailNew"
+	case ExpireCurrent:
+		return "ExpireCurrent"
+	case AllowNew:
+		return "AllowNew"
+	case AllowNewFromSameAddress:
+		return "AllowNewFromSameAddress"
+	}
+	return "Unknown"
+}
+
+/*
+Starts the span with the configured tracer, a span doing nothing without a tracer.
+*/
+func (sp *SessionPool) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if sp.configuration.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := sp.configuration.Tracer.Start(ctx, name)
+	span.SetAttribute(AttributeRealm, sp.configuration.Realm)
+	return ctx, span
+}
+
+/*
+Sets the outcome of the span and ends it.
+*/
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetAttribute(AttributeOutcome, OutcomeFailure)
+		span.RecordError(err)
+	} else {
+		span.SetAttribute(AttributeOutcome, OutcomeSuccess)
+	}
+	span.End()
+}
@@ -0,0 +1,169 @@
+package porter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attributes: map[string]interface{}{}}
+	r.lock.Lock()
+	r.spans = append(r.spans, span)
+	r.lock.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+/*
+Returns the spans as "parent>name" and resets the recording.
+*/
+func (r *recordingTracer) take() ([]string, map[string]*recordedSpan) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := []string{}
+	byName := map[string]*recordedSpan{}
+	for _, span := range r.spans {
+		name := span.name
+		if span.parent != nil {
+			name = span.parent.name + ">" + name
+		}
+		names = append(names, name)
+		byName[span.name] = span
+	}
+	r.spans = nil
+	return names, byName
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	policy := func(defaults SessionPolicy) SessionPolicy {
+		return defaults
+	}
+	var principal AuthenticationPrincipal = pp{ap{false, true, true}, "user", policy}
+	security := CreateNew(&Configuration{
+		SuccessLoginHandler: func(context interface{}, session *Session) {},
+		LoginFilter: func(context interface{}) (AuthenticationPrincipal, string, error) {
+			return principal, "remote1", nil
+		},
+		AuthenticationFilter: func(context interface{}) SessionIdentifier {
+			return context.(SessionIdentifier)
+		},
+		Logger:         testingLogger,
+		ExpirationTime: 10 * time.Second,
+		Timeout:        5 * time.Second,
+		MultiLogin:     ExpireCurrent,
+		Tracer:         tracer,
+	})
+
+	_, err := security.Login(nil)
+	check(err, t)
+	tracer.take()
+	ctx, parent := tracer.Start(context.Background(), "request")
+	session, err := security.LoginWithContext(ctx, nil)
+	check(err, t)
+
+	names, spans := tracer.take()
+	expected := []string{
+		"request",
+		"request>porter.Login",
+		"porter.Login>porter.LoginFilter",
+		"porter.Login>porter.SessionPool.newSession",
+		"porter.SessionPool.newSession>porter.SessionPool.lock",
+		"porter.SessionPool.newSession>porter.SessionStore.ByPrincipal",
+		"porter.SessionPool.newSession>porter.SessionStore.Remove",
+		"porter.SessionPool.newSession>porter.SessionStore.Save",
+		"porter.Login>porter.SuccessLoginHandler",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Unexpected spans %v", names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Unexpected span %s, expected %s", names[i], expected[i])
+		}
+	}
+	newSession := spans[SpanNewSession]
+	if newSession.attributes[AttributeMultiLogin] != "ExpireCurrent" ||
+		newSession.attributes[AttributeMultiLoginDecision] != "expire_current" ||
+		newSession.attributes[AttributeEvicted] != 1 {
+		t.Errorf("Unexpected attributes %v", newSession.attributes)
+	}
+	if spans[SpanStoreRemove].attributes[AttributeReason] != ReasonMultiLogin {
+		t.Error("Removal reason is not traced")
+	}
+	for _, span := range spans {
+		if !span.ended && span != parent {
+			t.Errorf("Span %s is not ended", span.name)
+		}
+	}
+	if login := spans[SpanLogin]; login.attributes[AttributeOutcome] != OutcomeSuccess || login.attributes[AttributeRealm] != DefaultRealm {
+		t.Errorf("Unexpected attributes %v", login.attributes)
+	}
+
+	_, err = security.AuthenticateWithContext(ctx, session.ID)
+	check(err, t)
+	names, _ = tracer.take()
+	if len(names) != 3 || names[0] != "request>porter.Authenticate" ||
+		names[1] != "porter.Authenticate>porter.SessionStore.Get" || names[2] != "porter.Authenticate>porter.SessionStore.Touch" {
+		t.Errorf("Unexpected spans %v", names)
+	}
+
+	principal = pp{ap{false, false, false}, "user", policy}
+	security.defaultRealm.pool.configuration.MultiLogin = FailNew
+	if _, err = security.LoginWithContext(ctx, nil); err == nil {
+		t.Fatal("Principal not allowed to login logged in")
+	}
+	_, spans = tracer.take()
+	if login := spans[SpanLogin]; login.attributes[AttributeOutcome] != OutcomeFailure || login.attributes[AttributeReason] != ReasonCannotLogin || login.err == nil {
+		t.Errorf("Unexpected attributes %v", login.attributes)
+	}
+
+	principal = pp{ap{false, true, false}, "user", policy}
+	if _, err = security.LoginWithContext(ctx, nil); err == nil {
+		t.Fatal("Second session started")
+	}
+	_, spans = tracer.take()
+	if newSession := spans[SpanNewSession]; newSession.attributes[AttributeMultiLoginDecision] != "reject" || newSession.attributes[AttributeOutcome] != OutcomeFailure {
+		t.Errorf("Unexpected attributes %v", newSession.attributes)
+	}
+	if login := spans[SpanLogin]; login.attributes[AttributeReason] != ReasonAlreadyStarted {
+		t.Errorf("Unexpected attributes %v", login.attributes)
+	}
+
+	if _, err = security.AuthenticateWithContext(ctx, SessionIdentifier{SID: "unknown"}); err == nil {
+		t.Fatal("Unknown session found")
+	}
+	_, spans = tracer.take()
+	if authenticate := spans[SpanAuthenticate]; authenticate.attributes[AttributeReason] != SessionNotFound {
+		t.Errorf("Unexpected attributes %v", authenticate.attributes)
+	}
+}